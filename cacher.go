@@ -1,11 +1,15 @@
 package pgxaws
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -14,25 +18,176 @@ import (
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/guregu/dynamo/v2"
 	"github.com/pgx-contrib/pgxcache"
 )
 
-// DynamoQuery represents a record in the DynamoDB cache table.
+// QueryEntry is a cached query item together with the metadata stored next
+// to it.
+type QueryEntry struct {
+	// Key is the key of the entry within the cacher namespace, as returned by
+	// pgxcache.QueryKey.String.
+	Key string
+	// Item is the cached query result. It is nil for entries returned by
+	// Entries, which only reads metadata.
+	Item *pgxcache.QueryItem
+	// Size is the size in bytes of the encoded item.
+	Size int64
+	// SQL is the text of the query, when the cacher stores it (see StoreSQL).
+	SQL string
+	// ExpireAt is the time at which the entry expires and must no longer be
+	// served (hard expiry).
+	ExpireAt time.Time
+	// RefreshAt is the time after which the entry is stale and should be
+	// refreshed, while it may still be served until ExpireAt (soft expiry).
+	// It is zero for entries that have no soft expiry.
+	RefreshAt time.Time
+	// CreatedAt is the time at which the result was produced. With
+	// conditional writes (see DynamoQueryCacher.ConditionalWrites), an entry
+	// only replaces an entry created earlier. SetEntry uses the time of the
+	// call when it is zero.
+	CreatedAt time.Time
+}
+
+// Expired reports whether the entry has expired.
+func (x *QueryEntry) Expired() bool {
+	return !time.Now().Before(x.ExpireAt)
+}
+
+// Stale reports whether the entry has passed its soft expiry.
+func (x *QueryEntry) Stale() bool {
+	return !x.RefreshAt.IsZero() && !time.Now().Before(x.RefreshAt)
+}
+
+// QueryEntryCacher is a pgxcache.QueryCacher that also exposes the metadata of
+// the entries it stores.
+type QueryEntryCacher interface {
+	pgxcache.QueryCacher
+	// GetEntry returns the entry stored for the key, or nil when there is none.
+	// Unlike Get, it also returns entries that have expired but have not been
+	// removed from the backend yet.
+	GetEntry(context.Context, *pgxcache.QueryKey) (*QueryEntry, error)
+	// SetEntry stores the entry for the key together with its metadata.
+	SetEntry(context.Context, *pgxcache.QueryKey, *QueryEntry) error
+}
+
+// DynamoQuery represents a record in the DynamoDB cache table. The struct
+// tags give the attribute names of the default schema (see DynamoSchema).
 type DynamoQuery struct {
-	ID       string    `dynamo:"query_id,hash"`
-	Data     []byte    `dynamo:"query_data"`
-	ExpireAt time.Time `dynamo:"query_expire_at,unixtime"`
+	// ID is the key of the record within the cacher namespace.
+	ID        string    `dynamodbav:"query_id"`
+	Data      []byte    `dynamodbav:"query_data"`
+	Size      int64     `dynamodbav:"query_size,omitempty"`
+	SQL       string    `dynamodbav:"query_sql,omitempty"`
+	ExpireAt  time.Time `dynamodbav:"query_expire_at,unixtime"`
+	RefreshAt time.Time `dynamodbav:"query_refresh_at,unixtime,omitempty"`
+	Checksum  string    `dynamodbav:"query_checksum,omitempty"`
+	// Generation orders the writes of the record. It is the time at which
+	// the result was produced, in nanoseconds since the Unix epoch.
+	Generation int64 `dynamodbav:"query_generation,omitempty"`
 }
 
-var _ pgxcache.QueryCacher = &DynamoQueryCacher{}
+// item returns the DynamoDB attributes of the record, except for its primary
+// key.
+func (x *DynamoQuery) item(schema *DynamoSchema) map[string]dynamodbtypes.AttributeValue {
+	item := map[string]dynamodbtypes.AttributeValue{
+		schema.Data: &dynamodbtypes.AttributeValueMemberB{Value: x.Data},
+		schema.TTL:  unixTimeAttr(x.ExpireAt),
+	}
+	if x.Size > 0 {
+		item[schema.Size] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(x.Size, 10)}
+	}
+	if x.SQL != "" {
+		item[schema.SQL] = &dynamodbtypes.AttributeValueMemberS{Value: x.SQL}
+	}
+	if !x.RefreshAt.IsZero() {
+		item[schema.RefreshAt] = unixTimeAttr(x.RefreshAt)
+	}
+	if x.Checksum != "" {
+		item[schema.Checksum] = &dynamodbtypes.AttributeValueMemberS{Value: x.Checksum}
+	}
+	if x.Generation != 0 {
+		item[schema.Generation] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(x.Generation, 10)}
+	}
+	return item
+}
+
+// unmarshal reads the record from DynamoDB attributes, except for its primary
+// key. Attributes that are missing, for example because they were not
+// projected, are left zero.
+func (x *DynamoQuery) unmarshal(schema *DynamoSchema, item map[string]dynamodbtypes.AttributeValue) error {
+	for name, value := range item {
+		var err error
+		switch name {
+		case schema.Data:
+			x.Data, err = bytesAttr(name, value)
+		case schema.Size:
+			x.Size, err = numberAttr(name, value)
+		case schema.SQL:
+			x.SQL, err = stringAttr(name, value)
+		case schema.TTL:
+			x.ExpireAt, err = unixTimeValue(name, value)
+		case schema.RefreshAt:
+			x.RefreshAt, err = unixTimeValue(name, value)
+		case schema.Checksum:
+			x.Checksum, err = stringAttr(name, value)
+		case schema.Generation:
+			x.Generation, err = numberAttr(name, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ QueryEntryCacher = &DynamoQueryCacher{}
 
 // DynamoQueryCacher implements pgxcache.QueryCacher interface to use DynamoDB.
 type DynamoQueryCacher struct {
 	// Client to interact with DynamoDB.
-	Client *dynamodb.Client
+	Client DynamoClient
 	// Table name in DynamoDB.
 	Table string
+	// Namespace scopes every key written by the cacher, so that several
+	// applications, environments or schema versions can share one table
+	// (e.g. "billing/prod/v3"). Reset only removes items in the namespace:
+	// namespaces are not nested, so "billing/prod" does not include
+	// "billing/prod/v3".
+	Namespace string
+	// ResetOptions controls the concurrency and strategy of Reset.
+	ResetOptions *ResetOptions
+	// StoreSQL stores the text of each query next to its result, so that it
+	// is returned by Entries.
+	StoreSQL bool
+	// Codec encodes the cached items. It defaults to TextCodec. The
+	// built-in codecs decode each other's items, so it can be changed
+	// without invalidating existing entries.
+	Codec QueryCodec
+	// Schema describes the attribute names and key schema of the table. It
+	// defaults to the layout created by EnsureTable.
+	Schema *DynamoSchema
+	// Checksum stores a checksum of each result next to it. Results whose
+	// checksum does not match are reported as missing and deleted, whatever
+	// the setting of the reading cacher.
+	Checksum ChecksumAlgorithm
+	// ConsistentRead makes reads strongly consistent, so that an entry is
+	// returned right after it has been written. Strongly consistent reads
+	// consume twice the read capacity.
+	ConsistentRead bool
+	// ConditionalWrites makes writes conditional on the generation stored
+	// with each entry, so that an entry never replaces one whose result was
+	// produced later (see QueryEntry.CreatedAt). Writes that lose the race
+	// are dropped without error.
+	ConditionalWrites bool
+	// DAX, if set, is a DynamoDB Accelerator client that serves the reads and
+	// writes of entries, while Client keeps serving provisioning, Entries and
+	// the scans of Reset. Eventually consistent reads are answered from the
+	// DAX item cache, including misses, which writes through DAX update
+	// (write-through). Writes made to the table without DAX, e.g. by other
+	// cachers, and items removed by DynamoDB TTL are not seen until they
+	// leave the item cache after its TTL, so every cacher of the table should
+	// use DAX. ConsistentRead reads bypass the item cache.
+	DAX DAXClient
 }
 
 // NewDynamoQueryCacher creates a new DynamoQueryCacher using the default AWS configuration.
@@ -47,86 +202,169 @@ func NewDynamoQueryCacher(ctx context.Context, table string) (*DynamoQueryCacher
 	}, nil
 }
 
-// Get retrieves a cache item from DynamoDB.
+// Get retrieves a cache item from DynamoDB. Items that have expired but have
+// not been removed by DynamoDB TTL yet are treated as missing.
 func (r *DynamoQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
-	row := &DynamoQuery{}
-	client := dynamo.NewFromIface(r.Client)
-
-	err := client.Table(r.Table).Get("query_id", key.String()).One(ctx, row)
-	switch err {
-	case nil:
-		item := &pgxcache.QueryItem{}
-		if err := item.UnmarshalText(row.Data); err != nil {
-			return nil, err
-		}
-		return item, nil
-	case dynamo.ErrNotFound:
+	entry, err := r.GetEntry(ctx, key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if entry.Expired() {
+		return nil, nil
+	}
+	return entry.Item, nil
+}
+
+// GetEntry retrieves a cache entry from DynamoDB, including its expiration
+// time. Expired entries are returned, and reported as expired to
+// InstrumentedQueryCacher.
+func (r *DynamoQueryCacher) GetEntry(ctx context.Context, key *pgxcache.QueryKey) (*QueryEntry, error) {
+	schema := r.schema()
+	out, err := r.dataClient().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:              aws.String(r.Table),
+		Key:                    r.primaryKey(schema, key.String()),
+		ConsistentRead:         aws.Bool(r.ConsistentRead),
+		ReturnConsumedCapacity: dynamodbtypes.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recordStats(ctx, func(stats *cacheStats) { stats.consumedCapacity += capacityUnits(out.ConsumedCapacity) })
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	entry, err := r.entry(ctx, schema, key.String(), out.Item)
+	if entry != nil && entry.Expired() {
+		recordStats(ctx, func(stats *cacheStats) { stats.expired = true })
+	}
+	return entry, err
+}
+
+// entry decodes the cache entry stored in an item read from the table. Items
+// whose checksum does not match are deleted and reported as missing.
+func (r *DynamoQueryCacher) entry(ctx context.Context, schema *DynamoSchema, id string, attributes map[string]dynamodbtypes.AttributeValue) (*QueryEntry, error) {
+	row := &DynamoQuery{ID: id}
+	if err := row.unmarshal(schema, attributes); err != nil {
+		return nil, err
+	}
+
+	recordStats(ctx, func(stats *cacheStats) { stats.bytesRead += int64(len(row.Data)) })
+	if !verifyChecksum(row.Checksum, row.Data) {
+		r.deleteCorrupt(ctx, schema, row)
 		return nil, nil
-	default:
+	}
+
+	item := &pgxcache.QueryItem{}
+	if err := codecOrDefault(r.Codec).Unmarshal(row.Data, item); err != nil {
 		return nil, err
 	}
+	entry := &QueryEntry{
+		Key:       id,
+		Item:      item,
+		Size:      int64(len(row.Data)),
+		SQL:       row.SQL,
+		ExpireAt:  row.ExpireAt,
+		RefreshAt: row.RefreshAt,
+	}
+	if row.Generation != 0 {
+		entry.CreatedAt = time.Unix(0, row.Generation).UTC()
+	}
+	return entry, nil
 }
 
 // Set stores a cache item in DynamoDB with the provided TTL.
-// The table must have TTL enabled on the query_expire_at attribute for
-// automatic item expiration.
+// The table must have TTL enabled on the TTL attribute of the schema for
+// automatic item expiration (see EnsureTable).
 func (r *DynamoQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
-	data, err := item.MarshalText()
+	return r.SetEntry(ctx, key, &QueryEntry{
+		Item:     item,
+		ExpireAt: time.Now().UTC().Add(lifetime),
+	})
+}
+
+// SetEntry stores a cache entry in DynamoDB. ExpireAt is used as the TTL of
+// the item.
+func (r *DynamoQueryCacher) SetEntry(ctx context.Context, key *pgxcache.QueryKey, entry *QueryEntry) error {
+	schema := r.schema()
+	item, size, err := r.item(schema, key, entry)
 	if err != nil {
 		return err
 	}
 
-	row := &DynamoQuery{
-		ID:       key.String(),
-		Data:     data,
-		ExpireAt: time.Now().UTC().Add(lifetime),
+	input := &dynamodb.PutItemInput{
+		TableName:              aws.String(r.Table),
+		Item:                   item,
+		ReturnConsumedCapacity: dynamodbtypes.ReturnConsumedCapacityTotal,
+	}
+	if r.ConditionalWrites {
+		// Items written without a generation are always replaced.
+		input.ConditionExpression = aws.String("attribute_not_exists(#gen) OR #gen < :gen")
+		input.ExpressionAttributeNames = map[string]string{"#gen": schema.Generation}
+		input.ExpressionAttributeValues = map[string]dynamodbtypes.AttributeValue{
+			":gen": item[schema.Generation],
+		}
 	}
 
-	client := dynamo.NewFromIface(r.Client)
-	return client.Table(r.Table).Put(row).Run(ctx)
-}
+	out, err := r.dataClient().PutItem(ctx, input)
+	var cerr *dynamodbtypes.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &cerr):
+		// A newer entry has been written in the meantime.
+		return nil
+	case err != nil:
+		return err
+	}
 
-// Reset deletes all items from the DynamoDB cache table.
-func (r *DynamoQueryCacher) Reset(ctx context.Context) error {
-	// Project only the hash key — we only need keys to issue deletes.
-	// Using an expression attribute name avoids conflicts with DynamoDB reserved words.
-	paginator := dynamodb.NewScanPaginator(r.Client, &dynamodb.ScanInput{
-		TableName:                aws.String(r.Table),
-		ProjectionExpression:     aws.String("#qid"),
-		ExpressionAttributeNames: map[string]string{"#qid": "query_id"},
+	recordStats(ctx, func(stats *cacheStats) {
+		stats.consumedCapacity += capacityUnits(out.ConsumedCapacity)
+		stats.bytesWritten += size
 	})
+	return nil
+}
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return err
-		}
+// item returns the item that stores the cache entry, including its primary
+// key, and the size of the encoded result.
+func (r *DynamoQueryCacher) item(schema *DynamoSchema, key *pgxcache.QueryKey, entry *QueryEntry) (map[string]dynamodbtypes.AttributeValue, int64, error) {
+	createdAt := entry.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
 
-		// BatchWriteItem accepts at most 25 requests per call.
-		for i := 0; i < len(page.Items); i += 25 {
-			end := min(i+25, len(page.Items))
-			deletes := make([]dynamodbtypes.WriteRequest, end-i)
-			for j, item := range page.Items[i:end] {
-				deletes[j] = dynamodbtypes.WriteRequest{
-					DeleteRequest: &dynamodbtypes.DeleteRequest{Key: item},
-				}
-			}
+	data, err := codecOrDefault(r.Codec).Marshal(entry.Item)
+	if err != nil {
+		return nil, 0, err
+	}
 
-			// Retry any unprocessed items returned by DynamoDB.
-			input := &dynamodb.BatchWriteItemInput{
-				RequestItems: map[string][]dynamodbtypes.WriteRequest{r.Table: deletes},
-			}
-			for len(input.RequestItems) > 0 {
-				out, err := r.Client.BatchWriteItem(ctx, input)
-				if err != nil {
-					return err
-				}
-				input.RequestItems = out.UnprocessedItems
-			}
-		}
+	row := &DynamoQuery{
+		ID:         key.String(),
+		Data:       data,
+		Size:       int64(len(data)),
+		ExpireAt:   entry.ExpireAt.UTC(),
+		RefreshAt:  entry.RefreshAt.UTC(),
+		Checksum:   r.Checksum.checksum(data),
+		Generation: createdAt.UnixNano(),
+	}
+	if r.StoreSQL {
+		row.SQL = key.SQL
 	}
 
-	return nil
+	item := row.item(schema)
+	maps.Copy(item, r.primaryKey(schema, row.ID))
+	return item, row.Size, nil
+}
+
+// Reset deletes all items in the cacher namespace from the DynamoDB cache
+// table. Without a namespace every item in the table is deleted, unless the
+// table has a sort key: the entries of a cacher without namespace then have a
+// partition of their own, and only that partition is deleted. How the items
+// are deleted is controlled by ResetOptions.
+func (r *DynamoQueryCacher) Reset(ctx context.Context) error {
+	if r.ResetOptions != nil && r.ResetOptions.Recreate {
+		return r.recreateTable(ctx)
+	}
+	return r.deleteItems(ctx, r.ResetOptions)
 }
 
 // metaKeyExpiresAt is the S3 user-defined metadata key that stores the
@@ -134,14 +372,89 @@ func (r *DynamoQueryCacher) Reset(ctx context.Context) error {
 // S3 normalises user-defined metadata keys to lowercase on write.
 const metaKeyExpiresAt = "expires-at"
 
-var _ pgxcache.QueryCacher = &S3QueryCacher{}
+// metaKeyRefreshAt is the S3 user-defined metadata key that stores the soft
+// expiration time of the cache item as an RFC 3339 timestamp.
+const metaKeyRefreshAt = "refresh-at"
+
+// metaKeySQL is the S3 user-defined metadata key that stores the text of the
+// query, escaped with url.QueryEscape as metadata values must be ASCII.
+const metaKeySQL = "query-sql"
+
+// metaSQLMaxSize is the maximum size of the escaped query text stored in
+// object metadata. S3 limits user-defined metadata to 2 KiB in total.
+const metaSQLMaxSize = 1024
+
+var _ QueryEntryCacher = &S3QueryCacher{}
 
 // S3QueryCacher implements pgxcache.QueryCacher interface to use S3.
+//
+// The bucket may be an S3 Express One Zone directory bucket, whose name ends
+// with "--x-s3". The SDK client authenticates requests to directory buckets
+// with sessions, which needs the s3express:CreateSession permission. Objects
+// in directory buckets carry their metadata in a header that precedes the
+// encoded result instead of user-defined metadata, and expired objects are
+// deleted by Get when they are read.
 type S3QueryCacher struct {
 	// Client to interact with S3.
-	Client *s3.Client
+	Client S3Client
 	// Bucket name in S3.
 	Bucket string
+	// Namespace scopes every object written by the cacher under a key prefix,
+	// so that several applications, environments or schema versions can share
+	// one bucket (e.g. "billing/prod/v3"). Reset only removes objects under
+	// the prefix. Slashes and other special characters are escaped in the
+	// prefix ("billing%2Fprod%2Fv3/"), so that namespaces are not nested:
+	// "billing/prod" does not include "billing/prod/v3".
+	Namespace string
+	// ResetOptions controls the concurrency and strategy of Reset.
+	ResetOptions *ResetOptions
+	// StoreSQL stores the text of each query in object metadata, so that it
+	// is returned by Entries. Queries whose escaped text is longer than 1 KiB
+	// are not stored, as S3 limits the size of user-defined metadata.
+	StoreSQL bool
+	// Codec encodes the cached items. It defaults to TextCodec. The
+	// built-in codecs decode each other's items, so it can be changed
+	// without invalidating existing entries. Items of a QueryStreamCodec,
+	// such as FramedCodec, are streamed to S3 in parts of PartSize bytes.
+	Codec QueryCodec
+	// PartSize bounds the memory used by Set to store the items of a
+	// QueryStreamCodec: items are encoded into a buffer of PartSize bytes,
+	// and items that do not fit are stored with a multipart upload, one part
+	// at a time. Such items carry no checksum in their metadata, and rely on
+	// the checksums of their frames instead. Defaults to 8 MiB, with a
+	// minimum of 5 MiB.
+	PartSize int
+	// Checksum stores a checksum of each result in object metadata, and has
+	// S3 verify it on upload. Objects whose checksum does not match are
+	// reported as missing and deleted, whatever the setting of the reading
+	// cacher.
+	Checksum ChecksumAlgorithm
+	// Layout shards the object keys over several prefixes and optionally
+	// groups them by expiry day (see S3KeyLayout). By default objects are
+	// stored directly under the namespace.
+	Layout *S3KeyLayout
+	// Encryption sets the server-side encryption of the objects, and the
+	// customer key sent on reads with SSE-C. By default the objects are
+	// encrypted with the default encryption of the bucket.
+	Encryption *S3Encryption
+	// StorageClass is the storage class of the objects. By default S3 uses
+	// STANDARD, or EXPRESS_ONEZONE in directory buckets.
+	StorageClass s3types.StorageClass
+	// Tags are set on every object, e.g. for cost allocation. Tags need the
+	// s3:PutObjectTagging permission.
+	Tags map[string]string
+	// ExpectedBucketOwner is the account ID of the owner of the bucket. When
+	// set, every request fails unless the bucket belongs to this account.
+	ExpectedBucketOwner string
+	// Hedge sends a second read of an entry when the first one is slow to
+	// respond, and uses the first response (see HedgeOptions). Hedged reads
+	// cost an extra request each. By default reads are not hedged.
+	Hedge *HedgeOptions
+	// BatchConcurrency is the number of requests issued concurrently by
+	// GetMany and SetMany. Defaults to 16.
+	BatchConcurrency int
+
+	latencies hedgeLatencies
 }
 
 // NewS3QueryCacher creates a new S3QueryCacher using the default AWS configuration.
@@ -158,10 +471,36 @@ func NewS3QueryCacher(ctx context.Context, bucket string) (*S3QueryCacher, error
 
 // Get retrieves a cache item from S3.
 func (r *S3QueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
-	row, err := r.Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(r.Bucket),
-		Key:    aws.String(key.String()),
-	})
+	entry, err := r.getEntry(ctx, key, false)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.Item, nil
+}
+
+// GetEntry retrieves a cache entry from S3, including its expiration time.
+// Expired entries are returned, and reported as expired to
+// InstrumentedQueryCacher.
+func (r *S3QueryCacher) GetEntry(ctx context.Context, key *pgxcache.QueryKey) (*QueryEntry, error) {
+	return r.getEntry(ctx, key, true)
+}
+
+// getEntry retrieves a cache entry from S3, looking it up at every storage key
+// allowed by the key layout. Unless expired is set, expired entries are
+// reported as missing without reading the object body.
+func (r *S3QueryCacher) getEntry(ctx context.Context, key *pgxcache.QueryKey, expired bool) (*QueryEntry, error) {
+	for _, id := range r.objectKeys(key.String()) {
+		entry, err := r.readEntry(ctx, id, key, expired)
+		if err != nil || entry != nil {
+			return entry, err
+		}
+	}
+	return nil, nil
+}
+
+// readEntry reads the cache entry stored at the given storage key.
+func (r *S3QueryCacher) readEntry(ctx context.Context, id string, key *pgxcache.QueryKey, expired bool) (*QueryEntry, error) {
+	row, err := r.getObject(ctx, r.getObjectInput(id))
 	if err != nil {
 		var nerr *s3types.NotFound
 		if errors.As(err, &nerr) {
@@ -175,83 +514,236 @@ func (r *S3QueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxca
 	}
 	defer row.Body.Close()
 
-	// Check the client-side TTL stored in object metadata.
-	if v, ok := row.Metadata[metaKeyExpiresAt]; ok {
-		if t, err := time.Parse(time.RFC3339, v); err == nil && time.Now().UTC().After(t) {
+	// Objects in directory buckets carry their metadata in a header.
+	body := bufio.NewReader(row.Body)
+	metadata := row.Metadata
+	if r.directory() {
+		if metadata, _, err = readObjectHeader(body); err != nil {
+			return nil, err
+		}
+	}
+
+	entry := metadataEntry(metadata)
+	entry.Key = key.String()
+	if !entry.ExpireAt.IsZero() && entry.Expired() {
+		recordStats(ctx, func(stats *cacheStats) { stats.expired = true })
+		if !expired {
+			if r.directory() {
+				r.deleteExpired(ctx, id, row.ETag)
+			}
 			return nil, nil
 		}
 	}
 
-	data, err := io.ReadAll(row.Body)
+	// Framed items are decoded as they are read, whatever the codec.
+	if magic, _ := body.Peek(len(framedMagic)); string(magic) == framedMagic {
+		return r.readStream(ctx, id, row.ETag, metadata[metaKeyChecksum], body, entry)
+	}
+
+	data, err := io.ReadAll(body)
+	recordStats(ctx, func(stats *cacheStats) { stats.bytesRead += int64(len(data)) })
 	if err != nil {
 		return nil, err
 	}
 
-	item := &pgxcache.QueryItem{}
-	if err := item.UnmarshalText(data); err != nil {
+	if !verifyChecksum(metadata[metaKeyChecksum], data) {
+		r.deleteCorrupt(ctx, id, row.ETag)
+		return nil, nil
+	}
+
+	entry.Size = int64(len(data))
+	entry.Item = &pgxcache.QueryItem{}
+	if err := codecOrDefault(r.Codec).Unmarshal(data, entry.Item); err != nil {
 		return nil, err
 	}
-	return item, nil
+	return entry, nil
 }
 
 // Set stores a cache item in S3. The expiration time is recorded in object
 // metadata (expires-at) and enforced client-side by Get. Objects are not
 // automatically deleted by S3 unless a matching lifecycle rule is configured
-// on the bucket.
+// on the bucket (see EnsureBucket), by Get in directory buckets, or by an
+// S3Janitor.
 func (r *S3QueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, ttl time.Duration) error {
-	data, err := item.MarshalText()
+	return r.SetEntry(ctx, key, &QueryEntry{
+		Item:     item,
+		ExpireAt: time.Now().UTC().Add(ttl),
+	})
+}
+
+// SetEntry stores a cache entry in S3. The expiration times are recorded in
+// object metadata.
+func (r *S3QueryCacher) SetEntry(ctx context.Context, key *pgxcache.QueryKey, entry *QueryEntry) error {
+	if err := r.Layout.check(entry.ExpireAt); err != nil {
+		return err
+	}
+
+	metadata := map[string]string{
+		metaKeyExpiresAt: entry.ExpireAt.UTC().Format(time.RFC3339),
+	}
+	if !entry.RefreshAt.IsZero() {
+		metadata[metaKeyRefreshAt] = entry.RefreshAt.UTC().Format(time.RFC3339)
+	}
+	if sql := url.QueryEscape(key.SQL); r.StoreSQL && len(sql) <= metaSQLMaxSize {
+		metadata[metaKeySQL] = sql
+	}
+
+	id := r.objectKey(key.String(), entry.ExpireAt)
+	if err := r.storeEntry(ctx, id, metadata, entry.Item); err != nil {
+		return err
+	}
+	return r.deleteCopies(ctx, key.String(), id)
+}
+
+// storeEntry encodes the item and stores it with its metadata at the given
+// storage key.
+func (r *S3QueryCacher) storeEntry(ctx context.Context, id string, metadata map[string]string, item *pgxcache.QueryItem) error {
+	codec := codecOrDefault(r.Codec)
+	if stream, ok := codec.(QueryStreamCodec); ok {
+		return r.streamEntry(ctx, id, metadata, stream, item)
+	}
+
+	data, err := codec.Marshal(item)
 	if err != nil {
 		return err
 	}
+	return r.putEntry(ctx, id, metadata, data)
+}
 
-	_, err = r.Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(r.Bucket),
-		Key:    aws.String(key.String()),
-		Body:   bytes.NewReader(data),
-		Metadata: map[string]string{
-			metaKeyExpiresAt: time.Now().UTC().Add(ttl).Format(time.RFC3339),
-		},
-	})
+// deleteCopies deletes the copies of the entry with the given key within the
+// namespace stored under the other expiry days of the layout than the one at
+// the storage key id, so that Get never serves an entry older than the last
+// one stored.
+func (r *S3QueryCacher) deleteCopies(ctx context.Context, key, id string) error {
+	var objects []s3types.ObjectIdentifier
+	for _, other := range r.objectKeys(key) {
+		if other != id {
+			objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(other)})
+		}
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+	return r.deleteBatch(ctx, objects)
+}
+
+// putEntry stores the encoded item and its metadata with a single PutObject.
+func (r *S3QueryCacher) putEntry(ctx context.Context, id string, metadata map[string]string, data []byte) error {
+	if checksum := r.Checksum.checksum(data); checksum != "" {
+		metadata[metaKeyChecksum] = checksum
+	}
+
+	_, err := r.Client.PutObject(ctx, r.putObjectInput(id, metadata, data))
+	if err == nil {
+		recordStats(ctx, func(stats *cacheStats) { stats.bytesWritten += int64(len(data)) })
+	}
 	return err
 }
 
-// Reset deletes all objects from the S3 cache bucket.
+// Reset deletes all objects under the cacher namespace from the S3 cache
+// bucket. Without a namespace every object in the bucket is deleted. How the
+// objects are deleted is controlled by ResetOptions.
+//
+// In directory buckets the objects are listed and deleted again until a pass
+// finds none. Reset fails when objects are still found after 5 passes, e.g.
+// because the namespace keeps being written to.
 func (r *S3QueryCacher) Reset(ctx context.Context) error {
-	paginator := s3.NewListObjectsV2Paginator(r.Client, &s3.ListObjectsV2Input{
-		Bucket: aws.String(r.Bucket),
-	})
+	return r.deleteObjects(ctx, r.ResetOptions)
+}
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return err
+// metadataEntry returns an entry with the metadata stored next to an S3
+// object.
+func metadataEntry(metadata map[string]string) *QueryEntry {
+	entry := &QueryEntry{}
+	// Check the client-side TTL stored in object metadata.
+	if v, ok := metadata[metaKeyExpiresAt]; ok {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			entry.ExpireAt = t
 		}
-		if len(page.Contents) == 0 {
-			continue
+	}
+	if v, ok := metadata[metaKeyRefreshAt]; ok {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			entry.RefreshAt = t
 		}
-
-		// ListObjectsV2 returns at most 1000 objects per page, which is also
-		// the DeleteObjects limit, so each page maps to exactly one API call.
-		objects := make([]s3types.ObjectIdentifier, len(page.Contents))
-		for i, obj := range page.Contents {
-			objects[i] = s3types.ObjectIdentifier{Key: obj.Key}
+	}
+	if v, ok := metadata[metaKeySQL]; ok {
+		if sql, err := url.QueryUnescape(v); err == nil {
+			entry.SQL = sql
 		}
+	}
+	return entry
+}
 
-		out, err := r.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-			Bucket: aws.String(r.Bucket),
-			Delete: &s3types.Delete{
-				Objects: objects,
-				Quiet:   aws.Bool(true),
-			},
-		})
-		if err != nil {
-			return err
-		}
-		if len(out.Errors) > 0 {
-			first := out.Errors[0]
-			return fmt.Errorf("s3: delete %s: %s", aws.ToString(first.Key), aws.ToString(first.Message))
-		}
+// namespacePrefix returns the key prefix shared by every key in the namespace,
+// or an empty string when no namespace is set. The namespace is escaped into a
+// single path segment, so that the prefix of a namespace is never a prefix of
+// the keys of another one: "billing/prod" does not contain the keys of
+// "billing/prod/v3".
+func namespacePrefix(namespace string) string {
+	namespace = strings.Trim(namespace, "/")
+	if namespace == "" {
+		return ""
+	}
+	return url.PathEscape(namespace) + "/"
+}
+
+// namespaceKey returns the storage key of the query key within the namespace.
+func namespaceKey(namespace string, key *pgxcache.QueryKey) string {
+	return namespacePrefix(namespace) + key.String()
+}
+
+// capacityUnits returns the capacity units consumed by a DynamoDB request, or
+// zero when they were not returned.
+func capacityUnits(capacity *dynamodbtypes.ConsumedCapacity) float64 {
+	if capacity == nil {
+		return 0
 	}
+	return aws.ToFloat64(capacity.CapacityUnits)
+}
 
-	return nil
+// unixTimeAttr returns the time as a number of seconds since the Unix epoch,
+// the format expected by DynamoDB TTL.
+func unixTimeAttr(t time.Time) dynamodbtypes.AttributeValue {
+	return &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+// unixTimeValue reads a time stored as a number of seconds since the Unix
+// epoch.
+func unixTimeValue(name string, value dynamodbtypes.AttributeValue) (time.Time, error) {
+	seconds, err := numberAttr(name, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// stringAttr reads a string attribute.
+func stringAttr(name string, value dynamodbtypes.AttributeValue) (string, error) {
+	v, ok := value.(*dynamodbtypes.AttributeValueMemberS)
+	if !ok {
+		return "", fmt.Errorf("pgxaws: attribute %s is %T instead of a string", name, value)
+	}
+	return v.Value, nil
+}
+
+// bytesAttr reads a binary attribute.
+func bytesAttr(name string, value dynamodbtypes.AttributeValue) ([]byte, error) {
+	v, ok := value.(*dynamodbtypes.AttributeValueMemberB)
+	if !ok {
+		return nil, fmt.Errorf("pgxaws: attribute %s is %T instead of a binary", name, value)
+	}
+	return v.Value, nil
+}
+
+// numberAttr reads an integer number attribute.
+func numberAttr(name string, value dynamodbtypes.AttributeValue) (int64, error) {
+	v, ok := value.(*dynamodbtypes.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("pgxaws: attribute %s is %T instead of a number", name, value)
+	}
+	n, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("pgxaws: attribute %s: %w", name, err)
+	}
+	return n, nil
 }
@@ -0,0 +1,210 @@
+package pgxaws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pgx-contrib/pgxcache"
+)
+
+const (
+	// admissionMaxPending is the maximum number of misses whose time is kept
+	// to measure the execution time of queries.
+	admissionMaxPending = 10000
+	// admissionPendingTimeout is the time after which a miss that was not
+	// followed by a Set is forgotten.
+	admissionPendingTimeout = 5 * time.Minute
+)
+
+// AdmissionReason is the reason why AdmissionQueryCacher rejected an item.
+type AdmissionReason string
+
+const (
+	// AdmissionTooSmall is an item smaller than MinSize.
+	AdmissionTooSmall AdmissionReason = "too_small"
+	// AdmissionTooLarge is an item larger than MaxSize.
+	AdmissionTooLarge AdmissionReason = "too_large"
+	// AdmissionTooFewRows is an item with fewer rows than MinRows.
+	AdmissionTooFewRows AdmissionReason = "too_few_rows"
+	// AdmissionTooManyRows is an item with more rows than MaxRows.
+	AdmissionTooManyRows AdmissionReason = "too_many_rows"
+	// AdmissionTooFast is an item whose query ran faster than MinDuration.
+	AdmissionTooFast AdmissionReason = "too_fast"
+	// AdmissionEmpty is an empty result, which is not cached because
+	// EmptyLifetime is negative.
+	AdmissionEmpty AdmissionReason = "empty"
+	// AdmissionPolicy is an item rejected by Policy.
+	AdmissionPolicy AdmissionReason = "policy"
+)
+
+// AdmissionCandidate describes an item offered to AdmissionQueryCacher.
+type AdmissionCandidate struct {
+	// Key is the key of the item.
+	Key *pgxcache.QueryKey
+	// Item is the item.
+	Item *pgxcache.QueryItem
+	// Size is the estimated size of the item in bytes.
+	Size int64
+	// Duration is the time between the miss of the key and the Set of the
+	// item, which approximates the execution time of the query. It is zero
+	// when no miss was observed.
+	Duration time.Duration
+	// Lifetime is the lifetime the item is stored with.
+	Lifetime time.Duration
+}
+
+var _ pgxcache.QueryCacher = &AdmissionQueryCacher{}
+
+// AdmissionQueryCacher implements pgxcache.QueryCacher interface around
+// another cacher, and only stores the items worth caching, so that cache
+// spend goes to expensive queries. Rejected items are dropped by Set, which
+// succeeds.
+//
+// Items can be rejected by size, row count, or by the execution time of
+// their query. The execution time is measured as the time between the miss
+// of a key reported by Get and the Set that follows it; items stored without
+// a prior miss in this process, e.g. by a refresh, are not checked against
+// MinDuration.
+//
+// Empty results get their own lifetime (see EmptyLifetime): they cost little
+// to store, and caching them for a short while spares the repeated execution
+// of queries that find nothing.
+type AdmissionQueryCacher struct {
+	// Cacher is the cacher that stores the admitted items.
+	Cacher pgxcache.QueryCacher
+	// MinSize rejects items smaller than this many bytes. Zero disables the
+	// check.
+	MinSize int64
+	// MaxSize rejects items larger than this many bytes. Zero disables the
+	// check.
+	MaxSize int64
+	// MinRows rejects items with fewer rows. Zero disables the check.
+	MinRows int
+	// MaxRows rejects items with more rows. Zero disables the check.
+	MaxRows int
+	// MinDuration rejects items whose query ran faster, as they are cheaper
+	// to recompute than to fetch. Zero disables the check.
+	MinDuration time.Duration
+	// EmptyLifetime is the lifetime of empty results, when shorter than the
+	// lifetime they are stored with. Empty results are only checked against
+	// MinDuration and Policy. Zero treats empty results as any other, and a
+	// negative value never caches them.
+	EmptyLifetime time.Duration
+	// Policy, if set, is called for the items that pass the other checks,
+	// and rejects the items for which it returns false.
+	Policy func(candidate *AdmissionCandidate) bool
+	// OnReject, if set, is called with every rejected item and the reason
+	// why it was rejected.
+	OnReject func(key *pgxcache.QueryKey, reason AdmissionReason)
+
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+// Get retrieves a cache item from Cacher, recording the time of misses.
+func (r *AdmissionQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	item, err := r.Cacher.Get(ctx, key)
+	if err == nil && item == nil && (r.MinDuration > 0 || r.Policy != nil) {
+		r.miss(key.String(), time.Now())
+	}
+	return item, err
+}
+
+// Set stores a cache item in Cacher when it is admitted.
+func (r *AdmissionQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	candidate := &AdmissionCandidate{
+		Key:      key,
+		Item:     item,
+		Size:     itemSize(item),
+		Duration: r.duration(key.String()),
+		Lifetime: lifetime,
+	}
+
+	if reason, ok := r.admit(candidate); !ok {
+		if r.OnReject != nil {
+			r.OnReject(key, reason)
+		}
+		return nil
+	}
+	return r.Cacher.Set(ctx, key, item, candidate.Lifetime)
+}
+
+// Reset resets Cacher and forgets the recorded misses.
+func (r *AdmissionQueryCacher) Reset(ctx context.Context) error {
+	r.mu.Lock()
+	r.pending = nil
+	r.mu.Unlock()
+
+	return r.Cacher.Reset(ctx)
+}
+
+// admit reports whether the candidate is admitted, or the reason why it is
+// not. The lifetime of admitted empty results is shortened.
+func (r *AdmissionQueryCacher) admit(candidate *AdmissionCandidate) (AdmissionReason, bool) {
+	rows := len(candidate.Item.Rows)
+	empty := rows == 0 && r.EmptyLifetime != 0
+
+	switch {
+	case empty && r.EmptyLifetime < 0:
+		return AdmissionEmpty, false
+	case r.MinDuration > 0 && candidate.Duration > 0 && candidate.Duration < r.MinDuration:
+		return AdmissionTooFast, false
+	case empty:
+		candidate.Lifetime = min(candidate.Lifetime, r.EmptyLifetime)
+	case r.MinRows > 0 && rows < r.MinRows:
+		return AdmissionTooFewRows, false
+	case r.MaxRows > 0 && rows > r.MaxRows:
+		return AdmissionTooManyRows, false
+	case r.MinSize > 0 && candidate.Size < r.MinSize:
+		return AdmissionTooSmall, false
+	case r.MaxSize > 0 && candidate.Size > r.MaxSize:
+		return AdmissionTooLarge, false
+	}
+
+	if r.Policy != nil && !r.Policy(candidate) {
+		return AdmissionPolicy, false
+	}
+	return "", true
+}
+
+// miss records the time of a miss of the key. When too many misses are
+// pending, the stale ones are forgotten, and the miss is not recorded if none
+// is.
+func (r *AdmissionQueryCacher) miss(key string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending == nil {
+		r.pending = map[string]time.Time{}
+	}
+	if len(r.pending) >= admissionMaxPending {
+		for k, at := range r.pending {
+			if now.Sub(at) > admissionPendingTimeout {
+				delete(r.pending, k)
+			}
+		}
+		if len(r.pending) >= admissionMaxPending {
+			return
+		}
+	}
+	r.pending[key] = now
+}
+
+// duration returns the time since the pending miss of the key, or zero when
+// there is none, and forgets the miss.
+func (r *AdmissionQueryCacher) duration(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	at, ok := r.pending[key]
+	if !ok {
+		return 0
+	}
+	delete(r.pending, key)
+
+	if elapsed := time.Since(at); elapsed <= admissionPendingTimeout {
+		return elapsed
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package pgxaws
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("AdmissionQueryCacher", func() {
+	var (
+		ctx      context.Context
+		backend  *entryCacher
+		cacher   *AdmissionQueryCacher
+		rejected []AdmissionReason
+		key      *pgxcache.QueryKey
+		item     *pgxcache.QueryItem
+		empty    *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = newEntryCacher()
+		rejected = nil
+		cacher = &AdmissionQueryCacher{
+			Cacher: backend,
+			OnReject: func(_ *pgxcache.QueryKey, reason AdmissionReason) {
+				rejected = append(rejected, reason)
+			},
+		}
+		key = &pgxcache.QueryKey{SQL: "SELECT * FROM users"}
+		item = &pgxcache.QueryItem{
+			CommandTag: "SELECT 2",
+			Rows:       [][][]byte{{[]byte("alice")}, {[]byte("bob")}},
+		}
+		empty = &pgxcache.QueryItem{CommandTag: "SELECT 0"}
+	})
+
+	It("admits every item by default", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+		Expect(rejected).To(BeEmpty())
+	})
+
+	It("rejects items by size and row count", func() {
+		cacher.MinRows = 3
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		cacher.MinRows, cacher.MaxRows = 0, 1
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		cacher.MaxRows, cacher.MinSize = 0, 100
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		cacher.MinSize, cacher.MaxSize = 0, 10
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		Expect(rejected).To(Equal([]AdmissionReason{
+			AdmissionTooFewRows, AdmissionTooManyRows, AdmissionTooSmall, AdmissionTooLarge,
+		}))
+		Expect(backend.entries).To(BeEmpty())
+
+		cacher.MaxSize = itemSize(item)
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(backend.entries).To(HaveLen(1))
+	})
+
+	It("rejects the items of fast queries", func() {
+		cacher.MinDuration = 50 * time.Millisecond
+
+		// the query runs right after the miss
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(rejected).To(Equal([]AdmissionReason{AdmissionTooFast}))
+
+		// the query takes longer than MinDuration
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+		time.Sleep(60 * time.Millisecond)
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+
+		// items stored without a miss are not measured
+		other := &pgxcache.QueryKey{SQL: "SELECT 2"}
+		Expect(cacher.Set(ctx, other, item, time.Minute)).To(Succeed())
+		Expect(backend.entries).To(HaveLen(2))
+		Expect(rejected).To(HaveLen(1))
+	})
+
+	It("caches empty results with their own lifetime", func() {
+		cacher.MinRows = 1
+		cacher.EmptyLifetime = 5 * time.Second
+
+		Expect(cacher.Set(ctx, key, empty, time.Hour)).To(Succeed())
+		Expect(rejected).To(BeEmpty())
+
+		entry := backend.entries[key.String()]
+		Expect(entry.Item).To(Equal(empty))
+		Expect(time.Until(entry.ExpireAt)).To(BeNumerically("~", 5*time.Second, time.Second))
+
+		// lifetimes shorter than EmptyLifetime are kept
+		Expect(cacher.Set(ctx, key, empty, time.Second)).To(Succeed())
+		Expect(time.Until(backend.entries[key.String()].ExpireAt)).To(BeNumerically("<=", time.Second))
+	})
+
+	It("never caches empty results with a negative lifetime", func() {
+		cacher.EmptyLifetime = -1
+		Expect(cacher.Set(ctx, key, empty, time.Hour)).To(Succeed())
+		Expect(rejected).To(Equal([]AdmissionReason{AdmissionEmpty}))
+		Expect(backend.entries).To(BeEmpty())
+	})
+
+	It("asks the policy last", func() {
+		var candidates []*AdmissionCandidate
+		cacher.Policy = func(candidate *AdmissionCandidate) bool {
+			candidates = append(candidates, candidate)
+			return candidate.Duration > 0
+		}
+
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(rejected).To(Equal([]AdmissionReason{AdmissionPolicy}))
+
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(backend.entries).To(HaveLen(1))
+
+		Expect(candidates).To(HaveLen(2))
+		Expect(candidates[1].Size).To(Equal(itemSize(item)))
+		Expect(candidates[1].Lifetime).To(Equal(time.Minute))
+	})
+
+	It("bounds the number of pending misses", func() {
+		start := time.Now()
+		for i := range admissionMaxPending + 1 {
+			cacher.miss(string(rune(i)), start)
+		}
+		Expect(cacher.pending).To(HaveLen(admissionMaxPending))
+
+		cacher.miss("late", start.Add(admissionPendingTimeout+time.Second))
+		Expect(cacher.pending).To(HaveLen(1))
+
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(cacher.pending).To(BeEmpty())
+	})
+})
@@ -0,0 +1,328 @@
+package pgxaws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pgx-contrib/pgxcache"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// batchGetLimit is the maximum number of keys in a BatchGetItem call.
+	batchGetLimit = 100
+	// batchWriteLimit is the maximum number of requests in a BatchWriteItem
+	// call.
+	batchWriteLimit = 25
+	// batchWorkers is the default number of requests issued concurrently by
+	// GetMany and SetMany.
+	batchWorkers = 16
+)
+
+// QueryBatchCacher is a pgxcache.QueryCacher that reads and writes many items
+// in one round, e.g. to prefetch the results of the independent queries of a
+// page.
+type QueryBatchCacher interface {
+	pgxcache.QueryCacher
+	// GetMany retrieves the cache items of the keys. The items are returned
+	// in the order of the keys; missing and expired items are nil.
+	GetMany(ctx context.Context, keys []*pgxcache.QueryKey) ([]*pgxcache.QueryItem, error)
+	// SetMany stores the cache items of the keys with the provided lifetime.
+	// The item of keys[i] is items[i].
+	SetMany(ctx context.Context, keys []*pgxcache.QueryKey, items []*pgxcache.QueryItem, lifetime time.Duration) error
+}
+
+var _ QueryBatchCacher = &DynamoQueryCacher{}
+
+// GetMany retrieves the cache items of the keys from DynamoDB with
+// BatchGetItem calls of up to 100 keys, issued concurrently. Keys that
+// DynamoDB leaves unprocessed are retried with backoff. Duplicate keys are
+// read once and share their item.
+func (r *DynamoQueryCacher) GetMany(ctx context.Context, keys []*pgxcache.QueryKey) ([]*pgxcache.QueryItem, error) {
+	schema := r.schema()
+
+	// positions maps the key of each item to its positions in keys.
+	positions := map[string][]int{}
+	var ids []map[string]dynamodbtypes.AttributeValue
+	for i, key := range keys {
+		id := key.String()
+		if _, ok := positions[id]; !ok {
+			ids = append(ids, r.primaryKey(schema, id))
+		}
+		positions[id] = append(positions[id], i)
+	}
+
+	items := make([]*pgxcache.QueryItem, len(keys))
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(batchWorkers)
+
+	for chunk := range slices.Chunk(ids, batchGetLimit) {
+		group.Go(func() error {
+			return r.batchGet(ctx, chunk, func(attributes map[string]dynamodbtypes.AttributeValue) error {
+				id, err := r.itemKey(schema, attributes)
+				if err != nil {
+					return err
+				}
+
+				entry, err := r.entry(ctx, schema, id, attributes)
+				switch {
+				case err != nil:
+					return err
+				case entry == nil:
+					return nil
+				case entry.Expired():
+					recordStats(ctx, func(stats *cacheStats) { stats.expired = true })
+					return nil
+				}
+
+				// Each key is read by a single chunk.
+				for _, i := range positions[id] {
+					items[i] = entry.Item
+				}
+				return nil
+			})
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// SetMany stores the cache items of the keys in DynamoDB with BatchWriteItem
+// calls of up to 25 items, issued concurrently. Items that DynamoDB leaves
+// unprocessed are retried with backoff. When a key is repeated, its last item
+// is stored.
+//
+// BatchWriteItem does not support conditions: with ConditionalWrites the
+// items are stored with concurrent PutItem calls instead.
+func (r *DynamoQueryCacher) SetMany(ctx context.Context, keys []*pgxcache.QueryKey, items []*pgxcache.QueryItem, lifetime time.Duration) error {
+	if len(keys) != len(items) {
+		return fmt.Errorf("pgxaws: %d keys and %d items", len(keys), len(items))
+	}
+
+	expireAt := time.Now().UTC().Add(lifetime)
+	if r.ConditionalWrites {
+		last := lastPositions(keys)
+		return concurrently(ctx, batchWorkers, len(keys), func(ctx context.Context, i int) error {
+			if last[keys[i].String()] != i {
+				return nil
+			}
+			return r.SetEntry(ctx, keys[i], &QueryEntry{Item: items[i], ExpireAt: expireAt})
+		})
+	}
+
+	schema := r.schema()
+
+	// positions maps the key of each item to its position in puts, as a
+	// batch cannot write the same item twice.
+	positions := map[string]int{}
+	puts := []dynamodbtypes.WriteRequest{}
+	sizes := []int64{}
+	for i, key := range keys {
+		item, size, err := r.item(schema, key, &QueryEntry{Item: items[i], ExpireAt: expireAt})
+		if err != nil {
+			return err
+		}
+
+		put := dynamodbtypes.WriteRequest{PutRequest: &dynamodbtypes.PutRequest{Item: item}}
+		if j, ok := positions[key.String()]; ok {
+			puts[j], sizes[j] = put, size
+			continue
+		}
+		positions[key.String()] = len(puts)
+		puts = append(puts, put)
+		sizes = append(sizes, size)
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(batchWorkers)
+
+	for start := 0; start < len(puts); start += batchWriteLimit {
+		end := min(start+batchWriteLimit, len(puts))
+		group.Go(func() error {
+			if err := r.batchWrite(ctx, puts[start:end]); err != nil {
+				return err
+			}
+
+			var written int64
+			for _, size := range sizes[start:end] {
+				written += size
+			}
+			recordStats(ctx, func(stats *cacheStats) { stats.bytesWritten += written })
+			return nil
+		})
+	}
+
+	return group.Wait()
+}
+
+// batchGet reads the items with the given keys, up to 100, with BatchGetItem
+// calls, retrying unprocessed keys with backoff. Missing items are skipped.
+func (r *DynamoQueryCacher) batchGet(ctx context.Context, keys []map[string]dynamodbtypes.AttributeValue, fn func(attributes map[string]dynamodbtypes.AttributeValue) error) error {
+	input := &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]dynamodbtypes.KeysAndAttributes{
+			r.Table: {Keys: keys, ConsistentRead: aws.Bool(r.ConsistentRead)},
+		},
+		ReturnConsumedCapacity: dynamodbtypes.ReturnConsumedCapacityTotal,
+	}
+	for attempt := 0; len(input.RequestItems) > 0; attempt++ {
+		if attempt > 0 {
+			if err := backoff(ctx, attempt-1); err != nil {
+				return err
+			}
+		}
+
+		out, err := r.dataClient().BatchGetItem(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		recordStats(ctx, func(stats *cacheStats) {
+			for _, capacity := range out.ConsumedCapacity {
+				stats.consumedCapacity += capacityUnits(&capacity)
+			}
+		})
+		for _, attributes := range out.Responses[r.Table] {
+			if err := fn(attributes); err != nil {
+				return err
+			}
+		}
+		input.RequestItems = out.UnprocessedKeys
+	}
+
+	return nil
+}
+
+// batchWrite applies up to 25 write requests with BatchWriteItem calls,
+// retrying unprocessed items with backoff.
+func (r *DynamoQueryCacher) batchWrite(ctx context.Context, requests []dynamodbtypes.WriteRequest) error {
+	input := &dynamodb.BatchWriteItemInput{
+		RequestItems:           map[string][]dynamodbtypes.WriteRequest{r.Table: requests},
+		ReturnConsumedCapacity: dynamodbtypes.ReturnConsumedCapacityTotal,
+	}
+	for attempt := 0; len(input.RequestItems) > 0; attempt++ {
+		if attempt > 0 {
+			if err := backoff(ctx, attempt-1); err != nil {
+				return err
+			}
+		}
+
+		out, err := r.dataClient().BatchWriteItem(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		recordStats(ctx, func(stats *cacheStats) {
+			for _, capacity := range out.ConsumedCapacity {
+				stats.consumedCapacity += capacityUnits(&capacity)
+			}
+		})
+		input.RequestItems = out.UnprocessedItems
+	}
+
+	return nil
+}
+
+var _ QueryBatchCacher = &S3QueryCacher{}
+
+// GetMany retrieves the cache items of the keys from S3 with concurrent
+// requests, up to BatchConcurrency at a time. Duplicate keys are read once and
+// share their item.
+func (r *S3QueryCacher) GetMany(ctx context.Context, keys []*pgxcache.QueryKey) ([]*pgxcache.QueryItem, error) {
+	var (
+		mu    sync.Mutex
+		items = map[string]*pgxcache.QueryItem{}
+	)
+
+	// first holds the position of the first occurrence of each key.
+	first := map[string]int{}
+	for i, key := range keys {
+		if _, ok := first[key.String()]; !ok {
+			first[key.String()] = i
+		}
+	}
+
+	err := concurrently(ctx, r.batchConcurrency(), len(keys), func(ctx context.Context, i int) error {
+		if first[keys[i].String()] != i {
+			return nil
+		}
+
+		item, err := r.Get(ctx, keys[i])
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		items[keys[i].String()] = item
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*pgxcache.QueryItem, len(keys))
+	for i, key := range keys {
+		result[i] = items[key.String()]
+	}
+	return result, nil
+}
+
+// SetMany stores the cache items of the keys in S3 with concurrent requests,
+// up to BatchConcurrency at a time. When a key is repeated, its last item is
+// stored.
+func (r *S3QueryCacher) SetMany(ctx context.Context, keys []*pgxcache.QueryKey, items []*pgxcache.QueryItem, lifetime time.Duration) error {
+	if len(keys) != len(items) {
+		return fmt.Errorf("pgxaws: %d keys and %d items", len(keys), len(items))
+	}
+
+	last := lastPositions(keys)
+	expireAt := time.Now().UTC().Add(lifetime)
+	return concurrently(ctx, r.batchConcurrency(), len(keys), func(ctx context.Context, i int) error {
+		if last[keys[i].String()] != i {
+			return nil
+		}
+		return r.SetEntry(ctx, keys[i], &QueryEntry{Item: items[i], ExpireAt: expireAt})
+	})
+}
+
+// batchConcurrency returns the number of requests issued concurrently by
+// GetMany and SetMany.
+func (r *S3QueryCacher) batchConcurrency() int {
+	if r.BatchConcurrency > 0 {
+		return r.BatchConcurrency
+	}
+	return batchWorkers
+}
+
+// lastPositions returns the position of the last occurrence of each key.
+func lastPositions(keys []*pgxcache.QueryKey) map[string]int {
+	last := map[string]int{}
+	for i, key := range keys {
+		last[key.String()] = i
+	}
+	return last
+}
+
+// concurrently calls fn with every position up to n, with up to limit calls at
+// a time, and returns the first error. The context passed to fn is canceled
+// when a call fails.
+func concurrently(ctx context.Context, limit, n int, fn func(ctx context.Context, i int) error) error {
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(limit)
+
+	for i := range n {
+		group.Go(func() error { return fn(ctx, i) })
+	}
+
+	return group.Wait()
+}
@@ -0,0 +1,145 @@
+package pgxaws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// batch returns n keys and their items.
+func batch(n int) ([]*pgxcache.QueryKey, []*pgxcache.QueryItem) {
+	keys := make([]*pgxcache.QueryKey, n)
+	items := make([]*pgxcache.QueryItem, n)
+	for i := range n {
+		keys[i] = &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", i)}
+		items[i] = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{fmt.Appendf(nil, "%d", i)}}}
+	}
+	return keys, items
+}
+
+var _ = Describe("DynamoQueryCacher batches", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.DynamoDB
+		cacher *DynamoQueryCacher
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewDynamoDB()
+		cacher = &DynamoQueryCacher{Client: client, Table: "queries", Namespace: "app"}
+		Expect(cacher.EnsureTable(ctx)).To(Succeed())
+	})
+
+	It("reads and writes more items than fit in a batch", func() {
+		keys, items := batch(150)
+		Expect(cacher.SetMany(ctx, keys, items, time.Minute)).To(Succeed())
+		Expect(client.Items("queries")).To(HaveLen(150))
+
+		missing := &pgxcache.QueryKey{SQL: "SELECT 'missing'"}
+		got, err := cacher.GetMany(ctx, append([]*pgxcache.QueryKey{missing, keys[3]}, keys...))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(append([]*pgxcache.QueryItem{nil, items[3]}, items...)))
+	})
+
+	It("retries unprocessed keys and items", func() {
+		client.BatchGetLimit = 3
+		client.BatchWriteLimit = 3
+
+		keys, items := batch(10)
+		Expect(cacher.SetMany(ctx, keys, items, time.Minute)).To(Succeed())
+		Expect(cacher.GetMany(ctx, keys)).To(Equal(items))
+	})
+
+	It("stores the last item of repeated keys", func() {
+		keys, items := batch(2)
+		keys[1] = keys[0]
+
+		Expect(cacher.SetMany(ctx, keys, items, time.Minute)).To(Succeed())
+		Expect(client.Items("queries")).To(HaveLen(1))
+		Expect(cacher.Get(ctx, keys[0])).To(Equal(items[1]))
+	})
+
+	It("reports expired items as missing", func() {
+		keys, items := batch(2)
+		Expect(cacher.SetMany(ctx, keys[:1], items[:1], time.Minute)).To(Succeed())
+		Expect(cacher.SetMany(ctx, keys[1:], items[1:], -time.Minute)).To(Succeed())
+
+		Expect(cacher.GetMany(ctx, keys)).To(Equal([]*pgxcache.QueryItem{items[0], nil}))
+	})
+
+	It("keeps newer entries with conditional writes", func() {
+		cacher.ConditionalWrites = true
+
+		keys, items := batch(2)
+		newer := &pgxcache.QueryItem{CommandTag: "SELECT 0"}
+		Expect(cacher.SetEntry(ctx, keys[0], &QueryEntry{
+			Item:      newer,
+			ExpireAt:  time.Now().Add(time.Minute),
+			CreatedAt: time.Now().Add(time.Hour),
+		})).To(Succeed())
+
+		Expect(cacher.SetMany(ctx, keys, items, time.Minute)).To(Succeed())
+		Expect(cacher.GetMany(ctx, keys)).To(Equal([]*pgxcache.QueryItem{newer, items[1]}))
+	})
+
+	It("requires an item for every key", func() {
+		keys, items := batch(2)
+		err := cacher.SetMany(ctx, keys, items[:1], time.Minute)
+		Expect(err).To(MatchError("pgxaws: 2 keys and 1 items"))
+	})
+})
+
+var _ = Describe("S3QueryCacher batches", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.S3
+		cacher *S3QueryCacher
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		cacher = &S3QueryCacher{Client: client, Bucket: "queries", BatchConcurrency: 2}
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("reads and writes items concurrently", func() {
+		keys, items := batch(20)
+		Expect(cacher.SetMany(ctx, keys, items, time.Minute)).To(Succeed())
+		Expect(client.Keys("queries")).To(HaveLen(20))
+
+		missing := &pgxcache.QueryKey{SQL: "SELECT 'missing'"}
+		got, err := cacher.GetMany(ctx, append([]*pgxcache.QueryKey{missing, keys[3]}, keys...))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(append([]*pgxcache.QueryItem{nil, items[3]}, items...)))
+	})
+
+	It("stores the last item of repeated keys", func() {
+		keys, items := batch(2)
+		keys[1] = keys[0]
+
+		Expect(cacher.SetMany(ctx, keys, items, time.Minute)).To(Succeed())
+		Expect(client.Keys("queries")).To(HaveLen(1))
+		Expect(cacher.Get(ctx, keys[0])).To(Equal(items[1]))
+	})
+
+	It("reports expired items as missing", func() {
+		keys, items := batch(2)
+		Expect(cacher.SetMany(ctx, keys[:1], items[:1], time.Minute)).To(Succeed())
+		Expect(cacher.SetMany(ctx, keys[1:], items[1:], -time.Minute)).To(Succeed())
+
+		Expect(cacher.GetMany(ctx, keys)).To(Equal([]*pgxcache.QueryItem{items[0], nil}))
+	})
+
+	It("requires an item for every key", func() {
+		keys, items := batch(2)
+		err := cacher.SetMany(ctx, keys, items[:1], time.Minute)
+		Expect(err).To(MatchError("pgxaws: 2 keys and 1 items"))
+	})
+})
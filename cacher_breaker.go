@@ -0,0 +1,218 @@
+package pgxaws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pgx-contrib/pgxcache"
+)
+
+const (
+	// breakerFailureThreshold is the default number of consecutive failures
+	// that open the circuit.
+	breakerFailureThreshold = 5
+	// breakerOpenTimeout is the default time the circuit stays open.
+	breakerOpenTimeout = 30 * time.Second
+)
+
+// CircuitState is the state of the circuit breaker of a FailOpenQueryCacher.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every operation through to the backend.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen skips the backend entirely.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe operation through to decide whether
+	// the backend has recovered.
+	CircuitHalfOpen
+)
+
+// String returns the name of the state.
+func (x CircuitState) String() string {
+	switch x {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+var _ pgxcache.QueryCacher = &FailOpenQueryCacher{}
+
+// FailOpenQueryCacher implements pgxcache.QueryCacher interface around
+// another cacher, such as DynamoQueryCacher or S3QueryCacher, so that the
+// cache never fails query execution: Get errors are reported as misses and
+// Set errors are dropped.
+//
+// After FailureThreshold consecutive failures the circuit opens, and Get and
+// Set skip the backend for OpenTimeout. A single probe is then let through:
+// the circuit closes when it succeeds and opens again when it fails.
+//
+// Reset is not protected by the circuit breaker and returns its error.
+type FailOpenQueryCacher struct {
+	// Cacher is the protected cacher.
+	Cacher pgxcache.QueryCacher
+	// Timeout bounds the duration of each Get and Set. Operations that time
+	// out count as failures. Zero disables the timeout.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures that open the
+	// circuit. Defaults to 5.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before a probe is let
+	// through. Defaults to 30 seconds.
+	OpenTimeout time.Duration
+	// OnStateChange, if set, is called after each transition of the circuit.
+	OnStateChange func(from, to CircuitState)
+	// OnError, if set, is called with every error that is converted into a
+	// miss or dropped.
+	OnError func(operation CacheOperation, err error)
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// State returns the current state of the circuit.
+func (r *FailOpenQueryCacher) State() CircuitState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// Get retrieves a cache item from Cacher. Errors are reported as misses.
+func (r *FailOpenQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	allowed, probe := r.allow()
+	if !allowed {
+		return nil, nil
+	}
+
+	octx, cancel := r.timeout(ctx)
+	defer cancel()
+
+	item, err := r.Cacher.Get(octx, key)
+	r.done(ctx, CacheGet, probe, err)
+	if err != nil {
+		return nil, nil
+	}
+	return item, nil
+}
+
+// Set stores a cache item in Cacher. Errors are dropped.
+func (r *FailOpenQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	allowed, probe := r.allow()
+	if !allowed {
+		return nil
+	}
+
+	octx, cancel := r.timeout(ctx)
+	defer cancel()
+
+	err := r.Cacher.Set(octx, key, item, lifetime)
+	r.done(ctx, CacheSet, probe, err)
+	return nil
+}
+
+// Reset resets Cacher.
+func (r *FailOpenQueryCacher) Reset(ctx context.Context) error {
+	return r.Cacher.Reset(ctx)
+}
+
+// timeout returns the context of an operation.
+func (r *FailOpenQueryCacher) timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.Timeout)
+}
+
+// allow reports whether an operation may reach the backend, and whether it is
+// the probe of a half-open circuit.
+func (r *FailOpenQueryCacher) allow() (allowed, probe bool) {
+	r.mu.Lock()
+
+	from := r.state
+
+	switch r.state {
+	case CircuitClosed:
+		allowed = true
+	case CircuitOpen:
+		if time.Since(r.openedAt) >= valueOrDefault(r.OpenTimeout, breakerOpenTimeout) {
+			r.state = CircuitHalfOpen
+			r.probing = true
+			allowed, probe = true, true
+		}
+	case CircuitHalfOpen:
+		if !r.probing {
+			r.probing = true
+			allowed, probe = true, true
+		}
+	}
+
+	to := r.state
+	r.mu.Unlock()
+
+	r.notify(from, to)
+	return allowed, probe
+}
+
+// done records the outcome of an operation that reached the backend. Errors
+// caused by the caller giving up are not held against the backend. Once the
+// circuit has left the closed state, only the outcome of the probe moves it:
+// the operations started before it opened are ignored.
+func (r *FailOpenQueryCacher) done(ctx context.Context, operation CacheOperation, probe bool, err error) {
+	if err != nil && r.OnError != nil {
+		r.OnError(operation, err)
+	}
+
+	r.mu.Lock()
+
+	from := r.state
+	if probe {
+		r.probing = false
+	}
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// The caller gave up; the outcome says nothing about the backend.
+	case !probe && r.state != CircuitClosed:
+		// The operation started before the circuit opened.
+	case err == nil:
+		r.failures = 0
+		r.state = CircuitClosed
+	default:
+		r.failures++
+		if probe || r.failures >= r.failureThreshold() {
+			r.state = CircuitOpen
+			r.openedAt = time.Now()
+		}
+	}
+
+	to := r.state
+	r.mu.Unlock()
+
+	r.notify(from, to)
+}
+
+// notify reports a transition of the circuit.
+func (r *FailOpenQueryCacher) notify(from, to CircuitState) {
+	if from != to && r.OnStateChange != nil {
+		r.OnStateChange(from, to)
+	}
+}
+
+// failureThreshold returns the number of consecutive failures that open the
+// circuit.
+func (r *FailOpenQueryCacher) failureThreshold() int {
+	if r.FailureThreshold <= 0 {
+		return breakerFailureThreshold
+	}
+	return r.FailureThreshold
+}
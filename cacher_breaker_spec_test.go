@@ -0,0 +1,202 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// blockingCacher is a pgxcache.QueryCacher whose operations block until their
+// context is done.
+type blockingCacher struct {
+	*entryCacher
+}
+
+func (x *blockingCacher) Get(ctx context.Context, _ *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// gatedCacher is a pgxcache.QueryCacher whose Get of a query reports its SQL
+// when it starts, blocks until the gate of its SQL is closed, and then misses.
+type gatedCacher struct {
+	*entryCacher
+	started chan string
+	gates   map[string]chan struct{}
+}
+
+func (x *gatedCacher) Get(_ context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	x.started <- key.SQL
+	<-x.gates[key.SQL]
+	return nil, nil
+}
+
+var _ = Describe("FailOpenQueryCacher", func() {
+	var (
+		ctx         context.Context
+		backend     *entryCacher
+		cacher      *FailOpenQueryCacher
+		transitions []CircuitState
+		key         *pgxcache.QueryKey
+		item        *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = newEntryCacher()
+		transitions = nil
+		cacher = &FailOpenQueryCacher{
+			Cacher:           backend,
+			FailureThreshold: 2,
+			OpenTimeout:      50 * time.Millisecond,
+			OnStateChange: func(_, to CircuitState) {
+				transitions = append(transitions, to)
+			},
+		}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+	})
+
+	It("passes operations through while the backend is healthy", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+		Expect(cacher.State()).To(Equal(CircuitClosed))
+	})
+
+	It("reports backend errors as misses and drops failed writes", func() {
+		var errs []error
+		cacher.OnError = func(_ CacheOperation, err error) { errs = append(errs, err) }
+		backend.err = errors.New("throttled")
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(errs).To(HaveLen(2))
+	})
+
+	It("opens the circuit after consecutive failures and skips the backend", func() {
+		backend.err = errors.New("throttled")
+
+		for range 2 {
+			_, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(cacher.State()).To(Equal(CircuitOpen))
+		Expect(transitions).To(Equal([]CircuitState{CircuitOpen}))
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.gets).To(Equal(2))
+	})
+
+	It("closes the circuit when the probe succeeds", func() {
+		backend.err = errors.New("throttled")
+		for range 2 {
+			_, _ = cacher.Get(ctx, key)
+		}
+
+		backend.err = nil
+		time.Sleep(cacher.OpenTimeout)
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cacher.State()).To(Equal(CircuitClosed))
+		Expect(transitions).To(Equal([]CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}))
+	})
+
+	It("opens the circuit again when the probe fails", func() {
+		backend.err = errors.New("throttled")
+		for range 2 {
+			_, _ = cacher.Get(ctx, key)
+		}
+
+		time.Sleep(cacher.OpenTimeout)
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cacher.State()).To(Equal(CircuitOpen))
+		Expect(transitions).To(Equal([]CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen}))
+	})
+
+	It("ignores slow operations that finish after the circuit opened", func() {
+		gated := &gatedCacher{entryCacher: backend, started: make(chan string, 2), gates: map[string]chan struct{}{
+			"slow":  make(chan struct{}),
+			"probe": make(chan struct{}),
+		}}
+		cacher.Cacher = gated
+
+		get := func(sql string) chan struct{} {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, _ = cacher.Get(ctx, &pgxcache.QueryKey{SQL: sql})
+			}()
+			return done
+		}
+
+		slow := get("slow")
+		Expect(<-gated.started).To(Equal("slow"))
+
+		backend.err = errors.New("throttled")
+		for range 2 {
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		}
+		Expect(cacher.State()).To(Equal(CircuitOpen))
+
+		time.Sleep(cacher.OpenTimeout)
+		probe := get("probe")
+		Expect(<-gated.started).To(Equal("probe"))
+		Expect(cacher.State()).To(Equal(CircuitHalfOpen))
+
+		// The slow operation neither closes the circuit nor frees the probe
+		// slot.
+		close(gated.gates["slow"])
+		<-slow
+		Expect(cacher.State()).To(Equal(CircuitHalfOpen))
+		backend.err = nil
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(backend.entries).To(BeEmpty())
+
+		close(gated.gates["probe"])
+		<-probe
+		Expect(cacher.State()).To(Equal(CircuitClosed))
+		Expect(transitions).To(Equal([]CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}))
+	})
+
+	It("counts operations that time out as failures", func() {
+		cacher.Cacher = &blockingCacher{entryCacher: backend}
+		cacher.Timeout = 10 * time.Millisecond
+
+		for range 2 {
+			got, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(BeNil())
+		}
+		Expect(cacher.State()).To(Equal(CircuitOpen))
+	})
+
+	It("does not count operations canceled by the caller as failures", func() {
+		cacher.Cacher = &blockingCacher{entryCacher: backend}
+		cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		for range 2 {
+			_, err := cacher.Get(cctx, key)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(cacher.State()).To(Equal(CircuitClosed))
+	})
+
+	It("returns Reset errors", func() {
+		backend.err = errors.New("throttled")
+		Expect(cacher.Reset(ctx)).To(MatchError("throttled"))
+	})
+})
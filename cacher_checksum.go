@@ -0,0 +1,158 @@
+package pgxaws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ChecksumAlgorithm is the algorithm of the checksums stored next to cached
+// results.
+type ChecksumAlgorithm string
+
+const (
+	// ChecksumCRC32C checksums results with CRC32 (Castagnoli). It is fast
+	// and detects truncated or accidentally modified payloads.
+	ChecksumCRC32C ChecksumAlgorithm = "CRC32C"
+	// ChecksumSHA256 checksums results with SHA-256.
+	ChecksumSHA256 ChecksumAlgorithm = "SHA256"
+)
+
+// crc32cTable is the CRC32 table of the Castagnoli polynomial.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// metaKeyChecksum is the S3 user-defined metadata key that stores the
+// checksum of the object body.
+const metaKeyChecksum = "checksum"
+
+// newHash returns a hash that computes checksums of the algorithm, or nil for
+// unknown algorithms.
+func (x ChecksumAlgorithm) newHash() hash.Hash {
+	switch x {
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	case ChecksumSHA256:
+		return sha256.New()
+	default:
+		return nil
+	}
+}
+
+// sum returns the base64 encoded checksum of data, in the format used by S3
+// checksum headers, or an empty string for unknown algorithms.
+func (x ChecksumAlgorithm) sum(data []byte) string {
+	h := x.newHash()
+	if h == nil {
+		return ""
+	}
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checksum returns the checksum of data as stored next to it, prefixed with
+// the algorithm (e.g. "CRC32C:yZRlqg=="), or an empty string when no
+// algorithm is set.
+func (x ChecksumAlgorithm) checksum(data []byte) string {
+	if x == "" {
+		return ""
+	}
+	return string(x) + ":" + x.sum(data)
+}
+
+// verifyChecksum reports whether data matches the stored checksum. Data
+// without a checksum, or with a checksum of an unknown algorithm, is assumed
+// to be intact.
+func verifyChecksum(checksum string, data []byte) bool {
+	algorithm, sum, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return true
+	}
+	expected := ChecksumAlgorithm(algorithm).sum(data)
+	return expected == "" || expected == sum
+}
+
+// checksumReader computes the checksum of what is read from reader, to
+// verify it against a stored checksum once the reader is exhausted.
+type checksumReader struct {
+	reader   io.Reader
+	checksum string
+	hash     hash.Hash
+}
+
+// Read reads from the underlying reader.
+func (x *checksumReader) Read(p []byte) (int, error) {
+	if x.hash == nil {
+		algorithm, _, _ := strings.Cut(x.checksum, ":")
+		if x.hash = ChecksumAlgorithm(algorithm).newHash(); x.hash == nil {
+			x.hash = crc32.New(crc32cTable)
+		}
+	}
+
+	n, err := x.reader.Read(p)
+	x.hash.Write(p[:n])
+	return n, err
+}
+
+// verify reports whether what was read matches the stored checksum, with the
+// same rules as verifyChecksum.
+func (x *checksumReader) verify() bool {
+	algorithm, sum, ok := strings.Cut(x.checksum, ":")
+	if !ok || x.hash == nil || ChecksumAlgorithm(algorithm).newHash() == nil {
+		return true
+	}
+	return base64.StdEncoding.EncodeToString(x.hash.Sum(nil)) == sum
+}
+
+// s3Checksum sets the native S3 checksum of the upload, so that S3 rejects
+// bodies corrupted in transit.
+func s3Checksum(input *s3.PutObjectInput, algorithm ChecksumAlgorithm, data []byte) {
+	switch algorithm {
+	case ChecksumCRC32C:
+		input.ChecksumAlgorithm = s3types.ChecksumAlgorithmCrc32c
+		input.ChecksumCRC32C = aws.String(algorithm.sum(data))
+	case ChecksumSHA256:
+		input.ChecksumAlgorithm = s3types.ChecksumAlgorithmSha256
+		input.ChecksumSHA256 = aws.String(algorithm.sum(data))
+	}
+}
+
+// deleteCorrupt removes an item whose checksum does not match its data,
+// unless it has been replaced in the meantime. Errors are ignored: the item
+// is reported as missing either way and is replaced by the next Set.
+func (r *DynamoQueryCacher) deleteCorrupt(ctx context.Context, schema *DynamoSchema, row *DynamoQuery) {
+	recordStats(ctx, func(stats *cacheStats) { stats.corrupt = true })
+
+	_, _ = r.dataClient().DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(r.Table),
+		Key:                      r.primaryKey(schema, row.ID),
+		ConditionExpression:      aws.String("#checksum = :checksum"),
+		ExpressionAttributeNames: map[string]string{"#checksum": schema.Checksum},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":checksum": &dynamodbtypes.AttributeValueMemberS{Value: row.Checksum},
+		},
+	})
+}
+
+// deleteCorrupt removes an object whose checksum does not match its body,
+// unless it has been replaced in the meantime. Errors are ignored: the object
+// is reported as missing either way and is replaced by the next Set.
+func (r *S3QueryCacher) deleteCorrupt(ctx context.Context, id string, etag *string) {
+	recordStats(ctx, func(stats *cacheStats) { stats.corrupt = true })
+
+	_, _ = r.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(id),
+		IfMatch:             etag,
+		ExpectedBucketOwner: r.bucketOwner(),
+	})
+}
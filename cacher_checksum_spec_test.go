@@ -0,0 +1,136 @@
+package pgxaws
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("verifyChecksum", func() {
+	data := []byte("payload")
+
+	DescribeTable("checksums",
+		func(checksum string, expected bool) {
+			Expect(verifyChecksum(checksum, data)).To(Equal(expected))
+		},
+		Entry("no checksum", "", true),
+		Entry("matching CRC32C", ChecksumCRC32C.checksum(data), true),
+		Entry("matching SHA256", ChecksumSHA256.checksum(data), true),
+		Entry("mismatching CRC32C", ChecksumCRC32C.checksum([]byte("other")), false),
+		Entry("mismatching SHA256", ChecksumSHA256.checksum([]byte("other")), false),
+		Entry("unknown algorithm", "MD5:abc", true),
+	)
+})
+
+var _ = Describe("Checksums", func() {
+	var (
+		ctx    context.Context
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+		events []*CacheEvent
+	)
+
+	instrument := func(cacher pgxcache.QueryCacher) *InstrumentedQueryCacher {
+		return &InstrumentedQueryCacher{
+			Cacher: cacher,
+			Observer: CacheObserverFunc(func(_ context.Context, event *CacheEvent) {
+				events = append(events, event)
+			}),
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+		events = nil
+	})
+
+	Context("DynamoQueryCacher", func() {
+		var (
+			client *pgxawstest.DynamoDB
+			cacher *DynamoQueryCacher
+		)
+
+		BeforeEach(func() {
+			client = pgxawstest.NewDynamoDB()
+			cacher = &DynamoQueryCacher{Client: client, Table: "queries", Checksum: ChecksumCRC32C}
+			Expect(cacher.EnsureTable(ctx)).To(Succeed())
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		})
+
+		It("serves intact items", func() {
+			got, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(item))
+		})
+
+		It("deletes corrupt items and reports them as missing", func() {
+			stored := client.Items("queries")[0]
+			data := stored["query_data"].(*dynamodbtypes.AttributeValueMemberB).Value
+			stored["query_data"] = &dynamodbtypes.AttributeValueMemberB{Value: data[:len(data)-1]}
+			_, err := client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String("queries"), Item: stored})
+			Expect(err).NotTo(HaveOccurred())
+
+			got, err := instrument(cacher).Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(BeNil())
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Result).To(Equal(CacheCorrupt))
+			Expect(client.Items("queries")).To(BeEmpty())
+		})
+	})
+
+	Context("S3QueryCacher", func() {
+		var (
+			client *pgxawstest.S3
+			cacher *S3QueryCacher
+		)
+
+		BeforeEach(func() {
+			client = pgxawstest.NewS3()
+			cacher = &S3QueryCacher{Client: client, Bucket: "queries", Checksum: ChecksumSHA256}
+			Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		})
+
+		It("serves intact objects to cachers without checksums", func() {
+			reader := &S3QueryCacher{Client: client, Bucket: "queries"}
+			got, err := reader.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(item))
+		})
+
+		It("deletes truncated objects and reports them as missing", func() {
+			out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("queries"), Key: aws.String(key.String())})
+			Expect(err).NotTo(HaveOccurred())
+			body, err := io.ReadAll(out.Body)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:   aws.String("queries"),
+				Key:      aws.String(key.String()),
+				Body:     strings.NewReader(string(body[:len(body)/2])),
+				Metadata: out.Metadata,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			got, err := instrument(cacher).Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(BeNil())
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Result).To(Equal(CacheCorrupt))
+			Expect(client.Keys("queries")).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,114 @@
+package pgxaws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var _ DynamoClient = &dynamodb.Client{}
+
+// DynamoClient is the subset of the DynamoDB API used by DynamoQueryCacher.
+// It is implemented by *dynamodb.Client and by the in-memory fake in the
+// pgxawstest package.
+type DynamoClient interface {
+	// GetItem returns the attributes of the item with the given key.
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	// PutItem creates or replaces an item.
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	// DeleteItem deletes an item by its key.
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	// Query reads the items of one item collection.
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	// Scan reads every item in a table.
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	// BatchGetItem reads up to 100 items by their keys.
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	// BatchWriteItem puts or deletes up to 25 items.
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+	// CreateTable creates a table.
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	// DescribeTable returns the description of a table.
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	// DeleteTable deletes a table and all of its items.
+	DeleteTable(ctx context.Context, params *dynamodb.DeleteTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteTableOutput, error)
+	// DescribeTimeToLive returns the TTL settings of a table.
+	DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	// UpdateTimeToLive enables or disables TTL on a table.
+	UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+var _ DAXClient = &dynamodb.Client{}
+
+// DAXClient is the subset of the DynamoDB API that DynamoQueryCacher sends to
+// DynamoDB Accelerator (DAX). It is implemented by the DAX client of
+// github.com/aws/aws-dax-go-v2, by *dynamodb.Client and by the in-memory fake
+// in the pgxawstest package.
+type DAXClient interface {
+	// GetItem returns the attributes of the item with the given key.
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	// BatchGetItem reads up to 100 items by their keys.
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	// PutItem creates or replaces an item.
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	// DeleteItem deletes an item by its key.
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	// BatchWriteItem puts or deletes up to 25 items.
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+// dataClient returns the client that serves the reads and writes of entries:
+// DAX when it is set, and Client otherwise.
+func (r *DynamoQueryCacher) dataClient() DAXClient {
+	if r.DAX != nil {
+		return r.DAX
+	}
+	return r.Client
+}
+
+var _ S3Client = &s3.Client{}
+
+// S3Client is the subset of the S3 API used by S3QueryCacher. It is
+// implemented by *s3.Client and by the in-memory fake in the pgxawstest
+// package.
+type S3Client interface {
+	// GetObject returns an object and its metadata.
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	// HeadObject returns the metadata of an object.
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	// PutObject creates or replaces an object.
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	// CreateMultipartUpload starts the upload of an object in parts.
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	// UploadPart uploads a part of a multipart upload.
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	// CompleteMultipartUpload assembles the uploaded parts into an object.
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	// AbortMultipartUpload aborts a multipart upload and deletes its parts.
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	// DeleteObject deletes an object.
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	// DeleteObjects deletes up to 1000 objects.
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	// ListObjectsV2 lists the objects in a bucket.
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	// ListObjectVersions lists the object versions and delete markers in a
+	// bucket.
+	ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	// HeadBucket reports whether a bucket exists and is accessible.
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	// CreateBucket creates a bucket.
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+	// GetBucketLifecycleConfiguration returns the lifecycle rules of a bucket.
+	GetBucketLifecycleConfiguration(ctx context.Context, params *s3.GetBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLifecycleConfigurationOutput, error)
+	// PutBucketLifecycleConfiguration replaces the lifecycle rules of a
+	// bucket.
+	PutBucketLifecycleConfiguration(ctx context.Context, params *s3.PutBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error)
+}
+
+// s3Options is implemented by S3 clients that expose their configuration,
+// such as *s3.Client.
+type s3Options interface {
+	Options() s3.Options
+}
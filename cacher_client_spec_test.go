@@ -0,0 +1,371 @@
+package pgxaws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var (
+	_ DynamoClient = &pgxawstest.DynamoDB{}
+	_ DAXClient    = &pgxawstest.DAX{}
+	_ S3Client     = &pgxawstest.S3{}
+)
+
+var _ = Describe("DynamoQueryCacher with a fake client", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.DynamoDB
+		cacher *DynamoQueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewDynamoDB()
+		cacher = &DynamoQueryCacher{Client: client, Table: "queries"}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+
+		Expect(cacher.EnsureTable(ctx)).To(Succeed())
+	})
+
+	It("round-trips an item through Set and Get", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("treats expired items as missing", func() {
+		Expect(cacher.SetEntry(ctx, key, &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Minute)})).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+
+		entry, err := cacher.GetEntry(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Expired()).To(BeTrue())
+	})
+
+	It("reports payload sizes and consumed capacity", func() {
+		var events []*CacheEvent
+		instrumented := &InstrumentedQueryCacher{
+			Cacher: cacher,
+			Observer: CacheObserverFunc(func(_ context.Context, event *CacheEvent) {
+				events = append(events, event)
+			}),
+		}
+
+		Expect(instrumented.Set(ctx, key, item, time.Minute)).To(Succeed())
+		_, err := instrumented.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].BytesWritten).To(BeNumerically(">", 0))
+		Expect(events[0].ConsumedCapacity).To(Equal(1.0))
+		Expect(events[1].BytesRead).To(Equal(events[0].BytesWritten))
+		Expect(events[1].ConsumedCapacity).To(Equal(0.5))
+	})
+
+	It("reports expired entries read through RefreshQueryCacher", func() {
+		Expect(cacher.SetEntry(ctx, key, &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Minute)})).To(Succeed())
+
+		var events []*CacheEvent
+		instrumented := &InstrumentedQueryCacher{
+			Cacher: &RefreshQueryCacher{Cacher: cacher},
+			Observer: CacheObserverFunc(func(_ context.Context, event *CacheEvent) {
+				events = append(events, event)
+			}),
+		}
+
+		got, err := instrumented.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+		Expect(events).To(ConsistOf(HaveField("Result", CacheExpired)))
+	})
+
+	It("resets only its namespace with parallel segments and unprocessed items", func() {
+		client.PageSize = 7
+		client.BatchWriteLimit = 10
+
+		ours := &DynamoQueryCacher{
+			Client:       client,
+			Table:        "queries",
+			Namespace:    "ours",
+			ResetOptions: &ResetOptions{Segments: 3, Workers: 4},
+		}
+		theirs := &DynamoQueryCacher{Client: client, Table: "queries", Namespace: "theirs"}
+
+		for i := range 60 {
+			k := &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", i)}
+			Expect(ours.Set(ctx, k, item, time.Minute)).To(Succeed())
+		}
+		Expect(theirs.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		Expect(ours.Reset(ctx)).To(Succeed())
+		Expect(client.Items("queries")).To(HaveLen(1))
+
+		got, err := theirs.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).NotTo(BeNil())
+	})
+
+	It("leaves nested namespaces out of Entries and Reset", func() {
+		outer := &DynamoQueryCacher{Client: client, Table: "queries", Namespace: "a/b"}
+		inner := &DynamoQueryCacher{Client: client, Table: "queries", Namespace: "a/b/c"}
+
+		Expect(outer.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(inner.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		var keys []string
+		for entry, err := range outer.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			keys = append(keys, entry.Key)
+		}
+		Expect(keys).To(Equal([]string{key.String()}))
+
+		Expect(outer.Reset(ctx)).To(Succeed())
+		Expect(client.Items("queries")).To(HaveLen(1))
+
+		got, err := inner.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("recreates the table on Reset", func() {
+		cacher.ResetOptions = &ResetOptions{Recreate: true}
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(client.Items("queries")).To(BeEmpty())
+	})
+
+	It("lists entries without their leases and deletes them", func() {
+		cacher.StoreSQL = true
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		_, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		var entries []*QueryEntry
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			entries = append(entries, entry)
+		}
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Key).To(Equal(key.String()))
+		Expect(entries[0].SQL).To(Equal("SELECT 1"))
+		Expect(entries[0].Size).To(BeNumerically(">", 0))
+
+		Expect(cacher.Delete(ctx, key)).To(Succeed())
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("reads its own writes with consistent reads", func() {
+		client.StaleReads = true
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+
+		cacher.ConsistentRead = true
+		got, err = cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("never replaces an entry with an older one with conditional writes", func() {
+		cacher.ConditionalWrites = true
+		now := time.Now()
+		newer := &pgxcache.QueryItem{CommandTag: "SELECT 2"}
+
+		Expect(cacher.SetEntry(ctx, key, &QueryEntry{Item: newer, ExpireAt: now.Add(time.Minute), CreatedAt: now})).To(Succeed())
+		Expect(cacher.SetEntry(ctx, key, &QueryEntry{Item: item, ExpireAt: now.Add(time.Minute), CreatedAt: now.Add(-time.Second)})).To(Succeed())
+
+		entry, err := cacher.GetEntry(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Item).To(Equal(newer))
+		Expect(entry.CreatedAt).To(BeTemporally("==", now))
+
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("hands out exclusive leases", func() {
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+
+		other, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeEmpty())
+
+		Expect(cacher.ReleaseLease(ctx, key, "stale")).To(Succeed())
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+
+		token, err = cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+	})
+
+	It("takes over expired leases", func() {
+		_, err := cacher.AcquireLease(ctx, key, -time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+	})
+})
+
+var _ = Describe("S3QueryCacher with a fake client", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.S3
+		cacher *S3QueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		client.Region = "eu-west-1"
+		cacher = &S3QueryCacher{Client: client, Bucket: "queries"}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("round-trips an item through Set and Get", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("treats expired objects as missing", func() {
+		Expect(cacher.SetEntry(ctx, key, &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Minute)})).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("expires the noncurrent versions of versioned buckets", func() {
+		Expect(client.SetVersioning("queries", s3types.BucketVersioningStatusEnabled)).To(Succeed())
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+
+		out, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String("queries")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.Rules).To(HaveLen(1))
+		Expect(out.Rules[0].NoncurrentVersionExpiration.NoncurrentDays).To(Equal(aws.Int32(1)))
+	})
+
+	It("reports expired entries read through RefreshQueryCacher", func() {
+		Expect(cacher.SetEntry(ctx, key, &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Minute)})).To(Succeed())
+
+		var events []*CacheEvent
+		instrumented := &InstrumentedQueryCacher{
+			Cacher: &RefreshQueryCacher{Cacher: cacher},
+			Observer: CacheObserverFunc(func(_ context.Context, event *CacheEvent) {
+				events = append(events, event)
+			}),
+		}
+
+		got, err := instrumented.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+		Expect(events).To(ConsistOf(HaveField("Result", CacheExpired)))
+	})
+
+	It("resets only its namespace across pages and batches", func() {
+		client.PageSize = 7
+
+		ours := &S3QueryCacher{Client: client, Bucket: "queries", Namespace: "ours", ResetOptions: &ResetOptions{Workers: 4}}
+		theirs := &S3QueryCacher{Client: client, Bucket: "queries", Namespace: "theirs"}
+
+		for i := range 30 {
+			k := &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", i)}
+			Expect(ours.Set(ctx, k, item, time.Minute)).To(Succeed())
+		}
+		Expect(theirs.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		Expect(ours.Reset(ctx)).To(Succeed())
+		Expect(client.Keys("queries")).To(Equal([]string{"theirs/" + key.String()}))
+	})
+
+	It("leaves nested namespaces out of Entries and Reset", func() {
+		outer := &S3QueryCacher{Client: client, Bucket: "queries", Namespace: "a/b"}
+		inner := &S3QueryCacher{Client: client, Bucket: "queries", Namespace: "a/b/c"}
+
+		Expect(outer.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(inner.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		var keys []string
+		for entry, err := range outer.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			keys = append(keys, entry.Key)
+		}
+		Expect(keys).To(Equal([]string{key.String()}))
+
+		Expect(outer.Reset(ctx)).To(Succeed())
+		Expect(client.Keys("queries")).To(Equal([]string{"a%2Fb%2Fc/" + key.String()}))
+	})
+
+	It("lists entries without their leases and deletes them", func() {
+		cacher.StoreSQL = true
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		_, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		var entries []*QueryEntry
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			entries = append(entries, entry)
+		}
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Key).To(Equal(key.String()))
+		Expect(entries[0].SQL).To(Equal("SELECT 1"))
+
+		Expect(cacher.DeleteKey(ctx, entries[0].Key)).To(Succeed())
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("hands out exclusive leases and takes over expired ones", func() {
+		token, err := cacher.AcquireLease(ctx, key, -time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+
+		token, err = cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+
+		other, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeEmpty())
+
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,289 @@
+package pgxaws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// QueryCodec encodes cache items for storage.
+type QueryCodec interface {
+	// Marshal encodes the item.
+	Marshal(item *pgxcache.QueryItem) ([]byte, error)
+	// Unmarshal decodes data into the item.
+	Unmarshal(data []byte, item *pgxcache.QueryItem) error
+}
+
+var _ QueryCodec = TextCodec{}
+
+// TextCodec encodes cache items with pgxcache.QueryItem.MarshalText. It is the
+// default codec of the cachers.
+//
+// Unmarshal also decodes items encoded by BinaryCodec, so that the codec of a
+// cacher can be changed without invalidating its entries.
+type TextCodec struct{}
+
+// Marshal encodes the item with MarshalText.
+func (TextCodec) Marshal(item *pgxcache.QueryItem) ([]byte, error) {
+	return item.MarshalText()
+}
+
+// Unmarshal decodes data encoded by TextCodec or BinaryCodec into the item.
+func (TextCodec) Unmarshal(data []byte, item *pgxcache.QueryItem) error {
+	return unmarshalItem(data, item)
+}
+
+// codecOrDefault returns the codec, or TextCodec when it is nil.
+func codecOrDefault(codec QueryCodec) QueryCodec {
+	if codec == nil {
+		return TextCodec{}
+	}
+	return codec
+}
+
+// binaryMagic starts every item encoded by BinaryCodec. Its leading zero byte
+// never starts a gob stream, which begins with a non-zero message length.
+const binaryMagic = "\x00PGXQ"
+
+// binaryVersion is the version of the binary format written by BinaryCodec.
+const binaryVersion = 1
+
+// errBinaryTruncated is returned when binary data ends prematurely.
+var errBinaryTruncated = errors.New("pgxaws: truncated binary query item")
+
+var _ QueryCodec = BinaryCodec{}
+
+// BinaryCodec encodes cache items in a compact binary format that is much
+// faster to encode and decode than TextCodec for large results.
+//
+// The format starts with a magic string and a version byte, followed by the
+// command tag, the field descriptions and the rows. Values are stored in the
+// Postgres wire format they were received in, prefixed by their length, and
+// NULL values are distinguished from empty ones.
+//
+// Unmarshal also decodes items encoded by TextCodec, so that the codec of a
+// cacher can be changed without invalidating its entries. The values of
+// decoded items share memory with data.
+type BinaryCodec struct{}
+
+// Marshal encodes the item in the binary format.
+func (BinaryCodec) Marshal(item *pgxcache.QueryItem) ([]byte, error) {
+	size := len(binaryMagic) + 1 + binary.MaxVarintLen64 + len(item.CommandTag)
+	for _, field := range item.Fields {
+		size += binary.MaxVarintLen64 + len(field.Name) + 18
+	}
+	for _, row := range item.Rows {
+		size += binary.MaxVarintLen64
+		for _, value := range row {
+			size += binary.MaxVarintLen64 + len(value)
+		}
+	}
+
+	data := make([]byte, 0, size)
+	data = append(data, binaryMagic...)
+	data = append(data, binaryVersion)
+	data = appendString(data, item.CommandTag)
+
+	data = appendFields(data, item.Fields)
+
+	data = binary.AppendUvarint(data, uint64(len(item.Rows)))
+	for _, row := range item.Rows {
+		data = appendRow(data, row)
+	}
+
+	return data, nil
+}
+
+// Unmarshal decodes data encoded by BinaryCodec or TextCodec into the item.
+func (BinaryCodec) Unmarshal(data []byte, item *pgxcache.QueryItem) error {
+	return unmarshalItem(data, item)
+}
+
+// unmarshalItem decodes data encoded by any built-in codec.
+func unmarshalItem(data []byte, item *pgxcache.QueryItem) error {
+	switch {
+	case bytes.HasPrefix(data, []byte(framedMagic)):
+		return decodeFramed(bytes.NewReader(data), item)
+	case !bytes.HasPrefix(data, []byte(binaryMagic)):
+		return item.UnmarshalText(data)
+	}
+
+	r := &binaryReader{data: data[len(binaryMagic):]}
+	if version := r.byte(); r.err == nil && version != binaryVersion {
+		return fmt.Errorf("pgxaws: unsupported binary query item version %d", version)
+	}
+
+	item.CommandTag = r.string()
+	item.Fields = r.fields()
+
+	item.Rows = make([][][]byte, r.count(1))
+	for i := range item.Rows {
+		item.Rows[i] = r.row()
+	}
+
+	if r.err == nil && len(r.data) > 0 {
+		return fmt.Errorf("pgxaws: %d trailing bytes after binary query item", len(r.data))
+	}
+	return r.err
+}
+
+// appendString appends a length-prefixed string.
+func appendString(data []byte, s string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(s)))
+	return append(data, s...)
+}
+
+// appendFields appends the number of fields followed by their descriptions.
+func appendFields(data []byte, fields []pgconn.FieldDescription) []byte {
+	data = binary.AppendUvarint(data, uint64(len(fields)))
+	for _, field := range fields {
+		data = appendString(data, field.Name)
+		data = binary.BigEndian.AppendUint32(data, field.TableOID)
+		data = binary.BigEndian.AppendUint16(data, field.TableAttributeNumber)
+		data = binary.BigEndian.AppendUint32(data, field.DataTypeOID)
+		data = binary.BigEndian.AppendUint16(data, uint16(field.DataTypeSize))
+		data = binary.BigEndian.AppendUint32(data, uint32(field.TypeModifier))
+		data = binary.BigEndian.AppendUint16(data, uint16(field.Format))
+	}
+	return data
+}
+
+// appendRow appends the number of values of the row followed by the values.
+func appendRow(data []byte, row [][]byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(row)))
+	for _, value := range row {
+		if value == nil {
+			// NULL is encoded as a length of -1, as in the wire protocol.
+			data = binary.AppendVarint(data, -1)
+			continue
+		}
+		data = binary.AppendVarint(data, int64(len(value)))
+		data = append(data, value...)
+	}
+	return data
+}
+
+// binaryReader reads the binary format. After the first error every read
+// returns a zero value and the error is kept in err.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+// next consumes n bytes.
+func (x *binaryReader) next(n int) []byte {
+	if x.err != nil || n < 0 || n > len(x.data) {
+		x.err = errBinaryTruncated
+		return nil
+	}
+	b := x.data[:n:n]
+	x.data = x.data[n:]
+	return b
+}
+
+// byte reads a single byte.
+func (x *binaryReader) byte() byte {
+	if b := x.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// uint16 reads a big-endian uint16.
+func (x *binaryReader) uint16() uint16 {
+	if b := x.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// uint32 reads a big-endian uint32.
+func (x *binaryReader) uint32() uint32 {
+	if b := x.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// uvarint reads an unsigned varint.
+func (x *binaryReader) uvarint() uint64 {
+	if x.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(x.data)
+	if n <= 0 {
+		x.err = errBinaryTruncated
+		return 0
+	}
+	x.data = x.data[n:]
+	return v
+}
+
+// count reads the number of elements that follow, each taking at least
+// size bytes. Counts that cannot fit in the remaining data are rejected
+// before anything is allocated.
+func (x *binaryReader) count(size int) int {
+	n := x.uvarint()
+	if x.err == nil && n > uint64(len(x.data)/size) {
+		x.err = errBinaryTruncated
+		return 0
+	}
+	return int(n)
+}
+
+// string reads a length-prefixed string.
+func (x *binaryReader) string() string {
+	return string(x.next(x.count(1)))
+}
+
+// fields reads the field descriptions written by appendFields.
+func (x *binaryReader) fields() []pgconn.FieldDescription {
+	fields := make([]pgconn.FieldDescription, x.count(18))
+	for i := range fields {
+		fields[i] = pgconn.FieldDescription{
+			Name:                 x.string(),
+			TableOID:             x.uint32(),
+			TableAttributeNumber: x.uint16(),
+			DataTypeOID:          x.uint32(),
+			DataTypeSize:         int16(x.uint16()),
+			TypeModifier:         int32(x.uint32()),
+			Format:               int16(x.uint16()),
+		}
+	}
+	return fields
+}
+
+// row reads a row written by appendRow.
+func (x *binaryReader) row() [][]byte {
+	row := make([][]byte, x.count(1))
+	for i := range row {
+		row[i] = x.value()
+	}
+	return row
+}
+
+// value reads a length-prefixed value, which is nil for NULL.
+func (x *binaryReader) value() []byte {
+	if x.err != nil {
+		return nil
+	}
+	n, m := binary.Varint(x.data)
+	switch {
+	case m <= 0:
+		x.err = errBinaryTruncated
+		return nil
+	case n == -1:
+		x.data = x.data[m:]
+		return nil
+	}
+	x.data = x.data[m:]
+	if n > int64(len(x.data)) {
+		x.err = errBinaryTruncated
+		return nil
+	}
+	return x.next(int(n))
+}
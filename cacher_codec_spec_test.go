@@ -0,0 +1,104 @@
+package pgxaws
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("BinaryCodec", func() {
+	var (
+		codec BinaryCodec
+		item  *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		item = &pgxcache.QueryItem{
+			CommandTag: "SELECT 2",
+			Fields: []pgconn.FieldDescription{
+				{Name: "id", TableOID: 16384, TableAttributeNumber: 1, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1, Format: 1},
+				{Name: "name", TableOID: 16384, TableAttributeNumber: 2, DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1},
+			},
+			Rows: [][][]byte{
+				{{0, 0, 0, 1}, []byte("alice")},
+				{{0, 0, 0, 2}, nil},
+				{{0, 0, 0, 3}, {}},
+			},
+		}
+	})
+
+	It("round-trips items and distinguishes NULL from empty values", func() {
+		data, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+
+		got := &pgxcache.QueryItem{}
+		Expect(codec.Unmarshal(data, got)).To(Succeed())
+		Expect(got).To(Equal(item))
+		Expect(got.Rows[1][1]).To(BeNil())
+		Expect(got.Rows[2][1]).NotTo(BeNil())
+	})
+
+	It("is smaller than the text format", func() {
+		binary, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+		text, err := TextCodec{}.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(binary)).To(BeNumerically("<", len(text)))
+	})
+
+	It("decodes items of the other built-in codec", func() {
+		text, err := TextCodec{}.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+
+		got := &pgxcache.QueryItem{}
+		Expect(codec.Unmarshal(text, got)).To(Succeed())
+		Expect(got.CommandTag).To(Equal(item.CommandTag))
+
+		binary, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+
+		got = &pgxcache.QueryItem{}
+		Expect(TextCodec{}.Unmarshal(binary, got)).To(Succeed())
+		Expect(got).To(Equal(item))
+	})
+
+	It("rejects unknown versions", func() {
+		data, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+		data[len(binaryMagic)] = binaryVersion + 1
+
+		err = codec.Unmarshal(data, &pgxcache.QueryItem{})
+		Expect(err).To(MatchError(ContainSubstring("unsupported binary query item version")))
+	})
+
+	It("rejects truncated and oversized data", func() {
+		data, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+
+		for n := len(binaryMagic); n < len(data); n++ {
+			Expect(codec.Unmarshal(data[:n], &pgxcache.QueryItem{})).To(HaveOccurred())
+		}
+		Expect(codec.Unmarshal(append(data, 0), &pgxcache.QueryItem{})).To(HaveOccurred())
+	})
+
+	It("is used by the cachers", func() {
+		ctx := context.Background()
+		client := pgxawstest.NewS3()
+		cacher := &S3QueryCacher{Client: client, Bucket: "queries", Codec: codec}
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+
+		key := &pgxcache.QueryKey{SQL: "SELECT * FROM users"}
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		// a cacher with the default codec still reads the entry
+		reader := &S3QueryCacher{Client: client, Bucket: "queries"}
+		got, err := reader.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+})
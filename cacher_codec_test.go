@@ -0,0 +1,70 @@
+package pgxaws_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pgx-contrib/pgxaws"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// benchmarkItem returns a result of 1000 rows with 10 text columns.
+func benchmarkItem() *pgxcache.QueryItem {
+	item := &pgxcache.QueryItem{CommandTag: "SELECT 1000"}
+	for i := range 10 {
+		item.Fields = append(item.Fields, pgconn.FieldDescription{
+			Name:        fmt.Sprintf("column_%d", i),
+			TableOID:    16384,
+			DataTypeOID: 25,
+		})
+	}
+	for i := range 1000 {
+		row := make([][]byte, len(item.Fields))
+		for j := range row {
+			row[j] = fmt.Appendf(nil, "value %d of row %d", j, i)
+		}
+		item.Rows = append(item.Rows, row)
+	}
+	return item
+}
+
+func benchmarkCodec(b *testing.B, codec pgxaws.QueryCodec) {
+	item := benchmarkItem()
+	data, err := codec.Marshal(item)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for b.Loop() {
+			if _, err := codec.Marshal(item); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for b.Loop() {
+			if err := codec.Unmarshal(data, &pgxcache.QueryItem{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkTextCodec(b *testing.B) {
+	benchmarkCodec(b, pgxaws.TextCodec{})
+}
+
+func BenchmarkBinaryCodec(b *testing.B) {
+	benchmarkCodec(b, pgxaws.BinaryCodec{})
+}
+
+func BenchmarkFramedCodec(b *testing.B) {
+	benchmarkCodec(b, pgxaws.FramedCodec{})
+}
@@ -0,0 +1,76 @@
+package pgxaws
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("DynamoQueryCacher with DAX", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.DynamoDB
+		dax    *pgxawstest.DAX
+		cacher *DynamoQueryCacher
+		direct *DynamoQueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+		newer  *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewDynamoDB()
+		dax = pgxawstest.NewDAX(client)
+		cacher = &DynamoQueryCacher{Client: client, DAX: dax, Table: "queries"}
+		direct = &DynamoQueryCacher{Client: client, Table: "queries"}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+		newer = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("2")}}}
+
+		Expect(cacher.EnsureTable(ctx)).To(Succeed())
+	})
+
+	It("reads entries from the item cache and writes them through", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(client.Items("queries")).To(HaveLen(1))
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+
+		Expect(cacher.Set(ctx, key, newer, time.Minute)).To(Succeed())
+		Expect(cacher.Get(ctx, key)).To(Equal(newer))
+		Expect(cacher.GetMany(ctx, []*pgxcache.QueryKey{key})).To(Equal([]*pgxcache.QueryItem{newer}))
+		Expect(dax.Hits()).To(Equal(3))
+	})
+
+	It("does not see writes made without DAX until the item cache expires", func() {
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+		Expect(direct.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+
+		// strongly consistent reads bypass the item cache
+		cacher.ConsistentRead = true
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+
+		cacher.ConsistentRead = false
+		dax.TTL = time.Nanosecond
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+	})
+
+	It("deletes entries through DAX on Reset", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(client.Items("queries")).To(BeEmpty())
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+	})
+
+	It("refuses to recreate the table", func() {
+		cacher.ResetOptions = &ResetOptions{Recreate: true}
+		Expect(cacher.Reset(ctx)).To(MatchError("pgxaws: cannot recreate table queries behind DAX"))
+	})
+})
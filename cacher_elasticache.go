@@ -0,0 +1,188 @@
+package pgxaws
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/pgx-contrib/pgxcache"
+	"github.com/redis/go-redis/v9"
+)
+
+// elastiCacheScanCount is the number of keys requested by each SCAN of Reset,
+// which is also the number of keys deleted by each pipeline.
+const elastiCacheScanCount = 1000
+
+var _ pgxcache.QueryCacher = &ElastiCacheQueryCacher{}
+
+// ElastiCacheQueryCacher implements pgxcache.QueryCacher interface to use
+// Amazon ElastiCache (Valkey or Redis OSS). Items are stored as strings that
+// expire with the native key TTL, so expired items are never returned and are
+// removed by the server.
+type ElastiCacheQueryCacher struct {
+	// Client to interact with ElastiCache: a *redis.Client, or a
+	// *redis.ClusterClient with cluster mode enabled.
+	Client redis.UniversalClient
+	// Namespace scopes every key written by the cacher under a key prefix,
+	// so that several applications, environments or schema versions can share
+	// one cache (e.g. "billing/prod/v3"). Reset only removes keys under the
+	// prefix. As with S3QueryCacher, the namespace is escaped in the prefix,
+	// so that "billing/prod" does not include "billing/prod/v3".
+	Namespace string
+	// Codec encodes the cached items. It defaults to TextCodec. The
+	// built-in codecs decode each other's items, so it can be changed
+	// without invalidating existing entries.
+	Codec QueryCodec
+
+	// auth is the token provider of the client built by
+	// NewElastiCacheQueryCacher, stopped by Close.
+	auth *ElastiCacheAuth
+}
+
+// NewElastiCacheQueryCacher creates a new ElastiCacheQueryCacher connected over
+// TLS to the endpoint of the cache, e.g. the configuration endpoint of a
+// cluster, using the default AWS configuration. The client authenticates as
+// the ElastiCache user with IAM auth tokens (see ElastiCacheAuth); cache is the
+// ID of the replication group or the name of the serverless cache. Endpoints
+// of serverless caches and the configuration endpoints of clusters are served
+// by a cluster client. Close stops the token refresh and closes the client.
+func NewElastiCacheQueryCacher(ctx context.Context, endpoint, cache, user string) (*ElastiCacheQueryCacher, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := strings.Cut(endpoint, ":")
+	auth := &ElastiCacheAuth{
+		Config:     &cfg,
+		User:       user,
+		Cache:      cache,
+		Serverless: strings.Contains(host, ".serverless."),
+	}
+
+	return &ElastiCacheQueryCacher{
+		Client: redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:                      []string{endpoint},
+			IsClusterMode:              auth.Serverless || strings.HasPrefix(host, "clustercfg."),
+			TLSConfig:                  &tls.Config{MinVersion: tls.VersionTLS12},
+			CredentialsProviderContext: auth.Credentials,
+		}),
+		auth: auth,
+	}, nil
+}
+
+// Close closes the client, and stops the background token refresh of the
+// cacher built by NewElastiCacheQueryCacher.
+func (r *ElastiCacheQueryCacher) Close() error {
+	if r.auth != nil {
+		r.auth.Close()
+	}
+	return r.Client.Close()
+}
+
+// Get retrieves a cache item from ElastiCache.
+func (r *ElastiCacheQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	data, err := r.Client.Get(ctx, namespaceKey(r.Namespace, key)).Bytes()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	recordStats(ctx, func(stats *cacheStats) { stats.bytesRead += int64(len(data)) })
+
+	item := &pgxcache.QueryItem{}
+	if err := codecOrDefault(r.Codec).Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Set stores a cache item in ElastiCache with the provided TTL, rounded to the
+// millisecond. An item stored with a TTL that has already elapsed replaces the
+// existing item by a miss.
+func (r *ElastiCacheQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, ttl time.Duration) error {
+	id := namespaceKey(r.Namespace, key)
+	if ttl < time.Millisecond {
+		return r.Client.Del(ctx, id).Err()
+	}
+
+	data, err := codecOrDefault(r.Codec).Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	if err := r.Client.Set(ctx, id, data, ttl).Err(); err != nil {
+		return err
+	}
+
+	recordStats(ctx, func(stats *cacheStats) { stats.bytesWritten += int64(len(data)) })
+	return nil
+}
+
+// Delete removes the cache item of the key from ElastiCache.
+func (r *ElastiCacheQueryCacher) Delete(ctx context.Context, key *pgxcache.QueryKey) error {
+	return r.Client.Del(ctx, namespaceKey(r.Namespace, key)).Err()
+}
+
+// Reset deletes all keys under the cacher namespace from ElastiCache. Without
+// a namespace every key in the database is deleted. The keys are found with
+// SCAN, on every primary of a cluster, and unlinked in pipelines.
+func (r *ElastiCacheQueryCacher) Reset(ctx context.Context) error {
+	if cluster, ok := r.Client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return r.deleteKeys(ctx, node)
+		})
+	}
+	return r.deleteKeys(ctx, r.Client)
+}
+
+// deleteKeys unlinks the keys under the cacher namespace found by SCAN on one
+// node. Keys are unlinked one by one, as the keys of a batch may belong to
+// different hash slots.
+func (r *ElastiCacheQueryCacher) deleteKeys(ctx context.Context, client redis.Cmdable) error {
+	pattern := escapeGlob(namespacePrefix(r.Namespace)) + "*"
+
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, elastiCacheScanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					pipe.Unlink(ctx, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// escapeGlob escapes the characters of s that are special in the glob-style
+// patterns of SCAN MATCH.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
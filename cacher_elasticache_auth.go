@@ -0,0 +1,158 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go/logging"
+)
+
+const (
+	// elastiCacheTokenLifetime is the validity of ElastiCache IAM auth tokens.
+	elastiCacheTokenLifetime = 15 * time.Minute
+	// elastiCacheTokenRefresh is the interval at which ElastiCacheAuth renews
+	// its token, which leaves a 5-minute safety margin.
+	elastiCacheTokenRefresh = 10 * time.Minute
+	// emptyPayloadHash is the SHA-256 hash of an empty request body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// ElastiCacheAuth builds IAM auth tokens for ElastiCache users, which are
+// SigV4-presigned connect requests valid for 15 minutes. Like the tokens of
+// Connector, the current token is cached and renewed every 10 minutes in the
+// background once Credentials has been called.
+//
+// IAM authentication requires TLS, and ElastiCache closes connections
+// authenticated with IAM after 12 hours; the client then reconnects with a
+// fresh token.
+type ElastiCacheAuth struct {
+	// Config is the AWS configuration.
+	Config *aws.Config
+	// User is the ID of the ElastiCache user, which must have IAM
+	// authentication enabled. It is also its user name.
+	User string
+	// Cache is the ID of the replication group, or the name of the serverless
+	// cache.
+	Cache string
+	// Serverless is set when Cache is a serverless cache.
+	Serverless bool
+
+	mu          sync.Mutex
+	initialized bool
+	close       context.CancelFunc
+	token       atomic.Pointer[string]
+}
+
+// Authorize builds a new auth token.
+func (x *ElastiCacheAuth) Authorize(ctx context.Context) (*string, error) {
+	if x.Config == nil || x.Config.Credentials == nil {
+		return nil, errors.New("pgxaws: no AWS credentials for ElastiCache IAM authentication")
+	}
+
+	credentials, err := x.Config.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("Action", "connect")
+	query.Set("User", x.User)
+	if x.Serverless {
+		query.Set("ResourceType", "ServerlessCache")
+	}
+	query.Set("X-Amz-Expires", strconv.Itoa(int(elastiCacheTokenLifetime.Seconds())))
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+x.Cache+"/?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	uri, _, err := v4.NewSigner().PresignHTTP(ctx, credentials, request, emptyPayloadHash, "elasticache", x.Config.Region, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	token := strings.TrimPrefix(uri, "http://")
+	return &token, nil
+}
+
+// Credentials returns the user name and the current auth token. It has the
+// signature of the CredentialsProviderContext option of go-redis clients.
+func (x *ElastiCacheAuth) Credentials(ctx context.Context) (string, string, error) {
+	// Fast path: a valid token is already cached.
+	if token := x.token.Load(); token != nil {
+		return x.User, *token, nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	// Double-check after acquiring the lock; another goroutine may have
+	// stored a token while we were waiting.
+	if token := x.token.Load(); token != nil {
+		return x.User, *token, nil
+	}
+
+	token, err := x.Authorize(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	x.token.Store(token)
+
+	if !x.initialized {
+		bgCtx, cancel := context.WithCancel(context.Background())
+		x.close = cancel
+		x.initialized = true
+		go x.session(bgCtx)
+	}
+
+	return x.User, *token, nil
+}
+
+// Close stops the background token refresh goroutine and clears the cached
+// token. The next call to Credentials builds a new token and restarts the
+// refresh.
+func (x *ElastiCacheAuth) Close() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.close != nil {
+		x.close()
+		x.close = nil
+	}
+	x.initialized = false
+	x.token.Store(nil)
+}
+
+// session refreshes the token every 10 minutes until ctx is cancelled.
+func (x *ElastiCacheAuth) session(ctx context.Context) {
+	ticker := time.NewTicker(elastiCacheTokenRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			token, err := x.Authorize(ctx)
+			if err != nil {
+				// Keep the current token active; it remains valid for up to
+				// 15 minutes from when it was issued.
+				if x.Config.Logger != nil {
+					x.Config.Logger.Logf(logging.Warn, err.Error())
+				}
+				continue
+			}
+			x.token.Store(token)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
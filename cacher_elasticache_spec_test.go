@@ -0,0 +1,183 @@
+package pgxaws
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go/logging"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("ElastiCacheAuth", func() {
+	var (
+		ctx  context.Context
+		auth *ElastiCacheAuth
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		auth = &ElastiCacheAuth{
+			Config: &aws.Config{
+				Region:      "us-east-1",
+				Credentials: staticCredentials(),
+				Logger:      logging.Nop{},
+			},
+			User:  "app-user",
+			Cache: "queries",
+		}
+	})
+
+	AfterEach(func() {
+		auth.Close()
+	})
+
+	It("builds presigned connect requests", func() {
+		token, err := auth.Authorize(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*token).To(HavePrefix("queries/?"))
+
+		u, err := url.Parse("http://" + *token)
+		Expect(err).NotTo(HaveOccurred())
+		query := u.Query()
+		Expect(query.Get("Action")).To(Equal("connect"))
+		Expect(query.Get("User")).To(Equal("app-user"))
+		Expect(query.Get("X-Amz-Expires")).To(Equal("900"))
+		Expect(query.Get("X-Amz-Credential")).To(ContainSubstring("/us-east-1/elasticache/aws4_request"))
+		Expect(query.Get("X-Amz-Signature")).NotTo(BeEmpty())
+		Expect(query.Has("ResourceType")).To(BeFalse())
+
+		auth.Serverless = true
+		token, err = auth.Authorize(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*token).To(ContainSubstring("ResourceType=ServerlessCache"))
+	})
+
+	It("caches the token until it is closed", func() {
+		user, token, err := auth.Credentials(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(user).To(Equal("app-user"))
+
+		time.Sleep(1100 * time.Millisecond)
+		_, again, err := auth.Credentials(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(token))
+
+		auth.Close()
+		_, fresh, err := auth.Credentials(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fresh).NotTo(Equal(token))
+	})
+
+	It("requires credentials", func() {
+		auth.Config.Credentials = nil
+		_, _, err := auth.Credentials(ctx)
+		Expect(err).To(MatchError(ContainSubstring("no AWS credentials")))
+	})
+})
+
+var _ = Describe("ElastiCacheQueryCacher", func() {
+	var (
+		ctx    context.Context
+		server *miniredis.Miniredis
+		client *redis.Client
+		cacher *ElastiCacheQueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		server = miniredis.RunT(GinkgoT())
+		client = redis.NewClient(&redis.Options{Addr: server.Addr()})
+		DeferCleanup(client.Close)
+
+		cacher = &ElastiCacheQueryCacher{Client: client, Namespace: "app"}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+	})
+
+	It("returns nil for a missing key", func() {
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+	})
+
+	It("stores items with a native TTL", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(server.Keys()).To(Equal([]string{"app/" + key.String()}))
+		Expect(server.TTL("app/" + key.String())).To(Equal(time.Minute))
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+
+		server.FastForward(time.Minute)
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+	})
+
+	It("replaces items stored with an elapsed TTL by a miss", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Set(ctx, key, item, 0)).To(Succeed())
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+	})
+
+	It("deletes items", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Delete(ctx, key)).To(Succeed())
+		Expect(server.Keys()).To(BeEmpty())
+	})
+
+	It("only resets the keys in its namespace", func() {
+		other := &ElastiCacheQueryCacher{Client: client, Namespace: "app/v2"}
+		Expect(other.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		for i := range 2500 {
+			key := &pgxcache.QueryKey{SQL: "SELECT 1", Args: []any{i}}
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		}
+
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(server.Keys()).To(Equal([]string{"app%2Fv2/" + key.String()}))
+
+		Expect(other.Reset(ctx)).To(Succeed())
+		Expect(server.Keys()).To(BeEmpty())
+	})
+
+	It("authenticates with the tokens of ElastiCacheAuth", func() {
+		auth := &ElastiCacheAuth{
+			Config: &aws.Config{Region: "us-east-1", Credentials: staticCredentials()},
+			User:   "app-user",
+			Cache:  "queries",
+		}
+		DeferCleanup(auth.Close)
+
+		_, token, err := auth.Credentials(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		server.RequireUserAuth("app-user", token)
+
+		cacher.Client = redis.NewClient(&redis.Options{
+			Addr:                       server.Addr(),
+			CredentialsProviderContext: auth.Credentials,
+		})
+		DeferCleanup(cacher.Client.Close)
+
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(server.Keys()).To(HaveLen(1))
+	})
+
+	It("stops the token refresh and closes the client on Close", func() {
+		cacher.Client = redis.NewClient(&redis.Options{Addr: server.Addr()})
+		cacher.auth = &ElastiCacheAuth{
+			Config: &aws.Config{Region: "us-east-1", Credentials: staticCredentials()},
+			User:   "app-user",
+			Cache:  "queries",
+		}
+		_, _, err := cacher.auth.Credentials(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cacher.Close()).To(Succeed())
+		Expect(cacher.auth.token.Load()).To(BeNil())
+		Expect(cacher.Client.Ping(ctx).Err()).To(MatchError(redis.ErrClosed))
+	})
+})
@@ -0,0 +1,133 @@
+package pgxaws
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Encryption configures the server-side encryption of the objects written
+// by S3QueryCacher. Without it, objects are encrypted with the default
+// encryption of the bucket.
+type S3Encryption struct {
+	// Algorithm is the server-side encryption algorithm:
+	// s3types.ServerSideEncryptionAes256 for SSE-S3,
+	// s3types.ServerSideEncryptionAwsKms for SSE-KMS or
+	// s3types.ServerSideEncryptionAwsKmsDsse for DSSE-KMS. It is ignored when
+	// CustomerKey is set.
+	Algorithm s3types.ServerSideEncryption
+	// KMSKeyID is the ID, ARN or alias of the KMS key used by SSE-KMS. The
+	// AWS managed key is used when empty.
+	KMSKeyID string
+	// KMSContext is the encryption context of SSE-KMS.
+	KMSContext map[string]string
+	// BucketKey uses an S3 Bucket Key for SSE-KMS, which reduces the number
+	// of requests to KMS.
+	BucketKey bool
+	// CustomerKey is the 256-bit key of SSE-C. S3 does not store it, so it is
+	// sent on every read as well. Objects written with another key cannot be
+	// read. Directory buckets do not support SSE-C.
+	CustomerKey []byte
+}
+
+// customerKey returns the SSE-C headers: the algorithm, the base64 encoded key
+// and its base64 encoded MD5 digest. They are nil without customer key.
+func (x *S3Encryption) customerKey() (*string, *string, *string) {
+	if x == nil || len(x.CustomerKey) == 0 {
+		return nil, nil, nil
+	}
+
+	sum := md5.Sum(x.CustomerKey)
+	return aws.String(string(s3types.ServerSideEncryptionAes256)),
+		aws.String(base64.StdEncoding.EncodeToString(x.CustomerKey)),
+		aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// applyPut sets the encryption headers of an upload.
+func (x *S3Encryption) applyPut(input *s3.PutObjectInput) {
+	if x == nil {
+		return
+	}
+
+	if len(x.CustomerKey) > 0 {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = x.customerKey()
+		return
+	}
+
+	input.ServerSideEncryption = x.Algorithm
+	if x.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(x.KMSKeyID)
+	}
+	if len(x.KMSContext) > 0 {
+		// The context is sent as base64 encoded JSON.
+		encoded, _ := json.Marshal(x.KMSContext)
+		input.SSEKMSEncryptionContext = aws.String(base64.StdEncoding.EncodeToString(encoded))
+	}
+	if x.BucketKey {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+}
+
+// applyCreate sets the encryption headers of a multipart upload, which are the
+// same as those of a single upload.
+func (x *S3Encryption) applyCreate(input *s3.CreateMultipartUploadInput) {
+	put := &s3.PutObjectInput{}
+	x.applyPut(put)
+
+	input.ServerSideEncryption = put.ServerSideEncryption
+	input.SSEKMSKeyId = put.SSEKMSKeyId
+	input.SSEKMSEncryptionContext = put.SSEKMSEncryptionContext
+	input.BucketKeyEnabled = put.BucketKeyEnabled
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = put.SSECustomerAlgorithm, put.SSECustomerKey, put.SSECustomerKeyMD5
+}
+
+// bucketOwner returns the expected owner of the bucket sent with every
+// request, or nil when it is not checked.
+func (r *S3QueryCacher) bucketOwner() *string {
+	if r.ExpectedBucketOwner == "" {
+		return nil
+	}
+	return aws.String(r.ExpectedBucketOwner)
+}
+
+// tagging returns the object tags as an URL query, or nil without tags.
+func (r *S3QueryCacher) tagging() *string {
+	if len(r.Tags) == 0 {
+		return nil
+	}
+
+	values := url.Values{}
+	for k, v := range r.Tags {
+		values.Set(k, v)
+	}
+	return aws.String(values.Encode())
+}
+
+// getObjectInput returns the input of a GetObject call that reads the object
+// with the given storage key.
+func (r *S3QueryCacher) getObjectInput(id string) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(id),
+		ExpectedBucketOwner: r.bucketOwner(),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = r.Encryption.customerKey()
+	return input
+}
+
+// headObjectInput returns the input of a HeadObject call that reads the
+// metadata of the object with the given storage key.
+func (r *S3QueryCacher) headObjectInput(id string) *s3.HeadObjectInput {
+	input := &s3.HeadObjectInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(id),
+		ExpectedBucketOwner: r.bucketOwner(),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = r.Encryption.customerKey()
+	return input
+}
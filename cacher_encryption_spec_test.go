@@ -0,0 +1,112 @@
+package pgxaws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("S3QueryCacher object settings", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.S3
+		cacher *S3QueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+	)
+
+	errorCode := func(err error) string {
+		var aerr smithy.APIError
+		Expect(errors.As(err, &aerr)).To(BeTrue())
+		return aerr.ErrorCode()
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		client.AccountID = "111122223333"
+		cacher = &S3QueryCacher{Client: client, Bucket: "queries", ExpectedBucketOwner: "111122223333"}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("encrypts, classifies and tags every object", func() {
+		cacher.Encryption = &S3Encryption{
+			Algorithm:  s3types.ServerSideEncryptionAwsKms,
+			KMSKeyID:   "alias/cache",
+			KMSContext: map[string]string{"app": "billing"},
+			BucketKey:  true,
+		}
+		cacher.StorageClass = s3types.StorageClassIntelligentTiering
+		cacher.Tags = map[string]string{"team": "billing", "cost-center": "42"}
+
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		_, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, id := range client.Keys("queries") {
+			head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("queries"), Key: aws.String(id)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(head.ServerSideEncryption).To(Equal(s3types.ServerSideEncryptionAwsKms))
+			Expect(aws.ToString(head.SSEKMSKeyId)).To(Equal("alias/cache"))
+			Expect(aws.ToBool(head.BucketKeyEnabled)).To(BeTrue())
+			Expect(head.StorageClass).To(Equal(s3types.StorageClassIntelligentTiering))
+			Expect(client.Tags("queries", id)).To(Equal(cacher.Tags))
+		}
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("reads objects encrypted with a customer key", func() {
+		cacher.Encryption = &S3Encryption{CustomerKey: bytes.Repeat([]byte{7}, 32)}
+		cacher.StoreSQL = true
+
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entry.SQL).To(Equal(key.SQL))
+		}
+
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+
+		other := &S3QueryCacher{Client: client, Bucket: "queries"}
+		_, err = other.Get(ctx, key)
+		Expect(errorCode(err)).To(Equal("InvalidRequest"))
+
+		other.Encryption = &S3Encryption{CustomerKey: bytes.Repeat([]byte{8}, 32)}
+		_, err = other.Get(ctx, key)
+		Expect(errorCode(err)).To(Equal("AccessDenied"))
+	})
+
+	It("checks the bucket owner", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Reset(ctx)).To(Succeed())
+
+		cacher.ExpectedBucketOwner = "444455556666"
+		Expect(errorCode(cacher.Set(ctx, key, item, time.Minute))).To(Equal("AccessDenied"))
+		_, err := cacher.Get(ctx, key)
+		Expect(errorCode(err)).To(Equal("AccessDenied"))
+		Expect(errorCode(cacher.EnsureBucket(ctx, time.Hour))).To(Equal("AccessDenied"))
+	})
+})
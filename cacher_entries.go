@@ -0,0 +1,206 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pgx-contrib/pgxcache"
+	"golang.org/x/sync/errgroup"
+)
+
+// entriesHeadWorkers is the number of HeadObject requests issued concurrently
+// while listing S3 entries.
+const entriesHeadWorkers = 16
+
+// Delete removes the cache item of the key from DynamoDB.
+func (r *DynamoQueryCacher) Delete(ctx context.Context, key *pgxcache.QueryKey) error {
+	return r.DeleteKey(ctx, key.String())
+}
+
+// DeleteKey removes the cache item with the given key, as returned in
+// QueryEntry.Key by Entries, from DynamoDB.
+func (r *DynamoQueryCacher) DeleteKey(ctx context.Context, key string) error {
+	_, err := r.dataClient().DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.Table),
+		Key:       r.primaryKey(r.schema(), key),
+	})
+	return err
+}
+
+// Entries iterates over the entries in the cacher namespace, including
+// expired entries that DynamoDB TTL has not removed yet. Only metadata is
+// returned: the Item of each entry is nil.
+//
+// The table is scanned, or queried when it has a sort key (see DynamoSchema),
+// without reading the cached results back, but DynamoDB still charges the
+// read capacity of whole items. Without a namespace, the entries of every
+// namespace are returned, unless the table has a sort key: only the entries
+// of the partition of the cacher without namespace are then returned.
+func (r *DynamoQueryCacher) Entries(ctx context.Context) iter.Seq2[*QueryEntry, error] {
+	return func(yield func(*QueryEntry, error) bool) {
+		schema := r.schema()
+		for items, err := range r.pages(ctx, schema, 0, 1, schema.Size, schema.SQL, schema.TTL, schema.RefreshAt) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, item := range items {
+				id, err := r.itemKey(schema, item)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				// Lease lock items are not cache entries.
+				if strings.HasSuffix(id, leaseSuffix) {
+					continue
+				}
+
+				row := &DynamoQuery{ID: id}
+				if err := row.unmarshal(schema, item); err != nil {
+					yield(nil, err)
+					return
+				}
+
+				entry := &QueryEntry{
+					Key:       row.ID,
+					Size:      row.Size,
+					SQL:       row.SQL,
+					ExpireAt:  row.ExpireAt,
+					RefreshAt: row.RefreshAt,
+				}
+				if !yield(entry, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Delete removes the cache object of the key from S3.
+func (r *S3QueryCacher) Delete(ctx context.Context, key *pgxcache.QueryKey) error {
+	return r.DeleteKey(ctx, key.String())
+}
+
+// DeleteKey removes the cache object with the given key, as returned in
+// QueryEntry.Key by Entries, from S3.
+func (r *S3QueryCacher) DeleteKey(ctx context.Context, key string) error {
+	ids := r.objectKeys(key)
+	if len(ids) == 1 {
+		_, err := r.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:              aws.String(r.Bucket),
+			Key:                 aws.String(ids[0]),
+			ExpectedBucketOwner: r.bucketOwner(),
+		})
+		return err
+	}
+
+	// The entry may be stored in any of the expiry days of the layout.
+	objects := make([]s3types.ObjectIdentifier, len(ids))
+	for i, id := range ids {
+		objects[i] = s3types.ObjectIdentifier{Key: aws.String(id)}
+	}
+	return r.deleteBatch(ctx, objects)
+}
+
+// Entries iterates over the entries under the cacher namespace, including
+// expired entries that no lifecycle rule has removed yet. Only metadata is
+// returned: the Item of each entry is nil.
+//
+// Listing does not return object metadata, so the metadata of each page of
+// objects is read with concurrent HeadObject requests, or with ranged
+// GetObject requests that read the object header in directory buckets.
+func (r *S3QueryCacher) Entries(ctx context.Context) iter.Seq2[*QueryEntry, error] {
+	return func(yield func(*QueryEntry, error) bool) {
+		for entry, err := range r.entries(ctx, namespacePrefix(r.Namespace)) {
+			if entry != nil {
+				entry.Key = r.entryKey(entry.Key)
+			}
+			if !yield(entry, err) {
+				return
+			}
+		}
+	}
+}
+
+// entries iterates over the entries stored under the prefix. The Key of each
+// entry is its storage key.
+func (r *S3QueryCacher) entries(ctx context.Context, prefix string) iter.Seq2[*QueryEntry, error] {
+	return func(yield func(*QueryEntry, error) bool) {
+		input := &s3.ListObjectsV2Input{
+			Bucket:              aws.String(r.Bucket),
+			ExpectedBucketOwner: r.bucketOwner(),
+		}
+		if prefix != "" {
+			input.Prefix = aws.String(prefix)
+		}
+
+		paginator := s3.NewListObjectsV2Paginator(r.Client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			entries, err := r.headObjects(ctx, page.Contents)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, entry := range entries {
+				if entry == nil {
+					continue
+				}
+				if !yield(entry, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// headObjects reads the metadata of the objects. The entries are returned in
+// the order of the objects; objects that are lease locks or that were deleted
+// in the meantime have a nil entry.
+func (r *S3QueryCacher) headObjects(ctx context.Context, objects []s3types.Object) ([]*QueryEntry, error) {
+	entries := make([]*QueryEntry, len(objects))
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(entriesHeadWorkers)
+
+	for i, obj := range objects {
+		if strings.HasSuffix(aws.ToString(obj.Key), leaseSuffix) {
+			continue
+		}
+
+		group.Go(func() error {
+			head, err := r.headObject(ctx, aws.ToString(obj.Key))
+			var nerr *s3types.NotFound
+			switch {
+			case errors.As(err, &nerr):
+				return nil
+			case err != nil:
+				return err
+			}
+
+			entry := metadataEntry(head.Metadata)
+			entry.Key = aws.ToString(obj.Key)
+			entry.Size = head.Size
+			entries[i] = entry
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
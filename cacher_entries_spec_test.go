@@ -0,0 +1,99 @@
+package pgxaws
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("metadataEntry", func() {
+	It("reads the expiry and the query text", func() {
+		entry := metadataEntry(map[string]string{
+			metaKeyExpiresAt: "2030-01-02T03:04:05Z",
+			metaKeySQL:       url.QueryEscape("SELECT 'é' FROM t"),
+		})
+		Expect(entry.ExpireAt).To(Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)))
+		Expect(entry.SQL).To(Equal("SELECT 'é' FROM t"))
+	})
+
+	It("ignores malformed values", func() {
+		entry := metadataEntry(map[string]string{metaKeyExpiresAt: "soon", metaKeySQL: "%zz"})
+		Expect(entry.ExpireAt).To(BeZero())
+		Expect(entry.SQL).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Entries", func() {
+	var (
+		ctx  context.Context
+		key  *pgxcache.QueryKey
+		item *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		key = &pgxcache.QueryKey{SQL: "SELECT 'entries'"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+	})
+
+	It("lists and deletes DynamoDB entries", func() {
+		table := os.Getenv("PGXAWS_DYNAMODB_TABLE")
+		if table == "" {
+			Skip("PGXAWS_DYNAMODB_TABLE not set")
+		}
+
+		client, err := NewDynamoQueryCacher(ctx, table)
+		Expect(err).NotTo(HaveOccurred())
+		cacher := &DynamoQueryCacher{Client: client.Client, Table: table, Namespace: "pgxaws/test/entries", StoreSQL: true}
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		var entries []*QueryEntry
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			entries = append(entries, entry)
+		}
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Key).To(Equal(key.String()))
+		Expect(entries[0].SQL).To(Equal(key.SQL))
+		Expect(entries[0].Size).To(BeNumerically(">", 0))
+
+		Expect(cacher.DeleteKey(ctx, entries[0].Key)).To(Succeed())
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("lists and deletes S3 entries", func() {
+		bucket := os.Getenv("PGXAWS_S3_BUCKET")
+		if bucket == "" {
+			Skip("PGXAWS_S3_BUCKET not set")
+		}
+
+		client, err := NewS3QueryCacher(ctx, bucket)
+		Expect(err).NotTo(HaveOccurred())
+		cacher := &S3QueryCacher{Client: client.Client, Bucket: bucket, Namespace: "pgxaws/test/entries", StoreSQL: true}
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		var entries []*QueryEntry
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			entries = append(entries, entry)
+		}
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Key).To(Equal(key.String()))
+		Expect(entries[0].SQL).To(Equal(key.SQL))
+		Expect(entries[0].Size).To(BeNumerically(">", 0))
+
+		Expect(cacher.Delete(ctx, key)).To(Succeed())
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+})
@@ -0,0 +1,195 @@
+package pgxaws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// directoryBucketSuffix ends the name of every S3 Express One Zone directory
+// bucket, e.g. "cache--use1-az4--x-s3".
+const directoryBucketSuffix = "--x-s3"
+
+// objectHeaderMagic starts the metadata header that precedes the body of the
+// objects written to directory buckets. The leading zero byte cannot start a
+// gob stream, nor the magic of BinaryCodec.
+const objectHeaderMagic = "\x00PGXM"
+
+// objectHeaderReadSize is the number of bytes read to decode the header of an
+// object without its body. Headers are smaller, as they hold the same values
+// as user-defined metadata, whose size is limited (see metaSQLMaxSize).
+const objectHeaderReadSize = 8 << 10
+
+// directoryResetPasses is the maximum number of times Reset lists and deletes
+// the objects of a directory bucket.
+const directoryResetPasses = 5
+
+// isDirectoryBucket reports whether the bucket is an S3 Express One Zone
+// directory bucket.
+func isDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, directoryBucketSuffix)
+}
+
+// directoryBucketZone returns the ID of the zone of a directory bucket, which
+// is part of its name.
+func directoryBucketZone(bucket string) (string, error) {
+	parts := strings.Split(strings.TrimSuffix(bucket, directoryBucketSuffix), "--")
+	if len(parts) < 2 || parts[len(parts)-1] == "" {
+		return "", fmt.Errorf("pgxaws: directory bucket %s has no zone ID", bucket)
+	}
+	return parts[len(parts)-1], nil
+}
+
+// directory reports whether the cache bucket is a directory bucket.
+func (r *S3QueryCacher) directory() bool {
+	return isDirectoryBucket(r.Bucket)
+}
+
+// objectHead is the metadata of an object.
+type objectHead struct {
+	// Metadata holds the values stored next to the object.
+	Metadata map[string]string
+	// ETag identifies the version of the object for conditional requests.
+	ETag *string
+	// Size is the size of the object data, without header.
+	Size int64
+}
+
+// putObjectInput returns the input of a PutObject call that stores data and
+// its metadata. Directory buckets get the metadata in a header that precedes
+// the data, so that it is not subject to how they handle user-defined
+// metadata.
+func (r *S3QueryCacher) putObjectInput(id string, metadata map[string]string, data []byte) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(id),
+		ExpectedBucketOwner: r.bucketOwner(),
+		StorageClass:        r.StorageClass,
+		Tagging:             r.tagging(),
+	}
+	r.Encryption.applyPut(input)
+
+	body := data
+	if r.directory() {
+		body = appendObjectHeader(nil, metadata)
+		body = append(body, data...)
+	} else {
+		input.Metadata = metadata
+	}
+
+	input.Body = bytes.NewReader(body)
+	s3Checksum(input, r.Checksum, body)
+	return input
+}
+
+// headObject returns the metadata of an object, or an *s3types.NotFound error
+// when it does not exist. The header of objects in directory buckets is read
+// with a ranged GetObject.
+func (r *S3QueryCacher) headObject(ctx context.Context, id string) (*objectHead, error) {
+	if !r.directory() {
+		out, err := r.Client.HeadObject(ctx, r.headObjectInput(id))
+		if err != nil {
+			return nil, err
+		}
+		return &objectHead{Metadata: out.Metadata, ETag: out.ETag, Size: aws.ToInt64(out.ContentLength)}, nil
+	}
+
+	input := r.getObjectInput(id)
+	input.Range = aws.String(fmt.Sprintf("bytes=0-%d", objectHeaderReadSize-1))
+	out, err := r.Client.GetObject(ctx, input)
+	var kerr *s3types.NoSuchKey
+	switch {
+	case errors.As(err, &kerr):
+		return nil, &s3types.NotFound{Message: kerr.Message}
+	case err != nil:
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	metadata, n, err := readObjectHeader(bufio.NewReader(out.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	size := aws.ToInt64(out.ContentLength)
+	// The content range ends with the size of the whole object.
+	if _, total, ok := strings.Cut(aws.ToString(out.ContentRange), "/"); ok {
+		if v, err := strconv.ParseInt(total, 10, 64); err == nil {
+			size = v
+		}
+	}
+	return &objectHead{Metadata: metadata, ETag: out.ETag, Size: size - int64(n)}, nil
+}
+
+// deleteExpired removes an expired object, unless it has been replaced in the
+// meantime. Directory buckets have no lifecycle rule, so that expired objects
+// are removed when they are read. Errors are ignored.
+func (r *S3QueryCacher) deleteExpired(ctx context.Context, id string, etag *string) {
+	_, _ = r.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(id),
+		IfMatch:             etag,
+		ExpectedBucketOwner: r.bucketOwner(),
+	})
+}
+
+// appendObjectHeader appends the header holding the metadata to b. The header
+// consists of the magic, the uvarint length of the metadata and the metadata
+// encoded as a URL query.
+func appendObjectHeader(b []byte, metadata map[string]string) []byte {
+	values := url.Values{}
+	for k, v := range metadata {
+		values.Set(k, v)
+	}
+	// Encode sorts the keys, so that equal metadata gives equal headers.
+	encoded := values.Encode()
+
+	b = append(b, objectHeaderMagic...)
+	b = binary.AppendUvarint(b, uint64(len(encoded)))
+	return append(b, encoded...)
+}
+
+// readObjectHeader reads the header that precedes the body of an object and
+// returns the metadata and the size of the header. Bodies without header are
+// left untouched and have no metadata.
+func readObjectHeader(r *bufio.Reader) (map[string]string, int, error) {
+	magic, err := r.Peek(len(objectHeaderMagic))
+	if err != nil || string(magic) != objectHeaderMagic {
+		return nil, 0, nil
+	}
+	_, _ = r.Discard(len(magic))
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("pgxaws: invalid object header: %w", err)
+	}
+	if size > objectHeaderReadSize {
+		return nil, 0, fmt.Errorf("pgxaws: object header of %d bytes is too large", size)
+	}
+
+	encoded := make([]byte, size)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return nil, 0, fmt.Errorf("pgxaws: invalid object header: %w", err)
+	}
+	values, err := url.ParseQuery(string(encoded))
+	if err != nil {
+		return nil, 0, fmt.Errorf("pgxaws: invalid object header: %w", err)
+	}
+
+	metadata := make(map[string]string, len(values))
+	for k := range values {
+		metadata[k] = values.Get(k)
+	}
+	return metadata, len(objectHeaderMagic) + len(binary.AppendUvarint(nil, size)) + int(size), nil
+}
@@ -0,0 +1,184 @@
+package pgxaws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("object headers", func() {
+	It("round-trips metadata", func() {
+		metadata := map[string]string{metaKeyExpiresAt: "2026-01-01T00:00:00Z", metaKeySQL: "SELECT+%27a%3Db%27"}
+		header := appendObjectHeader(nil, metadata)
+
+		reader := bufio.NewReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader([]byte("data"))))
+		got, n, err := readObjectHeader(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(metadata))
+		Expect(n).To(Equal(len(header)))
+
+		rest, err := io.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(rest)).To(Equal("data"))
+	})
+
+	It("leaves bodies without header untouched", func() {
+		reader := bufio.NewReader(bytes.NewReader([]byte("data")))
+		got, n, err := readObjectHeader(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+		Expect(n).To(BeZero())
+
+		rest, err := io.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(rest)).To(Equal("data"))
+	})
+
+	It("rejects truncated headers", func() {
+		header := appendObjectHeader(nil, map[string]string{metaKeyExpiresAt: "soon"})
+		_, _, err := readObjectHeader(bufio.NewReader(bytes.NewReader(header[:len(header)-1])))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("directoryBucketZone", func() {
+	It("parses the zone ID from the bucket name", func() {
+		Expect(directoryBucketZone("cache--use1-az4--x-s3")).To(Equal("use1-az4"))
+		Expect(directoryBucketZone("my--cache--usw2-az1--x-s3")).To(Equal("usw2-az1"))
+
+		_, err := directoryBucketZone("cache--x-s3")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("S3QueryCacher with a directory bucket", func() {
+	const bucket = "cache--use1-az4--x-s3"
+
+	var (
+		ctx    context.Context
+		client *pgxawstest.S3
+		cacher *S3QueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		cacher = &S3QueryCacher{Client: client, Bucket: bucket, Namespace: "billing", StoreSQL: true, Checksum: ChecksumCRC32C}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("creates the bucket without lifecycle rule", func() {
+		_, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+		Expect(err).To(HaveOccurred())
+
+		// Creating the bucket is idempotent.
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("stores metadata in the object header", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("billing/" + key.String())})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(head.Metadata).To(BeEmpty())
+
+		entry, err := cacher.GetEntry(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Item).To(Equal(item))
+		Expect(entry.SQL).To(Equal(key.SQL))
+		Expect(entry.ExpireAt).To(BeTemporally("~", time.Now().Add(time.Minute), 2*time.Second))
+
+		data, err := codecOrDefault(cacher.Codec).Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+
+		var entries []*QueryEntry
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			entries = append(entries, entry)
+		}
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Key).To(Equal(key.String()))
+		Expect(entries[0].SQL).To(Equal(key.SQL))
+		Expect(entries[0].Size).To(Equal(int64(len(data))))
+	})
+
+	It("deletes expired objects when they are read", func() {
+		Expect(cacher.Set(ctx, key, item, -time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+		Expect(client.Keys(bucket)).To(BeEmpty())
+	})
+
+	It("hands out leases", func() {
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+
+		other, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeEmpty())
+
+		Expect(cacher.ReleaseLease(ctx, key, "other")).To(Succeed())
+		Expect(client.Keys(bucket)).To(HaveLen(1))
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+		Expect(client.Keys(bucket)).To(BeEmpty())
+	})
+
+	It("resets until no object is left", func() {
+		client.PageSize = 3
+		for i := range 10 {
+			Expect(cacher.Set(ctx, &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", i)}, item, time.Minute)).To(Succeed())
+		}
+
+		// Objects written while the first pass runs are deleted by the next.
+		written := false
+		cacher.ResetOptions = &ResetOptions{
+			Workers: 2,
+			Progress: func(ResetProgress) {
+				if !written {
+					written = true
+					Expect(cacher.Set(ctx, &pgxcache.QueryKey{SQL: "SELECT 10"}, item, time.Minute)).To(Succeed())
+				}
+			},
+		}
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(client.Keys(bucket)).To(BeEmpty())
+	})
+
+	It("fails when objects are still found after the last pass", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		// An object is written after each batch of deletes.
+		written := 0
+		cacher.ResetOptions = &ResetOptions{
+			Progress: func(ResetProgress) {
+				written++
+				Expect(cacher.Set(ctx, &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", written)}, item, time.Minute)).To(Succeed())
+			},
+		}
+		Expect(cacher.Reset(ctx)).To(MatchError("pgxaws: namespace billing may not be empty after 5 passes"))
+		Expect(written).To(Equal(directoryResetPasses))
+	})
+
+	It("rejects resets of object versions", func() {
+		cacher.ResetOptions = &ResetOptions{Versions: true}
+		Expect(cacher.Reset(ctx)).To(MatchError(ContainSubstring("no object versions")))
+	})
+})
@@ -0,0 +1,184 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// hedgeDelay is the default delay before a hedged request is sent.
+	hedgeDelay = 50 * time.Millisecond
+	// hedgeSamples is the number of recent latencies from which the
+	// adaptive delay is computed.
+	hedgeSamples = 1000
+	// hedgeMinSamples is the number of latencies observed before the
+	// adaptive delay replaces the fixed one.
+	hedgeMinSamples = 20
+)
+
+// HedgeOptions configures hedged reads: when the response to a read is slow
+// to come, a second identical request is sent and the first response of the
+// two is used, while the other request is cancelled. This trades a few more
+// requests for a shorter tail latency.
+type HedgeOptions struct {
+	// Delay is the time after which the hedged request is sent. Defaults to
+	// 50 milliseconds.
+	Delay time.Duration
+	// Percentile, between 0 and 1, makes the delay adaptive: the hedged
+	// request is sent once the read has taken longer than this percentile
+	// of the latency of recent reads (e.g. 0.95 hedges about 5% of the
+	// reads). Delay is used until enough reads have been observed.
+	Percentile float64
+}
+
+// hedgeLatencies records the latency of recent reads.
+type hedgeLatencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// observe records the latency of a read.
+func (x *hedgeLatencies) observe(latency time.Duration) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.samples) < hedgeSamples {
+		x.samples = append(x.samples, latency)
+		return
+	}
+	x.samples[x.next] = latency
+	x.next = (x.next + 1) % hedgeSamples
+}
+
+// percentile returns the given percentile of the recorded latencies, or false
+// when too few latencies have been recorded.
+func (x *hedgeLatencies) percentile(p float64) (time.Duration, bool) {
+	x.mu.Lock()
+	samples := slices.Clone(x.samples)
+	x.mu.Unlock()
+
+	if len(samples) < hedgeMinSamples {
+		return 0, false
+	}
+	slices.Sort(samples)
+	return samples[int(min(max(p, 0), 1)*float64(len(samples)-1))], true
+}
+
+// hedgeDelay returns the time after which a hedged read is sent.
+func (r *S3QueryCacher) hedgeDelay() time.Duration {
+	if r.Hedge.Percentile > 0 {
+		if delay, ok := r.latencies.percentile(r.Hedge.Percentile); ok {
+			return delay
+		}
+	}
+	return valueOrDefault(r.Hedge.Delay, hedgeDelay)
+}
+
+// hedgeResponse is the response to one of the requests of a hedged read.
+type hedgeResponse struct {
+	out    *s3.GetObjectOutput
+	err    error
+	cancel context.CancelFunc
+	hedged bool
+	// index is the position of the request in the order they were sent.
+	index int
+}
+
+// getObject reads an object, with a hedged request when Hedge is set. Once a
+// response is chosen the other request is cancelled, and the request whose
+// response is used is cancelled when its body is closed.
+func (r *S3QueryCacher) getObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if r.Hedge == nil {
+		return r.Client.GetObject(ctx, input)
+	}
+
+	responses := make(chan *hedgeResponse, 2)
+	var cancels []context.CancelFunc
+	send := func(hedged bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			// The requests do not share their input, which the client may
+			// modify.
+			in := *input
+			out, err := r.Client.GetObject(ctx, &in)
+
+			var kerr *s3types.NoSuchKey
+			if err == nil || errors.As(err, &kerr) {
+				r.latencies.observe(time.Since(start))
+			}
+			responses <- &hedgeResponse{out: out, err: err, cancel: cancel, hedged: hedged, index: index}
+		}()
+	}
+
+	send(false)
+	pending := 1
+
+	timer := time.NewTimer(r.hedgeDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			send(true)
+			pending++
+			recordStats(ctx, func(stats *cacheStats) { stats.hedged++ })
+			continue
+		case res := <-responses:
+			pending--
+
+			var kerr *s3types.NoSuchKey
+			if res.err != nil && !errors.As(res.err, &kerr) && pending > 0 {
+				// The other request may still succeed.
+				res.cancel()
+				continue
+			}
+
+			// Cancel the other request, and close its body once it returns.
+			for i, cancel := range cancels {
+				if i != res.index {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for range pending {
+					if other := <-responses; other.out != nil {
+						other.out.Body.Close()
+					}
+				}
+			}(pending)
+
+			if res.hedged && res.err == nil {
+				recordStats(ctx, func(stats *cacheStats) { stats.hedgeWins++ })
+			}
+			if res.err != nil {
+				res.cancel()
+				return nil, res.err
+			}
+			res.out.Body = &cancelReadCloser{ReadCloser: res.out.Body, cancel: res.cancel}
+			return res.out, nil
+		}
+	}
+}
+
+// cancelReadCloser cancels the context of a request when its body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the request.
+func (x *cancelReadCloser) Close() error {
+	defer x.cancel()
+	return x.ReadCloser.Close()
+}
@@ -0,0 +1,152 @@
+package pgxaws
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// stalledS3 is an S3 fake whose first GetObject blocks until its context is
+// done, which it reports by closing cancelled.
+type stalledS3 struct {
+	*pgxawstest.S3
+
+	calls     atomic.Int32
+	cancelled chan struct{}
+}
+
+func (x *stalledS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if x.calls.Add(1) == 1 {
+		<-ctx.Done()
+		close(x.cancelled)
+		return nil, ctx.Err()
+	}
+	return x.S3.GetObject(ctx, params, optFns...)
+}
+
+var _ = Describe("S3QueryCacher hedged reads", func() {
+	var (
+		ctx      context.Context
+		client   *pgxawstest.S3
+		cacher   *S3QueryCacher
+		key      *pgxcache.QueryKey
+		item     *pgxcache.QueryItem
+		events   []*CacheEvent
+		instance *InstrumentedQueryCacher
+	)
+
+	// delay sets the latency of the next reads, in order, and returns the
+	// number of reads. Later reads are not delayed.
+	delay := func(latencies ...time.Duration) *atomic.Int64 {
+		calls := &atomic.Int64{}
+		client.GetLatency = func() time.Duration {
+			if call := int(calls.Add(1)); call <= len(latencies) {
+				return latencies[call-1]
+			}
+			return 0
+		}
+		return calls
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		cacher = &S3QueryCacher{Client: client, Bucket: "queries", Hedge: &HedgeOptions{Delay: 20 * time.Millisecond}}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+
+		events = nil
+		instance = &InstrumentedQueryCacher{
+			Cacher: cacher,
+			Observer: CacheObserverFunc(func(_ context.Context, event *CacheEvent) {
+				events = append(events, event)
+			}),
+		}
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+	})
+
+	It("does not hedge fast reads", func() {
+		calls := delay()
+		Expect(instance.Get(ctx, key)).To(Equal(item))
+		Expect(calls.Load()).To(BeEquivalentTo(1))
+		Expect(events[0].Hedged).To(BeZero())
+	})
+
+	It("uses the hedged read when the first one is slow", func() {
+		calls := delay(time.Hour)
+
+		start := time.Now()
+		Expect(instance.Get(ctx, key)).To(Equal(item))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(calls.Load()).To(BeEquivalentTo(2))
+		Expect(events[0].Hedged).To(BeEquivalentTo(1))
+		Expect(events[0].HedgeWins).To(BeEquivalentTo(1))
+	})
+
+	It("cancels the slow read once the hedged one wins", func() {
+		stalled := &stalledS3{S3: client, cancelled: make(chan struct{})}
+		cacher.Client = stalled
+
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+		Eventually(stalled.cancelled).Should(BeClosed())
+	})
+
+	It("uses the first read when it answers before the hedged one", func() {
+		delay(50*time.Millisecond, time.Hour)
+
+		Expect(instance.Get(ctx, key)).To(Equal(item))
+		Expect(events[0].Hedged).To(BeEquivalentTo(1))
+		Expect(events[0].HedgeWins).To(BeZero())
+	})
+
+	It("hedges misses", func() {
+		delay(time.Hour)
+
+		Expect(instance.Get(ctx, &pgxcache.QueryKey{SQL: "SELECT 2"})).To(BeNil())
+		Expect(events[0].Result).To(Equal(CacheMiss))
+	})
+
+	It("adapts the delay to the latency of recent reads", func() {
+		// The percentile is only set once the samples are recorded, so that
+		// no hedged read of the warm-up is left running.
+		cacher.Hedge = &HedgeOptions{Delay: time.Hour}
+		for range hedgeMinSamples {
+			Expect(cacher.Get(ctx, key)).To(Equal(item))
+		}
+		cacher.Hedge.Percentile = 0.9
+		Expect(cacher.hedgeDelay()).To(BeNumerically("<", time.Hour))
+
+		delay(time.Hour)
+		Expect(instance.Get(ctx, key)).To(Equal(item))
+		Expect(events[0].HedgeWins).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("hedgeLatencies", func() {
+	It("computes percentiles over the recent latencies", func() {
+		latencies := &hedgeLatencies{}
+		for i := range hedgeMinSamples - 1 {
+			latencies.observe(time.Duration(i))
+		}
+		_, ok := latencies.percentile(0.5)
+		Expect(ok).To(BeFalse())
+
+		for i := range hedgeSamples {
+			latencies.observe(time.Duration(i + 1))
+		}
+		Expect(latencies.samples).To(HaveLen(hedgeSamples))
+		lowest, _ := latencies.percentile(0)
+		Expect(lowest).To(Equal(time.Duration(1)))
+		highest, ok := latencies.percentile(1)
+		Expect(ok).To(BeTrue())
+		Expect(highest).To(Equal(time.Duration(hedgeSamples)))
+	})
+})
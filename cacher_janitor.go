@@ -0,0 +1,338 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// janitorInterval is the default interval between two sweeps of Run.
+const janitorInterval = time.Hour
+
+// S3Janitor deletes the expired objects of an S3QueryCacher. Lifecycle rules
+// only expire objects after whole days and are not installed on directory
+// buckets, so expired objects that are never read again would otherwise stay
+// in the bucket.
+//
+// The janitor lists the objects under the cacher namespace, reads their
+// expiration time and deletes the expired ones in batches (see Sweep). It can
+// sweep once, e.g. from a scheduled job, or run in-process with Run. Lease
+// lock objects are deleted once they have expired, e.g. when their holder
+// crashed, unless they are taken over in the meantime. An entry that is
+// replaced between the time it is read and the time it is deleted is deleted
+// too, which only costs a cache miss.
+type S3Janitor struct {
+	// Cacher is the cacher whose objects are swept.
+	Cacher *S3QueryCacher
+	// Interval is the time between two sweeps of Run. Defaults to 1 hour.
+	Interval time.Duration
+	// Rate is the maximum number of objects deleted per second, so that
+	// sweeping a large bucket does not compete with the cache traffic. Zero
+	// means no limit.
+	Rate int
+	// Report, if set, is called after each sweep of Run with its result and
+	// error.
+	Report func(*SweepResult, error)
+}
+
+// SweepResult reports the outcome of a sweep.
+type SweepResult struct {
+	// Scanned is the number of entries and lease lock objects whose
+	// expiration time was read.
+	Scanned int64
+	// Deleted is the number of expired entries and lease lock objects
+	// deleted.
+	Deleted int64
+}
+
+// Sweep deletes the expired objects under the cacher namespace once. It
+// returns the result of the sweep so far along with the first error.
+//
+// With an ExpiryDay key layout, the objects of past days are deleted without
+// reading their metadata, and those of later days are left alone.
+func (x *S3Janitor) Sweep(ctx context.Context) (*SweepResult, error) {
+	sweep := &janitorSweep{
+		cacher: x.Cacher,
+		result: &SweepResult{},
+		pacer:  &deletePacer{rate: x.Rate, start: time.Now()},
+		size:   1000,
+	}
+	if x.Rate > 0 {
+		sweep.size = min(sweep.size, x.Rate)
+	}
+
+	var err error
+	if layout := x.Cacher.Layout; layout != nil && layout.ExpiryDay {
+		err = sweep.days(ctx, time.Now())
+	} else {
+		err = sweep.entries(ctx, namespacePrefix(x.Cacher.Namespace))
+	}
+	if err == nil {
+		err = sweep.flush(ctx)
+	}
+	return sweep.result, err
+}
+
+// Run sweeps the expired objects right away and then every Interval, until
+// ctx is done. Sweep errors are passed to Report and do not stop Run, which
+// returns the error of ctx.
+func (x *S3Janitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(valueOrDefault(x.Interval, janitorInterval))
+	defer ticker.Stop()
+
+	for {
+		result, err := x.Sweep(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if x.Report != nil {
+			x.Report(result, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// janitorSweep is a sweep in progress.
+type janitorSweep struct {
+	cacher *S3QueryCacher
+	result *SweepResult
+	pacer  *deletePacer
+	// size is the number of objects deleted by a batch.
+	size  int
+	batch []s3types.ObjectIdentifier
+}
+
+// days sweeps a namespace whose keys start with their expiry day. Other keys
+// are swept by reading their metadata.
+func (x *janitorSweep) days(ctx context.Context, now time.Time) error {
+	prefix := namespacePrefix(x.cacher.Namespace)
+	today := now.UTC().Format(layoutDayFormat)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:              aws.String(x.cacher.Bucket),
+		Delimiter:           aws.String("/"),
+		ExpectedBucketOwner: x.cacher.bucketOwner(),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(x.cacher.Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := x.page(ctx, page.Contents); err != nil {
+			return err
+		}
+
+		for _, common := range page.CommonPrefixes {
+			dir := aws.ToString(common.Prefix)
+			day := strings.TrimSuffix(strings.TrimPrefix(dir, prefix), "/")
+			if _, perr := time.Parse(layoutDayFormat, day); perr != nil {
+				err = x.entries(ctx, dir)
+			} else if day < today {
+				err = x.objects(ctx, dir)
+			} else if day == today {
+				err = x.entries(ctx, dir)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// entries deletes the expired entries and lease lock objects stored under the
+// prefix.
+func (x *janitorSweep) entries(ctx context.Context, prefix string) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:              aws.String(x.cacher.Bucket),
+		ExpectedBucketOwner: x.cacher.bucketOwner(),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(x.cacher.Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if err := x.page(ctx, page.Contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// page deletes the expired entries and lease lock objects of a page of
+// objects.
+func (x *janitorSweep) page(ctx context.Context, objects []s3types.Object) error {
+	entries, err := x.cacher.headObjects(ctx, objects)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := x.entry(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	for _, obj := range objects {
+		if key := aws.ToString(obj.Key); strings.HasSuffix(key, leaseSuffix) {
+			if err := x.lease(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// entry deletes the entry if it has expired. Nil entries are ignored.
+func (x *janitorSweep) entry(ctx context.Context, entry *QueryEntry) error {
+	if entry == nil {
+		return nil
+	}
+
+	x.result.Scanned++
+	if entry.ExpireAt.IsZero() || !entry.Expired() {
+		return nil
+	}
+	return x.delete(ctx, entry.Key)
+}
+
+// lease deletes the lease lock object if it has expired. The object is
+// deleted on its own with a conditional request, so that a lease taken over
+// since it was read is kept.
+func (x *janitorSweep) lease(ctx context.Context, key string) error {
+	head, err := x.cacher.headObject(ctx, key)
+	var nerr *s3types.NotFound
+	switch {
+	case errors.As(err, &nerr):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	x.result.Scanned++
+	expireAt, err := time.Parse(time.RFC3339, head.Metadata[metaKeyExpiresAt])
+	if err != nil || time.Now().Before(expireAt) {
+		return nil
+	}
+
+	if err := x.pacer.wait(ctx, 1); err != nil {
+		return err
+	}
+	_, err = x.cacher.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:              aws.String(x.cacher.Bucket),
+		Key:                 aws.String(key),
+		IfMatch:             head.ETag,
+		ExpectedBucketOwner: x.cacher.bucketOwner(),
+	})
+	switch {
+	case isConditionFailed(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	x.result.Deleted++
+	return nil
+}
+
+// objects deletes every object stored under the prefix.
+func (x *janitorSweep) objects(ctx context.Context, prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(x.cacher.Client, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(x.cacher.Bucket),
+		Prefix:              aws.String(prefix),
+		ExpectedBucketOwner: x.cacher.bucketOwner(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err := x.delete(ctx, aws.ToString(obj.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delete adds the object to the current batch, which is deleted once full.
+func (x *janitorSweep) delete(ctx context.Context, key string) error {
+	x.batch = append(x.batch, s3types.ObjectIdentifier{Key: aws.String(key)})
+	if len(x.batch) < x.size {
+		return nil
+	}
+	return x.flush(ctx)
+}
+
+// flush deletes the current batch.
+func (x *janitorSweep) flush(ctx context.Context) error {
+	if len(x.batch) == 0 {
+		return nil
+	}
+	if err := x.pacer.wait(ctx, len(x.batch)); err != nil {
+		return err
+	}
+	if err := x.cacher.deleteBatch(ctx, x.batch); err != nil {
+		return err
+	}
+	x.result.Deleted += int64(len(x.batch))
+	x.batch = x.batch[:0]
+	return nil
+}
+
+// deletePacer spaces out deletes so that they do not exceed a rate.
+type deletePacer struct {
+	// rate is the maximum number of deletes per second, or zero.
+	rate int
+	// start is the time the first delete was issued.
+	start time.Time
+	// count is the number of deletes issued so far.
+	count int
+}
+
+// wait blocks until n more deletes can be issued without exceeding the rate.
+func (x *deletePacer) wait(ctx context.Context, n int) error {
+	if x.rate <= 0 {
+		return nil
+	}
+
+	// The deletes issued so far are spread over count/rate seconds.
+	due := x.start.Add(time.Duration(x.count) * time.Second / time.Duration(x.rate))
+	x.count += n
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
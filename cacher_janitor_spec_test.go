@@ -0,0 +1,117 @@
+package pgxaws
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("S3Janitor", func() {
+	var (
+		ctx     context.Context
+		client  *pgxawstest.S3
+		cacher  *S3QueryCacher
+		janitor *S3Janitor
+		item    *pgxcache.QueryItem
+	)
+
+	set := func(cacher *S3QueryCacher, sql string, ttl time.Duration) {
+		Expect(cacher.Set(ctx, &pgxcache.QueryKey{SQL: sql}, item, ttl)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		cacher = &S3QueryCacher{Client: client, Bucket: "queries", Namespace: "billing"}
+		janitor = &S3Janitor{Cacher: cacher}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("deletes expired objects under the namespace only", func() {
+		client.PageSize = 4
+		for i := range 5 {
+			set(cacher, fmt.Sprintf("SELECT %d", i), -time.Minute)
+			set(cacher, fmt.Sprintf("SELECT %d + 1", i), time.Minute)
+		}
+		other := &S3QueryCacher{Client: client, Bucket: "queries", Namespace: "other"}
+		set(other, "SELECT 1", -time.Minute)
+
+		_, err := cacher.AcquireLease(ctx, &pgxcache.QueryKey{SQL: "SELECT 1"}, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := janitor.Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&SweepResult{Scanned: 11, Deleted: 5}))
+		Expect(client.Keys("queries")).To(HaveLen(7))
+
+		count := 0
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entry.Expired()).To(BeFalse())
+			count++
+		}
+		Expect(count).To(Equal(5))
+	})
+
+	It("deletes expired lease lock objects", func() {
+		expired := &pgxcache.QueryKey{SQL: "SELECT 1"}
+		_, err := cacher.AcquireLease(ctx, expired, -time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		held := &pgxcache.QueryKey{SQL: "SELECT 2"}
+		_, err = cacher.AcquireLease(ctx, held, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := janitor.Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&SweepResult{Scanned: 2, Deleted: 1}))
+		Expect(client.Keys("queries")).To(ConsistOf("billing/" + held.String() + leaseSuffix))
+	})
+
+	It("limits the rate of deletes", func() {
+		for i := range 15 {
+			set(cacher, fmt.Sprintf("SELECT %d", i), -time.Minute)
+		}
+
+		janitor.Rate = 10
+		start := time.Now()
+		result, err := janitor.Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Deleted).To(BeEquivalentTo(15))
+		Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+	})
+
+	It("sweeps periodically until the context is done", func() {
+		set(cacher, "SELECT 1", -time.Minute)
+
+		var (
+			mu      sync.Mutex
+			results []*SweepResult
+		)
+		ctx, cancel := context.WithCancel(ctx)
+		janitor.Interval = 10 * time.Millisecond
+		janitor.Report = func(result *SweepResult, err error) {
+			Expect(err).NotTo(HaveOccurred())
+
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, result)
+			if len(results) == 3 {
+				cancel()
+			}
+		}
+
+		Expect(janitor.Run(ctx)).To(MatchError(context.Canceled))
+		Expect(results).To(HaveLen(3))
+		Expect(results[0].Deleted).To(BeEquivalentTo(1))
+		Expect(results[2].Deleted).To(BeZero())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+})
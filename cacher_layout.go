@@ -0,0 +1,139 @@
+package pgxaws
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// layoutDayFormat is the format of the expiry day prefix of object keys.
+const layoutDayFormat = time.DateOnly
+
+// layoutMaxLifetime is the default maximum lifetime of the entries of a layout
+// with an expiry day prefix.
+const layoutMaxLifetime = 24 * time.Hour
+
+// S3KeyLayout describes how S3QueryCacher lays out object keys under its
+// escaped namespace:
+//
+//	<namespace>/<expiry day>/<shard>/<query key>
+//
+// Changing the layout of a cacher makes its existing entries unreachable;
+// they are removed by Reset, the lifecycle rule or an S3Janitor.
+type S3KeyLayout struct {
+	// Shards spreads the objects over this many prefixes, named after the
+	// hash of the query key in hexadecimal (e.g. "0f/" with 256 shards). S3
+	// scales request rates per prefix, so sharding lets hot caches go past
+	// the limits of a single prefix. Zero or one disables sharding.
+	Shards int
+	// ExpiryDay prefixes the keys with the UTC day on which the entries
+	// expire (e.g. "2026-10-19/"), so that the entries of past days can be
+	// deleted wholesale by an S3Janitor without reading their metadata.
+	//
+	// As the expiry day of an entry is not known when it is read, Get looks
+	// the entry up in every day from today to the day MaxLifetime from now,
+	// latest first: a miss costs one request per day. Set deletes the copies
+	// of the entry stored under the other days with one more request, so that
+	// an entry stored with a shorter lifetime than the previous one is not
+	// hidden behind it.
+	ExpiryDay bool
+	// MaxLifetime is the maximum lifetime of the entries stored with an
+	// ExpiryDay layout, including any stale lifetime. Storing an entry that
+	// expires later fails. Defaults to 24 hours.
+	MaxLifetime time.Duration
+}
+
+// shard returns the shard prefix of the query key, or an empty string when
+// the layout is not sharded.
+func (x *S3KeyLayout) shard(id string) string {
+	if x == nil || x.Shards <= 1 {
+		return ""
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	// Every shard name has the width of the largest one.
+	width := len(fmt.Sprintf("%x", x.Shards-1))
+	return fmt.Sprintf("%0*x/", width, h.Sum32()%uint32(x.Shards))
+}
+
+// days returns the expiry day prefixes in which an entry stored at now may
+// be found, latest first, or a single empty prefix when the layout has no
+// expiry day.
+func (x *S3KeyLayout) days(now time.Time) []string {
+	if x == nil || !x.ExpiryDay {
+		return []string{""}
+	}
+
+	first := now.UTC().Truncate(24 * time.Hour)
+	last := now.UTC().Add(x.maxLifetime()).Truncate(24 * time.Hour)
+
+	var days []string
+	for day := last; !day.Before(first); day = day.Add(-24 * time.Hour) {
+		days = append(days, day.Format(layoutDayFormat)+"/")
+	}
+	return days
+}
+
+// day returns the expiry day prefix of an entry that expires at expireAt.
+func (x *S3KeyLayout) day(expireAt time.Time) string {
+	if x == nil || !x.ExpiryDay {
+		return ""
+	}
+	return expireAt.UTC().Format(layoutDayFormat) + "/"
+}
+
+// maxLifetime returns the maximum lifetime of the entries.
+func (x *S3KeyLayout) maxLifetime() time.Duration {
+	return valueOrDefault(x.MaxLifetime, layoutMaxLifetime)
+}
+
+// check reports an error when an entry that expires at expireAt cannot be
+// found by Get.
+func (x *S3KeyLayout) check(expireAt time.Time) error {
+	if x == nil || !x.ExpiryDay {
+		return nil
+	}
+	if limit := time.Now().Add(x.maxLifetime()); expireAt.After(limit) {
+		return fmt.Errorf("pgxaws: entry expires %s after the maximum lifetime of the key layout", expireAt.Sub(limit).Round(time.Second))
+	}
+	return nil
+}
+
+// objectKey returns the storage key of the entry with the given key within
+// the namespace, which expires at expireAt.
+func (r *S3QueryCacher) objectKey(id string, expireAt time.Time) string {
+	return namespacePrefix(r.Namespace) + r.Layout.day(expireAt) + r.Layout.shard(id) + id
+}
+
+// objectKeys returns the storage keys at which the entry with the given key
+// within the namespace may be stored, in lookup order.
+func (r *S3QueryCacher) objectKeys(id string) []string {
+	prefix := namespacePrefix(r.Namespace)
+	shard := r.Layout.shard(id)
+
+	days := r.Layout.days(time.Now())
+	keys := make([]string, len(days))
+	for i, day := range days {
+		keys[i] = prefix + day + shard + id
+	}
+	return keys
+}
+
+// leaseKey returns the storage key of the lease lock object of the entry with
+// the given key within the namespace. Lock objects have no expiry day, so
+// that every caller agrees on their key.
+func (r *S3QueryCacher) leaseKey(id string) string {
+	return namespacePrefix(r.Namespace) + r.Layout.shard(id) + id + leaseSuffix
+}
+
+// entryKey returns the key within the namespace of the entry stored at the
+// given storage key.
+func (r *S3QueryCacher) entryKey(key string) string {
+	key = strings.TrimPrefix(key, namespacePrefix(r.Namespace))
+	if r.Layout == nil {
+		return key
+	}
+	return key[strings.LastIndex(key, "/")+1:]
+}
@@ -0,0 +1,141 @@
+package pgxaws
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("S3KeyLayout", func() {
+	It("names shards after the hash of the key", func() {
+		var layout *S3KeyLayout
+		Expect(layout.shard("q1")).To(BeEmpty())
+		Expect((&S3KeyLayout{Shards: 1}).shard("q1")).To(BeEmpty())
+		Expect((&S3KeyLayout{Shards: 16}).shard("q1")).To(MatchRegexp(`^[0-9a-f]/$`))
+		Expect((&S3KeyLayout{Shards: 256}).shard("q1")).To(MatchRegexp(`^[0-9a-f]{2}/$`))
+		Expect((&S3KeyLayout{Shards: 1000}).shard("q1")).To(MatchRegexp(`^[0-9a-f]{3}/$`))
+	})
+
+	It("looks up every day up to the maximum lifetime, latest first", func() {
+		now := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+		Expect((&S3KeyLayout{}).days(now)).To(Equal([]string{""}))
+		Expect((&S3KeyLayout{ExpiryDay: true}).days(now)).To(Equal([]string{"2026-10-20/", "2026-10-19/"}))
+		Expect((&S3KeyLayout{ExpiryDay: true, MaxLifetime: time.Hour}).days(now)).To(Equal([]string{"2026-10-19/"}))
+		Expect((&S3KeyLayout{ExpiryDay: true, MaxLifetime: 36 * time.Hour}).days(now)).To(HaveLen(3))
+	})
+})
+
+var _ = Describe("S3QueryCacher with a key layout", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.S3
+		cacher *S3QueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		cacher = &S3QueryCacher{
+			Client:    client,
+			Bucket:    "queries",
+			Namespace: "billing",
+			Layout:    &S3KeyLayout{Shards: 16, ExpiryDay: true},
+		}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("stores entries under their expiry day and shard", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		day := time.Now().UTC().Add(time.Minute).Format(time.DateOnly)
+		Expect(client.Keys("queries")).To(ConsistOf(MatchRegexp(`^billing/` + day + `/[0-9a-f]/` + key.String() + `$`)))
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entry.Key).To(Equal(key.String()))
+		}
+
+		Expect(cacher.Delete(ctx, key)).To(Succeed())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+
+	It("serves the entry that expires last", func() {
+		Expect(cacher.Set(ctx, key, &pgxcache.QueryItem{CommandTag: "SELECT 0"}, time.Minute)).To(Succeed())
+		Expect(cacher.Set(ctx, key, item, 23*time.Hour)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("serves the last entry stored after a longer one", func() {
+		cacher.Layout.MaxLifetime = 48 * time.Hour
+		Expect(cacher.Set(ctx, key, &pgxcache.QueryItem{CommandTag: "SELECT 0"}, 30*time.Hour)).To(Succeed())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(client.Keys("queries")).To(HaveLen(1))
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("rejects entries that outlive the layout", func() {
+		Expect(cacher.Set(ctx, key, item, 48*time.Hour)).To(MatchError(ContainSubstring("maximum lifetime")))
+	})
+
+	It("keeps lease lock objects out of the expiry days", func() {
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+		Expect(client.Keys("queries")).To(ConsistOf(MatchRegexp(`^billing/[0-9a-f]/` + key.String() + leaseSuffix + `$`)))
+
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+
+	It("is swept by day", func() {
+		stale := "billing/2020-01-01/0/" + key.String()
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("queries"), Key: aws.String(stale), Body: strings.NewReader("")})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cacher.Set(ctx, &pgxcache.QueryKey{SQL: "SELECT 2"}, item, -time.Minute)).To(Succeed())
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		_, err = cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := (&S3Janitor{Cacher: cacher}).Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Deleted).To(BeEquivalentTo(2))
+		Expect(client.Keys("queries")).To(HaveLen(2))
+		Expect(client.Keys("queries")).NotTo(ContainElement(stale))
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("is reset entirely", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		_, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+})
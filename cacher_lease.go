@@ -0,0 +1,339 @@
+package pgxaws
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// leaseSuffix is appended to the storage key of an entry to build the key of
+// its lease.
+const leaseSuffix = ".lease"
+
+// metaKeyLeaseToken is the S3 user-defined metadata key that stores the token
+// of the lease holder.
+const metaKeyLeaseToken = "lease-token"
+
+// QueryLeaser is implemented by cachers that hand out short-lived, exclusive
+// leases on keys, so that only one caller repopulates a missing entry.
+type QueryLeaser interface {
+	// AcquireLease tries to take the lease on the key for the given duration.
+	// It returns a token identifying the holder, or an empty string when
+	// another caller holds an unexpired lease.
+	AcquireLease(ctx context.Context, key *pgxcache.QueryKey, lifetime time.Duration) (string, error)
+	// ReleaseLease gives up the lease identified by the token. It does nothing
+	// when the lease has expired and has been taken over by another caller.
+	ReleaseLease(ctx context.Context, key *pgxcache.QueryKey, token string) error
+}
+
+// QueryLeaseCacher is a QueryEntryCacher that also hands out leases.
+type QueryLeaseCacher interface {
+	QueryEntryCacher
+	QueryLeaser
+}
+
+var _ QueryLeaseCacher = &DynamoQueryCacher{}
+
+// AcquireLease takes the lease on the key by writing a lock item with a
+// conditional put. An expired lock item is taken over.
+func (r *DynamoQueryCacher) AcquireLease(ctx context.Context, key *pgxcache.QueryKey, lifetime time.Duration) (string, error) {
+	now := time.Now().UTC()
+	token := rand.Text()
+
+	schema := r.schema()
+	item := r.primaryKey(schema, key.String()+leaseSuffix)
+	item[schema.Lease] = &dynamodbtypes.AttributeValueMemberS{Value: token}
+	item[schema.TTL] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(lifetime).Unix(), 10)}
+
+	_, err := r.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(r.Table),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#pk) OR #exp < :now"),
+		ExpressionAttributeNames: map[string]string{"#pk": schema.PartitionKey, "#exp": schema.TTL},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":now": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+
+	var cerr *dynamodbtypes.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &cerr):
+		return "", nil
+	case err != nil:
+		return "", err
+	default:
+		return token, nil
+	}
+}
+
+// ReleaseLease deletes the lock item if it is still owned by the token.
+func (r *DynamoQueryCacher) ReleaseLease(ctx context.Context, key *pgxcache.QueryKey, token string) error {
+	schema := r.schema()
+	_, err := r.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(r.Table),
+		Key:                      r.primaryKey(schema, key.String()+leaseSuffix),
+		ConditionExpression:      aws.String("#lease = :token"),
+		ExpressionAttributeNames: map[string]string{"#lease": schema.Lease},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":token": &dynamodbtypes.AttributeValueMemberS{Value: token},
+		},
+	})
+
+	var cerr *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &cerr) {
+		return nil
+	}
+	return err
+}
+
+var _ QueryLeaseCacher = &S3QueryCacher{}
+
+// AcquireLease takes the lease on the key by creating a lock object with an
+// If-None-Match conditional write. An expired lock object is taken over with
+// an If-Match conditional write, so that only one caller wins.
+func (r *S3QueryCacher) AcquireLease(ctx context.Context, key *pgxcache.QueryKey, lifetime time.Duration) (string, error) {
+	id := r.leaseKey(key.String())
+	token := rand.Text()
+
+	metadata := map[string]string{
+		metaKeyExpiresAt:  time.Now().UTC().Add(lifetime).Format(time.RFC3339),
+		metaKeyLeaseToken: token,
+	}
+	input := r.putObjectInput(id, metadata, nil)
+	input.IfNoneMatch = aws.String("*")
+
+	_, err := r.Client.PutObject(ctx, input)
+	switch {
+	case err == nil:
+		return token, nil
+	case !isConditionFailed(err):
+		return "", err
+	}
+
+	// The lock object exists; take it over if it has expired.
+	head, err := r.headObject(ctx, id)
+	var nerr *s3types.NotFound
+	switch {
+	case errors.As(err, &nerr):
+		// Released in the meantime; let the caller retry later.
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	expireAt, err := time.Parse(time.RFC3339, head.Metadata[metaKeyExpiresAt])
+	if err == nil && time.Now().Before(expireAt) {
+		return "", nil
+	}
+
+	input = r.putObjectInput(id, metadata, nil)
+	input.IfMatch = head.ETag
+	_, err = r.Client.PutObject(ctx, input)
+	switch {
+	case err == nil:
+		return token, nil
+	case isConditionFailed(err):
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// ReleaseLease deletes the lock object if it is still owned by the token.
+func (r *S3QueryCacher) ReleaseLease(ctx context.Context, key *pgxcache.QueryKey, token string) error {
+	id := r.leaseKey(key.String())
+
+	head, err := r.headObject(ctx, id)
+	var nerr *s3types.NotFound
+	switch {
+	case errors.As(err, &nerr):
+		return nil
+	case err != nil:
+		return err
+	case head.Metadata[metaKeyLeaseToken] != token:
+		return nil
+	}
+
+	// The lock object may have been taken over since it was read.
+	_, err = r.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(id),
+		IfMatch:             head.ETag,
+		ExpectedBucketOwner: r.bucketOwner(),
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// isConditionFailed reports whether an S3 conditional request was rejected
+// because its precondition did not hold or a concurrent conditional request
+// won.
+func isConditionFailed(err error) bool {
+	var aerr smithy.APIError
+	if !errors.As(err, &aerr) {
+		return false
+	}
+
+	switch aerr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	// leaseDuration is the default maximum time a lease is held.
+	leaseDuration = 30 * time.Second
+	// leaseWaitTimeout is the default time to wait for a lease holder.
+	leaseWaitTimeout = time.Second
+	// leasePollInterval is the default interval between two polls.
+	leasePollInterval = 100 * time.Millisecond
+)
+
+var _ pgxcache.QueryCacher = &SingleFlightQueryCacher{}
+
+// SingleFlightQueryCacher implements pgxcache.QueryCacher interface on top of
+// a QueryLeaseCacher, such as DynamoQueryCacher or S3QueryCacher, so that only
+// one caller across all processes repopulates a missing or expired entry.
+//
+// On a miss, Get takes the lease on the key and reports the miss; the caller
+// runs the query and the lease is released by the following Set. Callers that
+// do not get the lease are served the expired entry when it is recent enough,
+// or wait for the lease holder to populate the key. When the lease holder
+// fails to call Set, e.g. because the query failed or pgxcache does not store
+// its result, the lease expires after LeaseDuration and is forgotten.
+type SingleFlightQueryCacher struct {
+	// Cacher stores the entries and hands out the leases.
+	Cacher QueryLeaseCacher
+	// LeaseDuration is the maximum time a caller may take to repopulate a
+	// key. Defaults to 30 seconds.
+	LeaseDuration time.Duration
+	// WaitTimeout is how long a caller waits for the lease holder before it
+	// gives up and reports a miss. Defaults to 1 second.
+	WaitTimeout time.Duration
+	// PollInterval is the interval at which a waiting caller polls Cacher.
+	// Defaults to 100 milliseconds.
+	PollInterval time.Duration
+	// MaxStale is how long after expiry an entry may still be served while
+	// another caller repopulates it. Zero disables serving stale entries.
+	MaxStale time.Duration
+
+	leases sync.Map
+}
+
+// heldLease is a lease held by this process.
+type heldLease struct {
+	token    string
+	expireAt time.Time
+}
+
+// Get retrieves a cache item from Cacher. On a miss it either takes the lease
+// on the key, serves a stale entry or waits for the lease holder.
+func (r *SingleFlightQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	entry, err := r.Cacher.GetEntry(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && !entry.Expired() {
+		return entry.Item, nil
+	}
+
+	lifetime := valueOrDefault(r.LeaseDuration, leaseDuration)
+	token, err := r.Cacher.AcquireLease(ctx, key, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		// The caller repopulates the key; Set releases the lease.
+		r.forgetExpired()
+		r.leases.Store(key.String(), &heldLease{token: token, expireAt: time.Now().Add(lifetime)})
+		return nil, nil
+	}
+
+	if entry != nil && time.Since(entry.ExpireAt) <= r.MaxStale {
+		return entry.Item, nil
+	}
+
+	return r.wait(ctx, key)
+}
+
+// wait polls Cacher until the lease holder has populated the key or the wait
+// timeout elapses.
+func (r *SingleFlightQueryCacher) wait(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	timeout := time.NewTimer(valueOrDefault(r.WaitTimeout, leaseWaitTimeout))
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(valueOrDefault(r.PollInterval, leasePollInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			entry, err := r.Cacher.GetEntry(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil && !entry.Expired() {
+				return entry.Item, nil
+			}
+		case <-timeout.C:
+			// Give up and let the caller run the query itself.
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Set stores a cache item in Cacher and releases the lease on the key when
+// this process holds it.
+func (r *SingleFlightQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	err := r.Cacher.Set(ctx, key, item, lifetime)
+
+	if lease, ok := r.leases.LoadAndDelete(key.String()); ok {
+		if rerr := r.Cacher.ReleaseLease(ctx, key, lease.(*heldLease).token); err == nil {
+			err = rerr
+		}
+	}
+
+	return err
+}
+
+// forgetExpired drops the leases whose Set never came. They have expired in
+// Cacher too, and may have been taken over by another caller.
+func (r *SingleFlightQueryCacher) forgetExpired() {
+	now := time.Now()
+	r.leases.Range(func(key, value any) bool {
+		if now.After(value.(*heldLease).expireAt) {
+			r.leases.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
+// Reset resets Cacher.
+func (r *SingleFlightQueryCacher) Reset(ctx context.Context) error {
+	return r.Cacher.Reset(ctx)
+}
+
+// valueOrDefault returns value when it is positive, or fallback otherwise.
+func valueOrDefault(value, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
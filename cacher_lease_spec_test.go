@@ -0,0 +1,241 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// leaseCacher is an in-memory QueryLeaseCacher.
+type leaseCacher struct {
+	*entryCacher
+
+	mu       sync.Mutex
+	leases   map[string]string
+	acquired int
+	released int
+}
+
+func newLeaseCacher() *leaseCacher {
+	return &leaseCacher{entryCacher: newEntryCacher(), leases: map[string]string{}}
+}
+
+func (x *leaseCacher) AcquireLease(_ context.Context, key *pgxcache.QueryKey, _ time.Duration) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, ok := x.leases[key.String()]; ok {
+		return "", nil
+	}
+
+	x.acquired++
+	token := fmt.Sprintf("token-%d", x.acquired)
+	x.leases[key.String()] = token
+	return token, nil
+}
+
+func (x *leaseCacher) ReleaseLease(_ context.Context, key *pgxcache.QueryKey, token string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.leases[key.String()] == token {
+		x.released++
+		delete(x.leases, key.String())
+	}
+	return nil
+}
+
+var _ = Describe("SingleFlightQueryCacher", func() {
+	var (
+		ctx     context.Context
+		backend *leaseCacher
+		cacher  *SingleFlightQueryCacher
+		key     *pgxcache.QueryKey
+		item    *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = newLeaseCacher()
+		cacher = &SingleFlightQueryCacher{
+			Cacher:       backend,
+			WaitTimeout:  200 * time.Millisecond,
+			PollInterval: 10 * time.Millisecond,
+		}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+	})
+
+	It("serves fresh entries without taking the lease", func() {
+		Expect(backend.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+		Expect(backend.acquired).To(Equal(0))
+	})
+
+	It("takes the lease on a miss and releases it on Set", func() {
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+		Expect(backend.leases).To(HaveKey(key.String()))
+
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(backend.leases).To(BeEmpty())
+		Expect(backend.released).To(Equal(1))
+	})
+
+	It("forgets the leases whose Set never came once they expire", func() {
+		cacher.LeaseDuration = 10 * time.Millisecond
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+		time.Sleep(20 * time.Millisecond)
+
+		other := &pgxcache.QueryKey{SQL: "SELECT 2"}
+		Expect(cacher.Get(ctx, other)).To(BeNil())
+
+		var held []any
+		cacher.leases.Range(func(key, _ any) bool {
+			held = append(held, key)
+			return true
+		})
+		Expect(held).To(Equal([]any{other.String()}))
+	})
+
+	It("waits for the lease holder to populate the key", func() {
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(50 * time.Millisecond)
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		}()
+
+		other := &SingleFlightQueryCacher{Cacher: backend, WaitTimeout: time.Second, PollInterval: 10 * time.Millisecond}
+		got, err := other.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("reports a miss when the lease holder does not populate the key in time", func() {
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		start := time.Now()
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+		Expect(time.Since(start)).To(BeNumerically(">=", cacher.WaitTimeout))
+	})
+
+	It("serves a recently expired entry while another caller holds the lease", func() {
+		cacher.MaxStale = time.Minute
+		backend.entries[key.String()] = &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Second)}
+
+		// The first caller takes the lease and repopulates the key.
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+
+		got, err = cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("does not serve entries that expired longer ago than MaxStale", func() {
+		cacher.MaxStale = time.Second
+		backend.entries[key.String()] = &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Minute)}
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("returns backend errors", func() {
+		backend.err = errors.New("unavailable")
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).To(MatchError("unavailable"))
+	})
+})
+
+var _ = Describe("isConditionFailed", func() {
+	It("detects failed preconditions and conflicting conditional requests", func() {
+		Expect(isConditionFailed(&smithy.GenericAPIError{Code: "PreconditionFailed"})).To(BeTrue())
+		Expect(isConditionFailed(&smithy.GenericAPIError{Code: "ConditionalRequestConflict"})).To(BeTrue())
+	})
+
+	It("ignores other errors", func() {
+		Expect(isConditionFailed(nil)).To(BeFalse())
+		Expect(isConditionFailed(errors.New("boom"))).To(BeFalse())
+		Expect(isConditionFailed(&smithy.GenericAPIError{Code: "AccessDenied"})).To(BeFalse())
+	})
+})
+
+var _ = Describe("Leases", func() {
+	It("are exclusive on DynamoDB until released", func() {
+		table := os.Getenv("PGXAWS_DYNAMODB_TABLE")
+		if table == "" {
+			Skip("PGXAWS_DYNAMODB_TABLE not set")
+		}
+
+		ctx := context.Background()
+		cacher, err := NewDynamoQueryCacher(ctx, table)
+		Expect(err).NotTo(HaveOccurred())
+		key := &pgxcache.QueryKey{SQL: "SELECT 'lease'"}
+
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+
+		other, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeEmpty())
+
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+
+		token, err = cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+	})
+
+	It("are exclusive on S3 until released", func() {
+		bucket := os.Getenv("PGXAWS_S3_BUCKET")
+		if bucket == "" {
+			Skip("PGXAWS_S3_BUCKET not set")
+		}
+
+		ctx := context.Background()
+		cacher, err := NewS3QueryCacher(ctx, bucket)
+		Expect(err).NotTo(HaveOccurred())
+		key := &pgxcache.QueryKey{SQL: "SELECT 'lease'"}
+
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+
+		other, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeEmpty())
+
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+
+		token, err = cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+	})
+})
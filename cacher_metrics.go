@@ -0,0 +1,310 @@
+package pgxaws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pgx-contrib/pgxcache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// CacheOperation identifies a pgxcache.QueryCacher method.
+type CacheOperation string
+
+const (
+	// CacheGet is a call to Get.
+	CacheGet CacheOperation = "get"
+	// CacheSet is a call to Set.
+	CacheSet CacheOperation = "set"
+	// CacheReset is a call to Reset.
+	CacheReset CacheOperation = "reset"
+)
+
+// CacheResult is the outcome of a cache operation.
+type CacheResult string
+
+const (
+	// CacheHit is a Get that returned an item.
+	CacheHit CacheResult = "hit"
+	// CacheMiss is a Get that found no item.
+	CacheMiss CacheResult = "miss"
+	// CacheExpired is a Get that found an item past its expiry, which was
+	// reported as missing.
+	CacheExpired CacheResult = "expired"
+	// CacheCorrupt is a Get that found an item whose checksum did not match,
+	// which was deleted and reported as missing.
+	CacheCorrupt CacheResult = "corrupt"
+	// CacheOK is a Set or Reset that succeeded.
+	CacheOK CacheResult = "ok"
+	// CacheError is an operation that failed.
+	CacheError CacheResult = "error"
+)
+
+// CacheEvent describes a single cache operation.
+type CacheEvent struct {
+	// Name is the name of the instrumented cacher.
+	Name string
+	// Operation is the method that was called.
+	Operation CacheOperation
+	// Result is the outcome of the operation.
+	Result CacheResult
+	// Err is the error returned by the operation, if any.
+	Err error
+	// Duration is how long the operation took.
+	Duration time.Duration
+	// BytesRead is the size of the payload read from the backend.
+	BytesRead int64
+	// BytesWritten is the size of the payload written to the backend.
+	BytesWritten int64
+	// ConsumedCapacity is the number of DynamoDB capacity units consumed by
+	// the operation.
+	ConsumedCapacity float64
+	// Hedged is the number of hedged S3 reads sent by the operation.
+	Hedged int64
+	// HedgeWins is the number of hedged S3 reads whose response was used,
+	// because it came before the response to the first read.
+	HedgeWins int64
+}
+
+// CacheObserver is notified of every operation of an InstrumentedQueryCacher.
+type CacheObserver interface {
+	// ObserveCache records the cache event. It is called synchronously and
+	// must not retain the event.
+	ObserveCache(ctx context.Context, event *CacheEvent)
+}
+
+// CacheObserverFunc is a function that implements CacheObserver.
+type CacheObserverFunc func(ctx context.Context, event *CacheEvent)
+
+// ObserveCache calls fn(ctx, event).
+func (fn CacheObserverFunc) ObserveCache(ctx context.Context, event *CacheEvent) {
+	fn(ctx, event)
+}
+
+var _ pgxcache.QueryCacher = &InstrumentedQueryCacher{}
+
+// InstrumentedQueryCacher implements pgxcache.QueryCacher interface around
+// another cacher and reports every operation to Observer.
+//
+// Hits, misses and latency are recorded for any cacher. DynamoQueryCacher and
+// S3QueryCacher, including when they sit behind TieredQueryCacher,
+// SingleFlightQueryCacher or RefreshQueryCacher, also report expired and
+// corrupt entries, payload sizes, DynamoDB consumed capacity and hedged S3
+// reads.
+type InstrumentedQueryCacher struct {
+	// Cacher is the instrumented cacher.
+	Cacher pgxcache.QueryCacher
+	// Observer is notified of every operation.
+	Observer CacheObserver
+	// Name distinguishes the cacher when several are instrumented.
+	Name string
+}
+
+// Get retrieves a cache item from Cacher.
+func (r *InstrumentedQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	ctx, stats := withStats(ctx)
+	start := time.Now()
+
+	item, err := r.Cacher.Get(ctx, key)
+
+	event := r.event(CacheGet, start, stats, err)
+	switch {
+	case err != nil:
+	case item != nil:
+		event.Result = CacheHit
+	case stats.corrupt:
+		event.Result = CacheCorrupt
+	case stats.expired:
+		event.Result = CacheExpired
+	default:
+		event.Result = CacheMiss
+	}
+	r.Observer.ObserveCache(ctx, event)
+
+	return item, err
+}
+
+// Set stores a cache item in Cacher.
+func (r *InstrumentedQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	ctx, stats := withStats(ctx)
+	start := time.Now()
+
+	err := r.Cacher.Set(ctx, key, item, lifetime)
+	r.Observer.ObserveCache(ctx, r.event(CacheSet, start, stats, err))
+
+	return err
+}
+
+// Reset resets Cacher.
+func (r *InstrumentedQueryCacher) Reset(ctx context.Context) error {
+	ctx, stats := withStats(ctx)
+	start := time.Now()
+
+	err := r.Cacher.Reset(ctx)
+	r.Observer.ObserveCache(ctx, r.event(CacheReset, start, stats, err))
+
+	return err
+}
+
+// event builds the event of an operation started at start.
+func (r *InstrumentedQueryCacher) event(operation CacheOperation, start time.Time, stats *cacheStats, err error) *CacheEvent {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	event := &CacheEvent{
+		Name:             r.Name,
+		Operation:        operation,
+		Result:           CacheOK,
+		Err:              err,
+		Duration:         time.Since(start),
+		BytesRead:        stats.bytesRead,
+		BytesWritten:     stats.bytesWritten,
+		ConsumedCapacity: stats.consumedCapacity,
+		Hedged:           stats.hedged,
+		HedgeWins:        stats.hedgeWins,
+	}
+	if err != nil {
+		event.Result = CacheError
+	}
+	return event
+}
+
+// cacheStatsKey is the context key of the cacheStats of an operation.
+type cacheStatsKey struct{}
+
+// cacheStats collects what the backends report about an operation of an
+// InstrumentedQueryCacher.
+type cacheStats struct {
+	mu               sync.Mutex
+	expired          bool
+	corrupt          bool
+	bytesRead        int64
+	bytesWritten     int64
+	consumedCapacity float64
+	hedged           int64
+	hedgeWins        int64
+}
+
+// withStats returns a context that collects the stats of an operation.
+func withStats(ctx context.Context) (context.Context, *cacheStats) {
+	stats := &cacheStats{}
+	return context.WithValue(ctx, cacheStatsKey{}, stats), stats
+}
+
+// recordStats updates the stats collected by the context, if any.
+func recordStats(ctx context.Context, fn func(stats *cacheStats)) {
+	if stats, ok := ctx.Value(cacheStatsKey{}).(*cacheStats); ok {
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+		fn(stats)
+	}
+}
+
+var _ CacheObserver = &OTelObserver{}
+
+// OTelObserver is a CacheObserver that records OpenTelemetry metrics:
+//
+//   - pgxaws.cache.operations counts operations by name, operation and result.
+//   - pgxaws.cache.duration records their duration in seconds.
+//   - pgxaws.cache.bytes counts the bytes read and written by name and
+//     direction.
+//   - pgxaws.cache.consumed_capacity counts the DynamoDB capacity units
+//     consumed by name and operation.
+//   - pgxaws.cache.hedges counts the hedged S3 reads by name and result, won
+//     when their response was used and lost otherwise.
+type OTelObserver struct {
+	operations metric.Int64Counter
+	duration   metric.Float64Histogram
+	bytes      metric.Int64Counter
+	capacity   metric.Float64Counter
+	hedges     metric.Int64Counter
+}
+
+// NewOTelObserver creates a new OTelObserver that records its metrics with
+// the meter.
+func NewOTelObserver(meter metric.Meter) (*OTelObserver, error) {
+	operations, err := meter.Int64Counter("pgxaws.cache.operations",
+		metric.WithDescription("Number of cache operations."),
+		metric.WithUnit("{operation}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := meter.Float64Histogram("pgxaws.cache.duration",
+		metric.WithDescription("Duration of cache operations."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := meter.Int64Counter("pgxaws.cache.bytes",
+		metric.WithDescription("Size of the cache payloads read and written."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, err := meter.Float64Counter("pgxaws.cache.consumed_capacity",
+		metric.WithDescription("DynamoDB capacity units consumed by cache operations."),
+		metric.WithUnit("{capacity_unit}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	hedges, err := meter.Int64Counter("pgxaws.cache.hedges",
+		metric.WithDescription("Number of hedged S3 reads."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OTelObserver{
+		operations: operations,
+		duration:   duration,
+		bytes:      bytes,
+		capacity:   capacity,
+		hedges:     hedges,
+	}, nil
+}
+
+// ObserveCache records the metrics of the cache event.
+func (r *OTelObserver) ObserveCache(ctx context.Context, event *CacheEvent) {
+	name := attribute.String("pgxaws.cache.name", event.Name)
+	operation := attribute.String("pgxaws.cache.operation", string(event.Operation))
+
+	r.operations.Add(ctx, 1, metric.WithAttributes(name, operation,
+		attribute.String("pgxaws.cache.result", string(event.Result)),
+	))
+	r.duration.Record(ctx, event.Duration.Seconds(), metric.WithAttributes(name, operation))
+
+	if event.BytesRead > 0 {
+		r.bytes.Add(ctx, event.BytesRead, metric.WithAttributes(name,
+			attribute.String("pgxaws.cache.direction", "read"),
+		))
+	}
+	if event.BytesWritten > 0 {
+		r.bytes.Add(ctx, event.BytesWritten, metric.WithAttributes(name,
+			attribute.String("pgxaws.cache.direction", "write"),
+		))
+	}
+	if event.ConsumedCapacity > 0 {
+		r.capacity.Add(ctx, event.ConsumedCapacity, metric.WithAttributes(name, operation))
+	}
+	if event.HedgeWins > 0 {
+		r.hedges.Add(ctx, event.HedgeWins, metric.WithAttributes(name,
+			attribute.String("pgxaws.cache.hedge_result", "won"),
+		))
+	}
+	if lost := event.Hedged - event.HedgeWins; lost > 0 {
+		r.hedges.Add(ctx, lost, metric.WithAttributes(name,
+			attribute.String("pgxaws.cache.hedge_result", "lost"),
+		))
+	}
+}
@@ -0,0 +1,176 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// statsCacher is an entryCacher that reports stats like the AWS cachers.
+type statsCacher struct {
+	*entryCacher
+}
+
+func (x *statsCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	entry, err := x.GetEntry(ctx, key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if entry.Expired() {
+		recordStats(ctx, func(stats *cacheStats) { stats.expired = true })
+		return nil, nil
+	}
+	recordStats(ctx, func(stats *cacheStats) {
+		stats.bytesRead += 10
+		stats.consumedCapacity += 0.5
+	})
+	return entry.Item, nil
+}
+
+func (x *statsCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	recordStats(ctx, func(stats *cacheStats) {
+		stats.bytesWritten += 20
+		stats.consumedCapacity += 1
+	})
+	return x.entryCacher.Set(ctx, key, item, lifetime)
+}
+
+var _ = Describe("InstrumentedQueryCacher", func() {
+	var (
+		ctx     context.Context
+		backend *entryCacher
+		events  []*CacheEvent
+		cacher  *InstrumentedQueryCacher
+		key     *pgxcache.QueryKey
+		item    *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = newEntryCacher()
+		events = nil
+		cacher = &InstrumentedQueryCacher{
+			Cacher: &statsCacher{entryCacher: backend},
+			Name:   "test",
+			Observer: CacheObserverFunc(func(_ context.Context, event *CacheEvent) {
+				events = append(events, event)
+			}),
+		}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1"}
+	})
+
+	It("reports misses", func() {
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(ConsistOf(HaveField("Result", CacheMiss)))
+		Expect(events[0].Name).To(Equal("test"))
+		Expect(events[0].Operation).To(Equal(CacheGet))
+	})
+
+	It("reports hits with the bytes read and the consumed capacity", func() {
+		Expect(backend.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Result).To(Equal(CacheHit))
+		Expect(events[0].BytesRead).To(Equal(int64(10)))
+		Expect(events[0].ConsumedCapacity).To(Equal(0.5))
+		Expect(events[0].Duration).To(BeNumerically(">", 0))
+	})
+
+	It("reports expired entries", func() {
+		backend.entries[key.String()] = &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Second)}
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(ConsistOf(HaveField("Result", CacheExpired)))
+	})
+
+	It("reports the bytes written", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Operation).To(Equal(CacheSet))
+		Expect(events[0].Result).To(Equal(CacheOK))
+		Expect(events[0].BytesWritten).To(Equal(int64(20)))
+	})
+
+	It("reports errors", func() {
+		backend.err = errors.New("unavailable")
+
+		_, err := cacher.Get(ctx, key)
+		Expect(err).To(MatchError("unavailable"))
+		Expect(cacher.Reset(ctx)).To(MatchError("unavailable"))
+
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Result).To(Equal(CacheError))
+		Expect(events[0].Err).To(MatchError("unavailable"))
+		Expect(events[1].Operation).To(Equal(CacheReset))
+		Expect(events[1].Result).To(Equal(CacheError))
+	})
+})
+
+var _ = Describe("recordStats", func() {
+	It("does nothing outside an instrumented operation", func() {
+		called := false
+		recordStats(context.Background(), func(*cacheStats) { called = true })
+		Expect(called).To(BeFalse())
+	})
+})
+
+var _ = Describe("OTelObserver", func() {
+	It("records operations, durations, bytes, consumed capacity and hedges", func() {
+		ctx := context.Background()
+		reader := sdkmetric.NewManualReader()
+		provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+		observer, err := NewOTelObserver(provider.Meter("pgxaws"))
+		Expect(err).NotTo(HaveOccurred())
+
+		observer.ObserveCache(ctx, &CacheEvent{
+			Name:             "test",
+			Operation:        CacheGet,
+			Result:           CacheHit,
+			Duration:         time.Millisecond,
+			BytesRead:        10,
+			ConsumedCapacity: 0.5,
+			Hedged:           3,
+			HedgeWins:        1,
+		})
+
+		data := metricdata.ResourceMetrics{}
+		Expect(reader.Collect(ctx, &data)).To(Succeed())
+		Expect(data.ScopeMetrics).To(HaveLen(1))
+
+		metrics := map[string]metricdata.Aggregation{}
+		for _, m := range data.ScopeMetrics[0].Metrics {
+			metrics[m.Name] = m.Data
+		}
+		Expect(metrics).To(HaveKey("pgxaws.cache.operations"))
+		Expect(metrics).To(HaveKey("pgxaws.cache.duration"))
+		Expect(metrics).To(HaveKey("pgxaws.cache.bytes"))
+		Expect(metrics).To(HaveKey("pgxaws.cache.consumed_capacity"))
+
+		bytes := metrics["pgxaws.cache.bytes"].(metricdata.Sum[int64])
+		Expect(bytes.DataPoints).To(HaveLen(1))
+		Expect(bytes.DataPoints[0].Value).To(Equal(int64(10)))
+
+		capacity := metrics["pgxaws.cache.consumed_capacity"].(metricdata.Sum[float64])
+		Expect(capacity.DataPoints[0].Value).To(Equal(0.5))
+
+		hedges := metrics["pgxaws.cache.hedges"].(metricdata.Sum[int64])
+		results := map[string]int64{}
+		for _, point := range hedges.DataPoints {
+			result, _ := point.Attributes.Value("pgxaws.cache.hedge_result")
+			results[result.AsString()] = point.Value
+		}
+		Expect(results).To(Equal(map[string]int64{"won": 1, "lost": 2}))
+	})
+})
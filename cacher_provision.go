@@ -0,0 +1,386 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// provisionTimeout bounds how long the Ensure helpers wait for a newly
+// created table or bucket to become available.
+const provisionTimeout = 5 * time.Minute
+
+// DriftError reports differences between an existing table and the layout
+// the cacher expects. The differences are not fixed automatically because
+// doing so could destroy data or affect other users of the resource.
+type DriftError struct {
+	// Resource is the name of the table.
+	Resource string
+	// Issues describes each difference that was found.
+	Issues []string
+}
+
+// Error implements the error interface.
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("pgxaws: %s has drifted: %s", e.Resource, strings.Join(e.Issues, "; "))
+}
+
+// EnsureTable creates the DynamoDB cache table when it does not exist and
+// enables TTL on the TTL attribute of the schema. New tables use on-demand
+// billing. An existing table is validated instead, and any difference that
+// cannot be fixed safely is reported as a *DriftError. EnsureTable is
+// idempotent and can be called on every start-up.
+func (r *DynamoQueryCacher) EnsureTable(ctx context.Context) error {
+	input := &dynamodb.DescribeTableInput{TableName: aws.String(r.Table)}
+
+	out, err := r.Client.DescribeTable(ctx, input)
+	var nerr *dynamodbtypes.ResourceNotFoundException
+	switch {
+	case errors.As(err, &nerr):
+		if err := r.createTable(ctx); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if issues := r.validateTable(out.Table); len(issues) > 0 {
+			return &DriftError{Resource: r.Table, Issues: issues}
+		}
+	}
+
+	// UpdateTimeToLive is rejected while the table is still being created.
+	if err := dynamodb.NewTableExistsWaiter(r.Client).Wait(ctx, input, provisionTimeout); err != nil {
+		return err
+	}
+
+	return r.ensureTimeToLive(ctx)
+}
+
+// ValidateTable checks that the DynamoDB cache table matches the schema of
+// the cacher and has TTL enabled on its TTL attribute, without changing
+// anything. The differences are reported as a *DriftError. Unlike
+// EnsureTable, it only needs the dynamodb:DescribeTable and
+// dynamodb:DescribeTimeToLive permissions.
+func (r *DynamoQueryCacher) ValidateTable(ctx context.Context) error {
+	out, err := r.Client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(r.Table)})
+	if err != nil {
+		return err
+	}
+	issues := r.validateTable(out.Table)
+
+	ttl, err := r.Client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(r.Table)})
+	if err != nil {
+		return err
+	}
+
+	schema := r.schema()
+	desc := ttl.TimeToLiveDescription
+	switch {
+	case desc == nil || (desc.TimeToLiveStatus != dynamodbtypes.TimeToLiveStatusEnabled && desc.TimeToLiveStatus != dynamodbtypes.TimeToLiveStatusEnabling):
+		issues = append(issues, fmt.Sprintf("TTL is not enabled on %q", schema.TTL))
+	case aws.ToString(desc.AttributeName) != schema.TTL:
+		issues = append(issues, fmt.Sprintf("TTL is enabled on %q instead of %q", aws.ToString(desc.AttributeName), schema.TTL))
+	}
+
+	if len(issues) > 0 {
+		return &DriftError{Resource: r.Table, Issues: issues}
+	}
+	return nil
+}
+
+// createTable creates the cache table with the primary key of the schema.
+func (r *DynamoQueryCacher) createTable(ctx context.Context) error {
+	input := &dynamodb.CreateTableInput{
+		TableName:   aws.String(r.Table),
+		BillingMode: dynamodbtypes.BillingModePayPerRequest,
+	}
+
+	schema := r.schema()
+	for i, name := range schema.keyNames() {
+		keyType := dynamodbtypes.KeyTypeHash
+		if i > 0 {
+			keyType = dynamodbtypes.KeyTypeRange
+		}
+		input.AttributeDefinitions = append(input.AttributeDefinitions, dynamodbtypes.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: dynamodbtypes.ScalarAttributeTypeS,
+		})
+		input.KeySchema = append(input.KeySchema, dynamodbtypes.KeySchemaElement{
+			AttributeName: aws.String(name),
+			KeyType:       keyType,
+		})
+	}
+
+	_, err := r.Client.CreateTable(ctx, input)
+
+	// Another process may have created the table concurrently.
+	var ierr *dynamodbtypes.ResourceInUseException
+	if errors.As(err, &ierr) {
+		return nil
+	}
+	return err
+}
+
+// validateTable compares the key schema of the table with the one used by the
+// cacher and returns the differences.
+func (r *DynamoQueryCacher) validateTable(table *dynamodbtypes.TableDescription) []string {
+	var issues []string
+
+	schema := r.schema()
+	expected := map[dynamodbtypes.KeyType]string{dynamodbtypes.KeyTypeHash: schema.PartitionKey}
+	if schema.SortKey != "" {
+		expected[dynamodbtypes.KeyTypeRange] = schema.SortKey
+	}
+
+	found := map[dynamodbtypes.KeyType]bool{}
+	for _, elem := range table.KeySchema {
+		name := aws.ToString(elem.AttributeName)
+		found[elem.KeyType] = true
+
+		switch want, ok := expected[elem.KeyType]; {
+		case !ok:
+			issues = append(issues, fmt.Sprintf("unexpected range key %q", name))
+		case name != want:
+			issues = append(issues, fmt.Sprintf("%s key is %q instead of %q", keyTypeName(elem.KeyType), name, want))
+		}
+	}
+	if schema.SortKey != "" && !found[dynamodbtypes.KeyTypeRange] {
+		issues = append(issues, fmt.Sprintf("missing range key %q", schema.SortKey))
+	}
+
+	for _, attr := range table.AttributeDefinitions {
+		name := aws.ToString(attr.AttributeName)
+		if (name == schema.PartitionKey || name == schema.SortKey) && attr.AttributeType != dynamodbtypes.ScalarAttributeTypeS {
+			issues = append(issues, fmt.Sprintf("key %q has type %s instead of S", name, attr.AttributeType))
+		}
+	}
+
+	return issues
+}
+
+// keyTypeName returns the name of the key type used in drift issues.
+func keyTypeName(keyType dynamodbtypes.KeyType) string {
+	if keyType == dynamodbtypes.KeyTypeRange {
+		return "range"
+	}
+	return "hash"
+}
+
+// ensureTimeToLive enables TTL on the TTL attribute of the schema.
+func (r *DynamoQueryCacher) ensureTimeToLive(ctx context.Context) error {
+	out, err := r.Client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(r.Table),
+	})
+	if err != nil {
+		return err
+	}
+
+	desc := out.TimeToLiveDescription
+	if desc == nil {
+		desc = &dynamodbtypes.TimeToLiveDescription{TimeToLiveStatus: dynamodbtypes.TimeToLiveStatusDisabled}
+	}
+
+	ttl := r.schema().TTL
+	switch desc.TimeToLiveStatus {
+	case dynamodbtypes.TimeToLiveStatusEnabled, dynamodbtypes.TimeToLiveStatusEnabling:
+		if name := aws.ToString(desc.AttributeName); name != ttl {
+			return &DriftError{
+				Resource: r.Table,
+				Issues:   []string{fmt.Sprintf("TTL is enabled on %q instead of %q", name, ttl)},
+			}
+		}
+		return nil
+	case dynamodbtypes.TimeToLiveStatusDisabling:
+		// TTL cannot be re-enabled until DynamoDB has finished disabling it.
+		return &DriftError{
+			Resource: r.Table,
+			Issues:   []string{"TTL is being disabled"},
+		}
+	}
+
+	_, err = r.Client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(r.Table),
+		TimeToLiveSpecification: &dynamodbtypes.TimeToLiveSpecification{
+			AttributeName: aws.String(ttl),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
+
+// EnsureBucket creates the S3 cache bucket when it does not exist and installs
+// a lifecycle rule that deletes objects under the cacher namespace once they
+// are older than lifetime, and the parts of incomplete multipart uploads after
+// a day. Lifecycle rules work at day granularity, so lifetime is rounded up to
+// whole days. Rules owned by other users of the bucket are preserved.
+// EnsureBucket is idempotent and can be called on every start-up.
+//
+// Versioned buckets are supported: the rule also deletes the versions of the
+// objects a day after they are replaced, deleted or expired. Reset only hides
+// the objects of a versioned bucket behind delete markers unless
+// ResetOptions.Versions is set.
+//
+// New buckets have ACLs disabled, so that every object belongs to the bucket
+// owner. Directory buckets are created in the zone named by the bucket, and
+// get no lifecycle rule.
+func (r *S3QueryCacher) EnsureBucket(ctx context.Context, lifetime time.Duration) error {
+	input := &s3.HeadBucketInput{Bucket: aws.String(r.Bucket), ExpectedBucketOwner: r.bucketOwner()}
+
+	_, err := r.Client.HeadBucket(ctx, input)
+	var nerr *s3types.NotFound
+	switch {
+	case errors.As(err, &nerr):
+		if err := r.createBucket(ctx); err != nil {
+			return err
+		}
+		if err := s3.NewBucketExistsWaiter(r.Client).Wait(ctx, input, provisionTimeout); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+
+	// The lifecycle rules of directory buckets are not relied upon: expired
+	// objects are deleted when they are read.
+	if r.directory() {
+		return nil
+	}
+
+	return r.ensureLifecycle(ctx, lifetime)
+}
+
+// createBucket creates the cache bucket in the region of the client, or in the
+// zone named by the bucket for directory buckets.
+func (r *S3QueryCacher) createBucket(ctx context.Context) error {
+	input := &s3.CreateBucketInput{Bucket: aws.String(r.Bucket)}
+
+	if r.directory() {
+		zone, err := directoryBucketZone(r.Bucket)
+		if err != nil {
+			return err
+		}
+		input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			Location: &s3types.LocationInfo{
+				Type: s3types.LocationTypeAvailabilityZone,
+				Name: aws.String(zone),
+			},
+			Bucket: &s3types.BucketInfo{
+				Type:           s3types.BucketTypeDirectory,
+				DataRedundancy: s3types.DataRedundancySingleAvailabilityZone,
+			},
+		}
+	}
+
+	// Objects belong to the bucket owner and ACLs are disabled, so that
+	// access is only governed by policies.
+	if !r.directory() {
+		input.ObjectOwnership = s3types.ObjectOwnershipBucketOwnerEnforced
+	}
+
+	// us-east-1 is the default location and must not be sent explicitly.
+	// Without client options the bucket is created in the default location.
+	if client, ok := r.Client.(s3Options); ok && !r.directory() {
+		if region := client.Options().Region; region != "" && region != "us-east-1" {
+			input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+				LocationConstraint: s3types.BucketLocationConstraint(region),
+			}
+		}
+	}
+
+	_, err := r.Client.CreateBucket(ctx, input)
+	// Another process may have created the bucket concurrently.
+	var oerr *s3types.BucketAlreadyOwnedByYou
+	if errors.As(err, &oerr) {
+		return nil
+	}
+	return err
+}
+
+// ensureLifecycle installs or updates the expiration rule owned by the cacher.
+func (r *S3QueryCacher) ensureLifecycle(ctx context.Context, lifetime time.Duration) error {
+	var rules []s3types.LifecycleRule
+
+	out, err := r.Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket:              aws.String(r.Bucket),
+		ExpectedBucketOwner: r.bucketOwner(),
+	})
+	var aerr smithy.APIError
+	switch {
+	case errors.As(err, &aerr) && aerr.ErrorCode() == "NoSuchLifecycleConfiguration":
+	case err != nil:
+		return err
+	default:
+		rules = out.Rules
+	}
+
+	// Lifecycle rules only support whole days, with a minimum of one.
+	days := int32(max(1, (lifetime+24*time.Hour-1)/(24*time.Hour)))
+	prefix := namespacePrefix(r.Namespace)
+	rule := s3types.LifecycleRule{
+		ID:         aws.String(r.lifecycleRuleID()),
+		Status:     s3types.ExpirationStatusEnabled,
+		Filter:     &s3types.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+		Expiration: &s3types.LifecycleExpiration{Days: aws.Int32(days)},
+		// Parts of the uploads of Set that could not be aborted are billed
+		// until the upload is aborted.
+		AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{DaysAfterInitiation: aws.Int32(1)},
+		// Versioned buckets keep the objects that are replaced, deleted or
+		// expired as noncurrent versions.
+		NoncurrentVersionExpiration: &s3types.NoncurrentVersionExpiration{NoncurrentDays: aws.Int32(1)},
+	}
+
+	found := false
+	for i, existing := range rules {
+		if aws.ToString(existing.ID) != aws.ToString(rule.ID) {
+			continue
+		}
+		if lifecycleRuleEqual(existing, rule) {
+			return nil
+		}
+		rules[i] = rule
+		found = true
+	}
+	if !found {
+		rules = append(rules, rule)
+	}
+
+	_, err = r.Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:              aws.String(r.Bucket),
+		ExpectedBucketOwner: r.bucketOwner(),
+		LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	})
+	return err
+}
+
+// lifecycleRuleID returns the ID of the lifecycle rule owned by the cacher.
+// Each namespace owns its own rule.
+func (r *S3QueryCacher) lifecycleRuleID() string {
+	if namespace := strings.Trim(r.Namespace, "/"); namespace != "" {
+		return "pgxaws:" + namespace
+	}
+	return "pgxaws"
+}
+
+// lifecycleRuleEqual reports whether two lifecycle rules expire the same
+// objects, incomplete multipart uploads and noncurrent versions after the same
+// number of days.
+func lifecycleRuleEqual(x, y s3types.LifecycleRule) bool {
+	if x.Status != y.Status || x.Filter == nil || x.Expiration == nil || x.AbortIncompleteMultipartUpload == nil || x.NoncurrentVersionExpiration == nil {
+		return false
+	}
+	return aws.ToString(x.Filter.Prefix) == aws.ToString(y.Filter.Prefix) &&
+		aws.ToInt32(x.Expiration.Days) == aws.ToInt32(y.Expiration.Days) &&
+		aws.ToInt32(x.AbortIncompleteMultipartUpload.DaysAfterInitiation) == aws.ToInt32(y.AbortIncompleteMultipartUpload.DaysAfterInitiation) &&
+		aws.ToInt32(x.NoncurrentVersionExpiration.NoncurrentDays) == aws.ToInt32(y.NoncurrentVersionExpiration.NoncurrentDays)
+}
@@ -0,0 +1,115 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DriftError", func() {
+	It("includes the resource name and every issue in the message", func() {
+		err := &DriftError{Resource: "queries", Issues: []string{"first", "second"}}
+		Expect(err.Error()).To(Equal("pgxaws: queries has drifted: first; second"))
+	})
+
+	It("can be detected with errors.As", func() {
+		var err error = &DriftError{Resource: "queries"}
+		var derr *DriftError
+		Expect(errors.As(err, &derr)).To(BeTrue())
+		Expect(derr.Resource).To(Equal("queries"))
+	})
+})
+
+var _ = Describe("S3QueryCacher lifecycle rules", func() {
+	rule := func(prefix string, days int32) s3types.LifecycleRule {
+		return s3types.LifecycleRule{
+			ID:         aws.String("pgxaws"),
+			Status:     s3types.ExpirationStatusEnabled,
+			Filter:     &s3types.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+			Expiration: &s3types.LifecycleExpiration{Days: aws.Int32(days)},
+			AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int32(1),
+			},
+			NoncurrentVersionExpiration: &s3types.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int32(1),
+			},
+		}
+	}
+
+	It("uses a shared rule ID when no namespace is set", func() {
+		cacher := &S3QueryCacher{Bucket: "queries"}
+		Expect(cacher.lifecycleRuleID()).To(Equal("pgxaws"))
+	})
+
+	It("uses a rule ID per namespace", func() {
+		cacher := &S3QueryCacher{Bucket: "queries", Namespace: "billing/prod/v3"}
+		Expect(cacher.lifecycleRuleID()).To(Equal("pgxaws:billing/prod/v3"))
+	})
+
+	It("treats rules with the same prefix and days as equal", func() {
+		Expect(lifecycleRuleEqual(rule("a/", 1), rule("a/", 1))).To(BeTrue())
+	})
+
+	It("treats rules with a different prefix or days as different", func() {
+		Expect(lifecycleRuleEqual(rule("a/", 1), rule("b/", 1))).To(BeFalse())
+		Expect(lifecycleRuleEqual(rule("a/", 1), rule("a/", 2))).To(BeFalse())
+	})
+
+	It("treats a rule without an expiration as different", func() {
+		existing := rule("a/", 1)
+		existing.Expiration = nil
+		Expect(lifecycleRuleEqual(existing, rule("a/", 1))).To(BeFalse())
+	})
+
+	It("treats a rule that does not abort incomplete uploads as different", func() {
+		existing := rule("a/", 1)
+		existing.AbortIncompleteMultipartUpload = nil
+		Expect(lifecycleRuleEqual(existing, rule("a/", 1))).To(BeFalse())
+	})
+
+	It("treats a rule that does not expire noncurrent versions as different", func() {
+		existing := rule("a/", 1)
+		existing.NoncurrentVersionExpiration = nil
+		Expect(lifecycleRuleEqual(existing, rule("a/", 1))).To(BeFalse())
+	})
+})
+
+var _ = Describe("EnsureTable", func() {
+	It("creates or validates the cache table", func() {
+		table := os.Getenv("PGXAWS_DYNAMODB_TABLE")
+		if table == "" {
+			Skip("PGXAWS_DYNAMODB_TABLE not set")
+		}
+
+		ctx := context.Background()
+		cacher, err := NewDynamoQueryCacher(ctx, table)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cacher.EnsureTable(ctx)).To(Succeed())
+		// A second call must be a no-op.
+		Expect(cacher.EnsureTable(ctx)).To(Succeed())
+	})
+})
+
+var _ = Describe("EnsureBucket", func() {
+	It("creates or validates the cache bucket", func() {
+		bucket := os.Getenv("PGXAWS_S3_BUCKET")
+		if bucket == "" {
+			Skip("PGXAWS_S3_BUCKET not set")
+		}
+
+		ctx := context.Background()
+		cacher, err := NewS3QueryCacher(ctx, bucket)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+		// A second call must be a no-op.
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+})
@@ -0,0 +1,263 @@
+package pgxaws
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// Querier executes queries that return rows. It is implemented by *pgx.Conn,
+// *pgxpool.Pool and pgx.Tx.
+type Querier interface {
+	// Query executes a query that returns rows.
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// query runs the query identified by the key and records its result.
+func query(ctx context.Context, querier Querier, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	rows, err := querier.Query(ctx, key.SQL, key.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	item := &pgxcache.QueryItem{
+		Fields: slices.Clone(rows.FieldDescriptions()),
+	}
+
+	for rows.Next() {
+		// Raw values are only valid until the next call to Next.
+		values := rows.RawValues()
+		row := make([][]byte, len(values))
+		for i, value := range values {
+			if value != nil {
+				row[i] = slices.Clone(value)
+			}
+		}
+		item.Rows = append(item.Rows, row)
+	}
+
+	// The command tag is only available once the rows are closed.
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	item.CommandTag = rows.CommandTag().String()
+	return item, nil
+}
+
+// lifetime returns the lifetime configured by the @cache-max-lifetime option
+// of the query, or fallback when the query has no such option.
+func lifetime(key *pgxcache.QueryKey, fallback time.Duration) time.Duration {
+	if options, err := pgxcache.ParseQueryOptions(key.SQL); err == nil && options.MaxLifetime > 0 {
+		return options.MaxLifetime
+	}
+	return fallback
+}
+
+// refreshClaim records that a caller in this process is refreshing a key.
+type refreshClaim struct {
+	// token identifies the lease held on the key, if any.
+	token string
+	// expireAt is the time after which the claim is abandoned.
+	expireAt time.Time
+	// background is set when the claim is held by a background refresh,
+	// which Set must not release.
+	background bool
+}
+
+var _ pgxcache.QueryCacher = &RefreshQueryCacher{}
+
+// RefreshQueryCacher implements pgxcache.QueryCacher interface with
+// stale-while-revalidate and refresh-ahead semantics on top of a
+// QueryEntryCacher, such as DynamoQueryCacher or S3QueryCacher.
+//
+// Entries are stored with a soft expiry at the end of their lifetime and a
+// hard expiry StaleLifetime later. Between the two, Get keeps serving the
+// stale item while one caller refreshes it:
+//
+//   - With a Querier, the query is re-run in the background and every caller
+//     is served the stale item.
+//   - Without a Querier, one caller is told the item is missing, so that it
+//     runs the query and stores the result with Set, while every other caller
+//     is served the stale item.
+//
+// When Cacher also implements QueryLeaser, a lease ensures that only one
+// caller across all processes refreshes a key.
+type RefreshQueryCacher struct {
+	// Cacher stores the entries.
+	Cacher QueryEntryCacher
+	// StaleLifetime is how long an entry may still be served after the end
+	// of its lifetime while it is being refreshed.
+	StaleLifetime time.Duration
+	// RefreshAhead is how long before the end of its lifetime an entry that
+	// is read is refreshed in the background, so that hot entries never
+	// become stale. It requires Querier. Zero disables refresh-ahead.
+	RefreshAhead time.Duration
+	// Querier runs the queries that refresh entries in the background.
+	Querier Querier
+	// MaxLifetime is the lifetime of entries refreshed in the background
+	// whose query has no @cache-max-lifetime option. As with pgxcache, a
+	// zero lifetime means the refreshed result is not stored.
+	MaxLifetime time.Duration
+	// LeaseDuration is the maximum time a refresh may take before another
+	// caller is allowed to refresh the key. Defaults to 30 seconds.
+	LeaseDuration time.Duration
+	// OnRefresh, if set, is called after each background refresh with its
+	// outcome.
+	OnRefresh func(key *pgxcache.QueryKey, err error)
+
+	claims sync.Map
+}
+
+// Get retrieves a cache item from Cacher. A stale item is served while it is
+// being refreshed.
+func (r *RefreshQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	entry, err := r.Cacher.GetEntry(ctx, key)
+	if err != nil || entry == nil || entry.Expired() {
+		return nil, err
+	}
+
+	refreshAt := entry.RefreshAt
+	if refreshAt.IsZero() {
+		refreshAt = entry.ExpireAt
+	}
+
+	switch {
+	case r.Querier != nil && time.Now().After(refreshAt.Add(-r.RefreshAhead)):
+		// Serve the item while it is refreshed in the background.
+		r.refresh(ctx, key)
+	case r.Querier == nil && entry.Stale():
+		// Let a single caller repopulate the item.
+		if r.claim(ctx, key, false) != nil {
+			return nil, nil
+		}
+	}
+
+	return entry.Item, nil
+}
+
+// Set stores a cache item in Cacher with a soft expiry after lifetime and a
+// hard expiry StaleLifetime later. It releases the claim handed out by Get to
+// the caller that repopulates the item, but not the claim of a background
+// refresh.
+func (r *RefreshQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	err := r.set(ctx, key, item, lifetime, time.Time{})
+	if value, ok := r.claims.Load(key.String()); ok {
+		if claim := value.(*refreshClaim); !claim.background {
+			r.release(ctx, key, claim)
+		}
+	}
+	return err
+}
+
+// Reset resets Cacher.
+func (r *RefreshQueryCacher) Reset(ctx context.Context) error {
+	return r.Cacher.Reset(ctx)
+}
+
+// set stores the item with its soft and hard expiry. createdAt is the time at
+// which the query started, or zero when it is unknown.
+func (r *RefreshQueryCacher) set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration, createdAt time.Time) error {
+	now := time.Now().UTC()
+	return r.Cacher.SetEntry(ctx, key, &QueryEntry{
+		Item:      item,
+		RefreshAt: now.Add(lifetime),
+		ExpireAt:  now.Add(lifetime + r.StaleLifetime),
+		CreatedAt: createdAt,
+	})
+}
+
+// refresh re-runs the query of the key in the background unless it is
+// already being refreshed.
+func (r *RefreshQueryCacher) refresh(ctx context.Context, key *pgxcache.QueryKey) {
+	claim := r.claim(ctx, key, true)
+	if claim == nil {
+		return
+	}
+
+	go func() {
+		// The refresh outlives the Get that triggered it.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), valueOrDefault(r.LeaseDuration, leaseDuration))
+		defer cancel()
+
+		start := time.Now()
+		item, err := query(ctx, r.Querier, key)
+		if err == nil {
+			if lifetime := lifetime(key, r.MaxLifetime); lifetime > 0 {
+				err = r.set(ctx, key, item, lifetime, start)
+			}
+		}
+		r.release(ctx, key, claim)
+
+		if r.OnRefresh != nil {
+			r.OnRefresh(key, err)
+		}
+	}()
+}
+
+// claim returns the claim of the caller on the key, or nil when it may not
+// refresh the key. At most one caller per process, and per Cacher when it
+// hands out leases, holds the claim.
+func (r *RefreshQueryCacher) claim(ctx context.Context, key *pgxcache.QueryKey, background bool) *refreshClaim {
+	r.forgetExpired()
+
+	id := key.String()
+	duration := valueOrDefault(r.LeaseDuration, leaseDuration)
+	claim := &refreshClaim{expireAt: time.Now().Add(duration), background: background}
+
+	if _, loaded := r.claims.LoadOrStore(id, claim); loaded {
+		return nil
+	}
+
+	if leaser, ok := r.Cacher.(QueryLeaser); ok {
+		token, err := leaser.AcquireLease(ctx, key, duration)
+		if err != nil || token == "" {
+			r.claims.CompareAndDelete(id, claim)
+			return nil
+		}
+
+		leased := &refreshClaim{token: token, expireAt: claim.expireAt, background: background}
+		if !r.claims.CompareAndSwap(id, claim, leased) {
+			// The claim was released by a Set in the meantime.
+			_ = leaser.ReleaseLease(ctx, key, token)
+			return nil
+		}
+		claim = leased
+	}
+
+	return claim
+}
+
+// release gives up the claim on the key, and the lease backing it, unless the
+// claim has been dropped in the meantime.
+func (r *RefreshQueryCacher) release(ctx context.Context, key *pgxcache.QueryKey, claim *refreshClaim) {
+	if !r.claims.CompareAndDelete(key.String(), claim) {
+		return
+	}
+
+	if claim.token != "" {
+		if leaser, ok := r.Cacher.(QueryLeaser); ok {
+			// The lease expires on its own when it cannot be released.
+			_ = leaser.ReleaseLease(ctx, key, claim.token)
+		}
+	}
+}
+
+// forgetExpired drops the claims abandoned by callers that never called Set,
+// e.g. because the query failed or pgxcache did not store its result. Their
+// leases expire on their own.
+func (r *RefreshQueryCacher) forgetExpired() {
+	now := time.Now()
+	r.claims.Range(func(key, value any) bool {
+		if now.After(value.(*refreshClaim).expireAt) {
+			r.claims.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
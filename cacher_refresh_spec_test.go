@@ -0,0 +1,278 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// queryRows is a pgx.Rows over an in-memory result.
+type queryRows struct {
+	pgx.Rows
+
+	rows   [][][]byte
+	index  int
+	closed bool
+}
+
+func (x *queryRows) Next() bool {
+	if x.index >= len(x.rows) {
+		return false
+	}
+	x.index++
+	return true
+}
+
+func (x *queryRows) RawValues() [][]byte { return x.rows[x.index-1] }
+func (x *queryRows) Close()              { x.closed = true }
+func (x *queryRows) Err() error          { return nil }
+
+func (x *queryRows) FieldDescriptions() []pgconn.FieldDescription {
+	return []pgconn.FieldDescription{{Name: "value"}}
+}
+
+func (x *queryRows) CommandTag() pgconn.CommandTag {
+	return pgconn.NewCommandTag("SELECT 1")
+}
+
+// countingQuerier returns a single row and counts the queries it runs. With a
+// gate, queries block until the gate is closed.
+type countingQuerier struct {
+	calls atomic.Int32
+	err   error
+	gate  chan struct{}
+}
+
+func (x *countingQuerier) Query(_ context.Context, _ string, _ ...any) (pgx.Rows, error) {
+	x.calls.Add(1)
+	if x.gate != nil {
+		<-x.gate
+	}
+	if x.err != nil {
+		return nil, x.err
+	}
+	return &queryRows{rows: [][][]byte{{[]byte("fresh")}}}, nil
+}
+
+var _ = Describe("query", func() {
+	It("records the command tag, fields and rows", func() {
+		item, err := query(context.Background(), &countingQuerier{}, &pgxcache.QueryKey{SQL: "SELECT 1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(item.CommandTag).To(Equal("SELECT 1"))
+		Expect(item.Fields).To(HaveLen(1))
+		Expect(item.Rows).To(Equal([][][]byte{{[]byte("fresh")}}))
+	})
+
+	It("returns query errors", func() {
+		_, err := query(context.Background(), &countingQuerier{err: errors.New("boom")}, &pgxcache.QueryKey{SQL: "SELECT 1"})
+		Expect(err).To(MatchError("boom"))
+	})
+})
+
+var _ = Describe("lifetime", func() {
+	It("uses the @cache-max-lifetime option of the query", func() {
+		key := &pgxcache.QueryKey{SQL: "-- @cache-max-lifetime 5m\nSELECT 1"}
+		Expect(lifetime(key, time.Second)).To(Equal(5 * time.Minute))
+	})
+
+	It("falls back when the query has no option", func() {
+		key := &pgxcache.QueryKey{SQL: "SELECT 1"}
+		Expect(lifetime(key, time.Second)).To(Equal(time.Second))
+	})
+})
+
+var _ = Describe("RefreshQueryCacher", func() {
+	var (
+		ctx     context.Context
+		backend *leaseCacher
+		cacher  *RefreshQueryCacher
+		key     *pgxcache.QueryKey
+		item    *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = newLeaseCacher()
+		cacher = &RefreshQueryCacher{Cacher: backend, StaleLifetime: time.Minute}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("stale")}}}
+	})
+
+	It("stores entries with a soft and a hard expiry", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		entry := backend.entries[key.String()]
+		Expect(entry.ExpireAt.Sub(entry.RefreshAt)).To(Equal(time.Minute))
+		Expect(entry.Stale()).To(BeFalse())
+	})
+
+	It("serves fresh entries", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+		Expect(backend.acquired).To(Equal(0))
+	})
+
+	It("does not serve entries past their hard expiry", func() {
+		backend.entries[key.String()] = &QueryEntry{
+			Item:      item,
+			RefreshAt: time.Now().Add(-2 * time.Minute),
+			ExpireAt:  time.Now().Add(-time.Minute),
+		}
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	Context("without a Querier", func() {
+		BeforeEach(func() {
+			backend.entries[key.String()] = &QueryEntry{
+				Item:      item,
+				RefreshAt: time.Now().Add(-time.Second),
+				ExpireAt:  time.Now().Add(time.Minute),
+			}
+		})
+
+		It("reports a miss to one caller and serves the stale item to the others", func() {
+			got, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(BeNil())
+
+			got, err = cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(item))
+		})
+
+		It("releases the lease once the caller stores the refreshed item", func() {
+			_, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.leases).To(HaveKey(key.String()))
+
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+			Expect(backend.leases).To(BeEmpty())
+		})
+
+		It("forgets the claims whose Set never came once they expire", func() {
+			cacher.LeaseDuration = 10 * time.Millisecond
+			_, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(20 * time.Millisecond)
+
+			other := &pgxcache.QueryKey{SQL: "SELECT 2"}
+			backend.entries[other.String()] = backend.entries[key.String()]
+			Expect(cacher.Get(ctx, other)).To(BeNil())
+
+			var claimed []any
+			cacher.claims.Range(func(key, _ any) bool {
+				claimed = append(claimed, key)
+				return true
+			})
+			Expect(claimed).To(Equal([]any{other.String()}))
+		})
+	})
+
+	Context("with a Querier", func() {
+		var (
+			querier   *countingQuerier
+			refreshed chan error
+		)
+
+		BeforeEach(func() {
+			querier = &countingQuerier{}
+			refreshed = make(chan error, 1)
+			cacher.Querier = querier
+			cacher.MaxLifetime = time.Minute
+			cacher.OnRefresh = func(_ *pgxcache.QueryKey, err error) { refreshed <- err }
+		})
+
+		It("serves the stale item and refreshes it in the background", func() {
+			backend.entries[key.String()] = &QueryEntry{
+				Item:      item,
+				RefreshAt: time.Now().Add(-time.Second),
+				ExpireAt:  time.Now().Add(time.Minute),
+			}
+
+			got, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(item))
+
+			Eventually(refreshed).Should(Receive(BeNil()))
+			Expect(querier.calls.Load()).To(Equal(int32(1)))
+
+			got, err = cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got.Rows).To(Equal([][][]byte{{[]byte("fresh")}}))
+			Expect(backend.leases).To(BeEmpty())
+		})
+
+		It("keeps the claim of a background refresh on a foreground Set", func() {
+			querier.gate = make(chan struct{})
+			backend.entries[key.String()] = &QueryEntry{
+				Item:      item,
+				RefreshAt: time.Now().Add(-time.Second),
+				ExpireAt:  time.Now().Add(time.Minute),
+			}
+
+			_, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(querier.calls.Load).Should(Equal(int32(1)))
+
+			Expect(cacher.Set(ctx, key, item, -time.Second)).To(Succeed())
+			_, err = cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(querier.calls.Load()).To(Equal(int32(1)))
+
+			close(querier.gate)
+			Eventually(refreshed).Should(Receive(BeNil()))
+			Expect(backend.leases).To(BeEmpty())
+		})
+
+		It("refreshes hot entries ahead of their soft expiry", func() {
+			cacher.RefreshAhead = time.Minute
+			backend.entries[key.String()] = &QueryEntry{
+				Item:      item,
+				RefreshAt: time.Now().Add(30 * time.Second),
+				ExpireAt:  time.Now().Add(time.Minute),
+			}
+
+			got, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(item))
+
+			Eventually(refreshed).Should(Receive(BeNil()))
+			Expect(querier.calls.Load()).To(Equal(int32(1)))
+		})
+
+		It("does not refresh entries outside the refresh-ahead window", func() {
+			cacher.RefreshAhead = time.Second
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+			_, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Consistently(refreshed, 50*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("reports refresh errors", func() {
+			querier.err = errors.New("boom")
+			backend.entries[key.String()] = &QueryEntry{
+				Item:      item,
+				RefreshAt: time.Now().Add(-time.Second),
+				ExpireAt:  time.Now().Add(time.Minute),
+			}
+
+			_, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(refreshed).Should(Receive(MatchError("boom")))
+		})
+	})
+})
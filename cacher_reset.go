@@ -0,0 +1,372 @@
+package pgxaws
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// ResetOptions configures how a cacher deletes its entries on Reset.
+type ResetOptions struct {
+	// Segments is the number of DynamoDB scan segments that are read in
+	// parallel. It is ignored by S3, which can only be listed sequentially,
+	// and by DynamoDB tables with a sort key, which are queried. Defaults
+	// to 1.
+	Segments int
+	// Workers is the number of delete requests that are issued concurrently.
+	// Defaults to 1.
+	Workers int
+	// Versions makes S3 delete every object version and delete marker instead
+	// of the current objects only, which is required to empty a versioned
+	// bucket; without it the objects are only hidden behind delete markers
+	// until the lifecycle rule removes them (see EnsureBucket). It needs the
+	// s3:ListBucketVersions and s3:DeleteObjectVersion permissions. Directory
+	// buckets have no versions and reject it.
+	Versions bool
+	// Recreate makes DynamoDB delete and recreate the table (see EnsureTable)
+	// instead of deleting items in batches. This is much cheaper for huge
+	// tables, but the table is unavailable while it is being recreated and
+	// settings that EnsureTable does not manage are lost. It deletes the
+	// entries of every namespace, even with a sort key, so it cannot be used
+	// together with a namespace. It cannot be used with DAX either.
+	Recreate bool
+	// Progress, if set, is called after each batch of deletes. Calls are
+	// serialized even when several workers are running.
+	Progress func(ResetProgress)
+}
+
+// ResetProgress reports the progress of a Reset.
+type ResetProgress struct {
+	// Deleted is the number of items or objects deleted so far.
+	Deleted int64
+}
+
+// segments returns the number of scan segments to use.
+func (x *ResetOptions) segments() int {
+	if x == nil || x.Segments < 1 {
+		return 1
+	}
+	return x.Segments
+}
+
+// workers returns the number of delete workers to use.
+func (x *ResetOptions) workers() int {
+	if x == nil || x.Workers < 1 {
+		return 1
+	}
+	return x.Workers
+}
+
+// resetProgress counts deleted entries and reports them to the callback.
+type resetProgress struct {
+	mu       sync.Mutex
+	deleted  atomic.Int64
+	callback func(ResetProgress)
+}
+
+// add records n deleted entries.
+func (x *resetProgress) add(n int) {
+	deleted := x.deleted.Add(int64(n))
+	if x.callback == nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.callback(ResetProgress{Deleted: deleted})
+}
+
+const (
+	// backoffBase is the delay before the first retry.
+	backoffBase = 50 * time.Millisecond
+	// backoffMax caps the delay between two retries.
+	backoffMax = 5 * time.Second
+)
+
+// backoff waits before the given retry attempt using capped exponential
+// backoff with full jitter. It returns early when ctx is cancelled.
+func backoff(ctx context.Context, attempt int) error {
+	delay := backoffMax
+	if attempt < 16 {
+		delay = min(backoffMax, backoffBase<<attempt)
+	}
+
+	timer := time.NewTimer(rand.N(delay) + 1)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deleteItems scans the table with parallel segments and deletes the items in
+// the cacher namespace with concurrent workers.
+func (r *DynamoQueryCacher) deleteItems(ctx context.Context, options *ResetOptions) error {
+	group, ctx := errgroup.WithContext(ctx)
+	batches := make(chan []map[string]dynamodbtypes.AttributeValue)
+	progress := &resetProgress{}
+	if options != nil {
+		progress.callback = options.Progress
+	}
+
+	segments := options.segments()
+	if r.schema().SortKey != "" {
+		// The namespace is a single item collection, which cannot be split.
+		segments = 1
+	}
+	scanners := &sync.WaitGroup{}
+	for segment := range segments {
+		scanners.Add(1)
+		group.Go(func() error {
+			defer scanners.Done()
+			return r.scanKeys(ctx, int32(segment), int32(segments), batches)
+		})
+	}
+
+	go func() {
+		scanners.Wait()
+		close(batches)
+	}()
+
+	for range options.workers() {
+		group.Go(func() error {
+			for keys := range batches {
+				if err := r.deleteKeys(ctx, keys); err != nil {
+					return err
+				}
+				progress.add(len(keys))
+			}
+			return nil
+		})
+	}
+
+	return group.Wait()
+}
+
+// scanKeys reads the keys of one scan segment and sends them in batches that
+// fit in a single BatchWriteItem call.
+func (r *DynamoQueryCacher) scanKeys(ctx context.Context, segment, segments int32, batches chan<- []map[string]dynamodbtypes.AttributeValue) error {
+	// Project only the primary key — we only need keys to issue deletes.
+	for items, err := range r.pages(ctx, r.schema(), segment, segments) {
+		if err != nil {
+			return err
+		}
+
+		// BatchWriteItem accepts at most 25 requests per call.
+		for keys := range slices.Chunk(items, 25) {
+			select {
+			case batches <- keys:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteKeys deletes up to 25 items with batchWrite.
+func (r *DynamoQueryCacher) deleteKeys(ctx context.Context, keys []map[string]dynamodbtypes.AttributeValue) error {
+	deletes := make([]dynamodbtypes.WriteRequest, len(keys))
+	for i, key := range keys {
+		deletes[i] = dynamodbtypes.WriteRequest{
+			DeleteRequest: &dynamodbtypes.DeleteRequest{Key: key},
+		}
+	}
+
+	return r.batchWrite(ctx, deletes)
+}
+
+// recreateTable deletes the cache table and creates it again.
+func (r *DynamoQueryCacher) recreateTable(ctx context.Context) error {
+	if prefix := namespacePrefix(r.Namespace); prefix != "" {
+		return fmt.Errorf("pgxaws: cannot recreate table %s shared by namespace %s", r.Table, r.Namespace)
+	}
+	if r.DAX != nil {
+		// The DAX item cache would keep serving the deleted items.
+		return fmt.Errorf("pgxaws: cannot recreate table %s behind DAX", r.Table)
+	}
+
+	input := &dynamodb.DescribeTableInput{TableName: aws.String(r.Table)}
+	if _, err := r.Client.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: input.TableName}); err != nil {
+		return err
+	}
+	if err := dynamodb.NewTableNotExistsWaiter(r.Client).Wait(ctx, input, provisionTimeout); err != nil {
+		return err
+	}
+
+	return r.EnsureTable(ctx)
+}
+
+// deleteObjects lists the objects under the cacher namespace and deletes them
+// with concurrent workers.
+//
+// Directory buckets list objects in no particular order, and a listing that
+// runs while its objects are deleted may miss some of them. Their objects are
+// listed and deleted again until a pass finds none, up to
+// directoryResetPasses times.
+func (r *S3QueryCacher) deleteObjects(ctx context.Context, options *ResetOptions) error {
+	progress := &resetProgress{}
+	if options != nil {
+		progress.callback = options.Progress
+	}
+
+	if !r.directory() {
+		return r.deleteObjectsPass(ctx, options, progress)
+	}
+	if options != nil && options.Versions {
+		return fmt.Errorf("pgxaws: directory bucket %s has no object versions", r.Bucket)
+	}
+
+	for range directoryResetPasses {
+		deleted := progress.deleted.Load()
+		if err := r.deleteObjectsPass(ctx, options, progress); err != nil {
+			return err
+		}
+		if progress.deleted.Load() == deleted {
+			return nil
+		}
+	}
+	return fmt.Errorf("pgxaws: namespace %s may not be empty after %d passes", r.Namespace, directoryResetPasses)
+}
+
+// deleteObjectsPass lists the objects under the cacher namespace once and
+// deletes them with concurrent workers.
+func (r *S3QueryCacher) deleteObjectsPass(ctx context.Context, options *ResetOptions, progress *resetProgress) error {
+	group, ctx := errgroup.WithContext(ctx)
+	batches := make(chan []s3types.ObjectIdentifier)
+
+	group.Go(func() error {
+		defer close(batches)
+		if options != nil && options.Versions {
+			return r.listVersions(ctx, batches)
+		}
+		return r.listObjects(ctx, batches)
+	})
+
+	for range options.workers() {
+		group.Go(func() error {
+			for objects := range batches {
+				if err := r.deleteBatch(ctx, objects); err != nil {
+					return err
+				}
+				progress.add(len(objects))
+			}
+			return nil
+		})
+	}
+
+	return group.Wait()
+}
+
+// listObjects sends the current objects under the cacher namespace in batches
+// that fit in a single DeleteObjects call.
+func (r *S3QueryCacher) listObjects(ctx context.Context, batches chan<- []s3types.ObjectIdentifier) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:              aws.String(r.Bucket),
+		ExpectedBucketOwner: r.bucketOwner(),
+	}
+	if prefix := namespacePrefix(r.Namespace); prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(r.Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		objects := make([]s3types.ObjectIdentifier, len(page.Contents))
+		for i, obj := range page.Contents {
+			objects[i] = s3types.ObjectIdentifier{Key: obj.Key}
+		}
+
+		if err := sendObjects(ctx, batches, objects); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listVersions sends every object version and delete marker under the cacher
+// namespace in batches that fit in a single DeleteObjects call.
+func (r *S3QueryCacher) listVersions(ctx context.Context, batches chan<- []s3types.ObjectIdentifier) error {
+	input := &s3.ListObjectVersionsInput{
+		Bucket:              aws.String(r.Bucket),
+		ExpectedBucketOwner: r.bucketOwner(),
+	}
+	if prefix := namespacePrefix(r.Namespace); prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	paginator := s3.NewListObjectVersionsPaginator(r.Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		objects := make([]s3types.ObjectIdentifier, 0, len(page.Versions)+len(page.DeleteMarkers))
+		for _, obj := range page.Versions {
+			objects = append(objects, s3types.ObjectIdentifier{Key: obj.Key, VersionId: obj.VersionId})
+		}
+		for _, obj := range page.DeleteMarkers {
+			objects = append(objects, s3types.ObjectIdentifier{Key: obj.Key, VersionId: obj.VersionId})
+		}
+
+		if err := sendObjects(ctx, batches, objects); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendObjects sends the objects in batches of at most 1000, the DeleteObjects
+// limit.
+func sendObjects(ctx context.Context, batches chan<- []s3types.ObjectIdentifier, objects []s3types.ObjectIdentifier) error {
+	for batch := range slices.Chunk(objects, 1000) {
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// deleteBatch deletes the objects with a single DeleteObjects call.
+func (r *S3QueryCacher) deleteBatch(ctx context.Context, objects []s3types.ObjectIdentifier) error {
+	out, err := r.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket:              aws.String(r.Bucket),
+		ExpectedBucketOwner: r.bucketOwner(),
+		Delete: &s3types.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.Errors) > 0 {
+		first := out.Errors[0]
+		return fmt.Errorf("s3: delete %s: %s", aws.ToString(first.Key), aws.ToString(first.Message))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package pgxaws
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("ResetOptions", func() {
+	It("defaults to a single segment and worker", func() {
+		var options *ResetOptions
+		Expect(options.segments()).To(Equal(1))
+		Expect(options.workers()).To(Equal(1))
+
+		options = &ResetOptions{Segments: -1}
+		Expect(options.segments()).To(Equal(1))
+		Expect(options.workers()).To(Equal(1))
+	})
+
+	It("uses the configured segments and workers", func() {
+		options := &ResetOptions{Segments: 4, Workers: 8}
+		Expect(options.segments()).To(Equal(4))
+		Expect(options.workers()).To(Equal(8))
+	})
+})
+
+var _ = Describe("resetProgress", func() {
+	It("reports the running total to the callback", func() {
+		var reported []int64
+		progress := &resetProgress{
+			callback: func(p ResetProgress) { reported = append(reported, p.Deleted) },
+		}
+
+		progress.add(25)
+		progress.add(10)
+		Expect(reported).To(Equal([]int64{25, 35}))
+	})
+
+	It("counts without a callback", func() {
+		progress := &resetProgress{}
+		progress.add(3)
+		Expect(progress.deleted.Load()).To(Equal(int64(3)))
+	})
+})
+
+var _ = Describe("backoff", func() {
+	It("returns the context error when the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Expect(backoff(ctx, 20)).To(MatchError(context.Canceled))
+	})
+
+	It("waits no longer than the base delay on the first attempt", func() {
+		start := time.Now()
+		Expect(backoff(context.Background(), 0)).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", backoffMax))
+	})
+})
+
+var _ = Describe("DynamoQueryCacher Reset", func() {
+	It("refuses to recreate a table shared by a namespace", func() {
+		cacher := &DynamoQueryCacher{
+			Table:        "queries",
+			Namespace:    "billing/prod/v3",
+			ResetOptions: &ResetOptions{Recreate: true},
+		}
+
+		err := cacher.Reset(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("billing/prod/v3")))
+	})
+
+	It("deletes every item with parallel segments and workers", func() {
+		table := os.Getenv("PGXAWS_DYNAMODB_TABLE")
+		if table == "" {
+			Skip("PGXAWS_DYNAMODB_TABLE not set")
+		}
+
+		ctx := context.Background()
+		cacher, err := NewDynamoQueryCacher(ctx, table)
+		Expect(err).NotTo(HaveOccurred())
+
+		var deleted int64
+		cacher.Namespace = "pgxaws/test/reset"
+		cacher.ResetOptions = &ResetOptions{
+			Segments: 4,
+			Workers:  4,
+			Progress: func(p ResetProgress) { deleted = p.Deleted },
+		}
+
+		item := &pgxcache.QueryItem{CommandTag: "SELECT"}
+		for i := range 60 {
+			key := &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", i)}
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		}
+
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(deleted).To(Equal(int64(60)))
+	})
+})
+
+var _ = Describe("S3QueryCacher Reset", func() {
+	It("deletes every object with concurrent workers", func() {
+		bucket := os.Getenv("PGXAWS_S3_BUCKET")
+		if bucket == "" {
+			Skip("PGXAWS_S3_BUCKET not set")
+		}
+
+		ctx := context.Background()
+		cacher, err := NewS3QueryCacher(ctx, bucket)
+		Expect(err).NotTo(HaveOccurred())
+
+		var deleted int64
+		cacher.Namespace = "pgxaws/test/reset"
+		cacher.ResetOptions = &ResetOptions{
+			Workers:  4,
+			Progress: func(p ResetProgress) { deleted = p.Deleted },
+		}
+
+		item := &pgxcache.QueryItem{CommandTag: "SELECT"}
+		for i := range 20 {
+			key := &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", i)}
+			Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		}
+
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(deleted).To(Equal(int64(20)))
+	})
+})
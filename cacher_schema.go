@@ -0,0 +1,209 @@
+package pgxaws
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoSchema describes the layout of the DynamoDB cache table, so that the
+// cacher can use existing tables. Empty fields take their default names.
+type DynamoSchema struct {
+	// PartitionKey is the name of the partition key. Defaults to "query_id".
+	PartitionKey string
+	// SortKey is the name of the sort key of a table with a composite primary
+	// key. When set, the namespace is stored in the partition key and the
+	// query key in the sort key, so that the entries of a namespace are
+	// grouped in one item collection that Reset and Entries query instead of
+	// scanning the whole table. All the entries of a namespace then share the
+	// throughput of a single partition. A cacher without namespace stores its
+	// entries in a partition of its own, named "/", and its Reset and Entries
+	// do not reach the entries of the other namespaces.
+	SortKey string
+	// Data is the name of the attribute that stores the encoded result.
+	// Defaults to "query_data".
+	Data string
+	// Size is the name of the attribute that stores the size of the encoded
+	// result. Defaults to "query_size".
+	Size string
+	// SQL is the name of the attribute that stores the text of the query (see
+	// StoreSQL). Defaults to "query_sql".
+	SQL string
+	// TTL is the name of the attribute that stores the expiration time, on
+	// which DynamoDB TTL is enabled. Defaults to "query_expire_at".
+	TTL string
+	// RefreshAt is the name of the attribute that stores the soft expiration
+	// time. Defaults to "query_refresh_at".
+	RefreshAt string
+	// Checksum is the name of the attribute that stores the checksum of the
+	// result (see Checksum). Defaults to "query_checksum".
+	Checksum string
+	// Lease is the name of the attribute that stores the token of lease lock
+	// items. Defaults to "query_lease".
+	Lease string
+	// Generation is the name of the attribute that orders the writes of an
+	// entry (see ConditionalWrites). Defaults to "query_generation".
+	Generation string
+}
+
+// rootPartition is the partition key value of the entries of a cacher without
+// namespace, when the table has a sort key. DynamoDB rejects empty key values,
+// and namespaces never consist of a single slash.
+const rootPartition = "/"
+
+// withDefaults returns a copy of the schema in which empty names are replaced
+// by their defaults.
+func (x *DynamoSchema) withDefaults() *DynamoSchema {
+	schema := &DynamoSchema{}
+	if x != nil {
+		*schema = *x
+	}
+
+	for _, attr := range []struct {
+		name  *string
+		value string
+	}{
+		{&schema.PartitionKey, "query_id"},
+		{&schema.Data, "query_data"},
+		{&schema.Size, "query_size"},
+		{&schema.SQL, "query_sql"},
+		{&schema.TTL, "query_expire_at"},
+		{&schema.RefreshAt, "query_refresh_at"},
+		{&schema.Checksum, "query_checksum"},
+		{&schema.Lease, "query_lease"},
+		{&schema.Generation, "query_generation"},
+	} {
+		if *attr.name == "" {
+			*attr.name = attr.value
+		}
+	}
+	return schema
+}
+
+// keyNames returns the names of the primary key attributes.
+func (x *DynamoSchema) keyNames() []string {
+	if x.SortKey == "" {
+		return []string{x.PartitionKey}
+	}
+	return []string{x.PartitionKey, x.SortKey}
+}
+
+// schema returns the schema of the table, with defaults applied.
+func (r *DynamoQueryCacher) schema() *DynamoSchema {
+	return r.Schema.withDefaults()
+}
+
+// partition returns the partition key value of the namespace, for tables with
+// a sort key.
+func (r *DynamoQueryCacher) partition() string {
+	if namespace := strings.Trim(r.Namespace, "/"); namespace != "" {
+		return namespace
+	}
+	return rootPartition
+}
+
+// primaryKey returns the primary key of the item with the given key within the
+// cacher namespace.
+func (r *DynamoQueryCacher) primaryKey(schema *DynamoSchema, id string) map[string]dynamodbtypes.AttributeValue {
+	if schema.SortKey == "" {
+		return map[string]dynamodbtypes.AttributeValue{
+			schema.PartitionKey: &dynamodbtypes.AttributeValueMemberS{Value: namespacePrefix(r.Namespace) + id},
+		}
+	}
+	return map[string]dynamodbtypes.AttributeValue{
+		schema.PartitionKey: &dynamodbtypes.AttributeValueMemberS{Value: r.partition()},
+		schema.SortKey:      &dynamodbtypes.AttributeValueMemberS{Value: id},
+	}
+}
+
+// itemKey returns the key within the cacher namespace of an item read from
+// the table.
+func (r *DynamoQueryCacher) itemKey(schema *DynamoSchema, item map[string]dynamodbtypes.AttributeValue) (string, error) {
+	if schema.SortKey != "" {
+		return stringAttr(schema.SortKey, item[schema.SortKey])
+	}
+
+	id, err := stringAttr(schema.PartitionKey, item[schema.PartitionKey])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(id, namespacePrefix(r.Namespace)), nil
+}
+
+// pages iterates over the pages of items in the cacher namespace, projected
+// on the given attributes and the primary key. Tables with a sort key are
+// queried; other tables are scanned in the given segment, with a filter on
+// the namespace prefix.
+func (r *DynamoQueryCacher) pages(ctx context.Context, schema *DynamoSchema, segment, segments int32, attributes ...string) iter.Seq2[[]map[string]dynamodbtypes.AttributeValue, error] {
+	// Expression attribute names avoid conflicts with DynamoDB reserved words.
+	names := map[string]string{}
+	projection := make([]string, 0, len(attributes)+2)
+	for i, name := range append(schema.keyNames(), attributes...) {
+		placeholder := fmt.Sprintf("#a%d", i)
+		names[placeholder] = name
+		projection = append(projection, placeholder)
+	}
+
+	return func(yield func([]map[string]dynamodbtypes.AttributeValue, error) bool) {
+		if schema.SortKey != "" {
+			paginator := dynamodb.NewQueryPaginator(r.Client, &dynamodb.QueryInput{
+				TableName:                aws.String(r.Table),
+				ConsistentRead:           aws.Bool(r.ConsistentRead),
+				KeyConditionExpression:   aws.String("#a0 = :partition"),
+				ProjectionExpression:     aws.String(strings.Join(projection, ", ")),
+				ExpressionAttributeNames: names,
+				ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+					":partition": &dynamodbtypes.AttributeValueMemberS{Value: r.partition()},
+				},
+			})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				if !yield(page.Items, nil) {
+					return
+				}
+			}
+			return
+		}
+
+		input := &dynamodb.ScanInput{
+			TableName:                aws.String(r.Table),
+			ConsistentRead:           aws.Bool(r.ConsistentRead),
+			ProjectionExpression:     aws.String(strings.Join(projection, ", ")),
+			ExpressionAttributeNames: names,
+		}
+		if segments > 1 {
+			input.Segment = aws.Int32(segment)
+			input.TotalSegments = aws.Int32(segments)
+		}
+		// Namespaces are encoded as a prefix of the partition key, so the
+		// scan is narrowed down with a filter. DynamoDB still reads the whole
+		// table.
+		if prefix := namespacePrefix(r.Namespace); prefix != "" {
+			input.FilterExpression = aws.String("begins_with(#a0, :prefix)")
+			input.ExpressionAttributeValues = map[string]dynamodbtypes.AttributeValue{
+				":prefix": &dynamodbtypes.AttributeValueMemberS{Value: prefix},
+			}
+		}
+
+		paginator := dynamodb.NewScanPaginator(r.Client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(page.Items, nil) {
+				return
+			}
+		}
+	}
+}
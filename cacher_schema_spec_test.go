@@ -0,0 +1,192 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+var _ = Describe("DynamoSchema", func() {
+	It("defaults every attribute name", func() {
+		var schema *DynamoSchema
+		Expect(schema.withDefaults()).To(Equal(&DynamoSchema{
+			PartitionKey: "query_id",
+			Data:         "query_data",
+			Size:         "query_size",
+			SQL:          "query_sql",
+			TTL:          "query_expire_at",
+			RefreshAt:    "query_refresh_at",
+			Checksum:     "query_checksum",
+			Lease:        "query_lease",
+			Generation:   "query_generation",
+		}))
+	})
+
+	It("keeps the names that are set", func() {
+		schema := (&DynamoSchema{PartitionKey: "pk", SortKey: "sk", TTL: "ttl"}).withDefaults()
+		Expect(schema.keyNames()).To(Equal([]string{"pk", "sk"}))
+		Expect(schema.TTL).To(Equal("ttl"))
+		Expect(schema.Data).To(Equal("query_data"))
+	})
+})
+
+var _ = Describe("DynamoQueryCacher with a composite key", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.DynamoDB
+		schema *DynamoSchema
+		cacher *DynamoQueryCacher
+		key    *pgxcache.QueryKey
+		item   *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewDynamoDB()
+		schema = &DynamoSchema{PartitionKey: "pk", SortKey: "sk", Data: "payload", TTL: "ttl"}
+		cacher = &DynamoQueryCacher{Client: client, Table: "cache", Namespace: "billing", Schema: schema, StoreSQL: true}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+
+		Expect(cacher.EnsureTable(ctx)).To(Succeed())
+		Expect(cacher.ValidateTable(ctx)).To(Succeed())
+	})
+
+	It("stores entries under the namespace partition", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		items := client.Items("cache")
+		Expect(items).To(HaveLen(1))
+		Expect(items[0]).To(HaveKeyWithValue("pk", &dynamodbtypes.AttributeValueMemberS{Value: "billing"}))
+		Expect(items[0]).To(HaveKeyWithValue("sk", &dynamodbtypes.AttributeValueMemberS{Value: key.String()}))
+		Expect(items[0]).To(HaveKey("payload"))
+		Expect(items[0]).To(HaveKey("ttl"))
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("lists and resets only its partition", func() {
+		client.PageSize = 3
+		other := &DynamoQueryCacher{Client: client, Table: "cache", Schema: schema}
+
+		for i := range 10 {
+			k := &pgxcache.QueryKey{SQL: fmt.Sprintf("SELECT %d", i)}
+			Expect(cacher.Set(ctx, k, item, time.Minute)).To(Succeed())
+		}
+		Expect(other.Set(ctx, key, item, time.Minute)).To(Succeed())
+		_, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		count := 0
+		for entry, err := range cacher.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entry.SQL).To(HavePrefix("SELECT "))
+			count++
+		}
+		Expect(count).To(Equal(10))
+
+		cacher.ResetOptions = &ResetOptions{Segments: 4, Workers: 2}
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(client.Items("cache")).To(HaveLen(1))
+
+		got, err := other.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+	})
+
+	It("keeps a cacher without namespace to its own partition", func() {
+		other := &DynamoQueryCacher{Client: client, Table: "cache", Schema: schema}
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(other.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		count := 0
+		for _, err := range other.Entries(ctx) {
+			Expect(err).NotTo(HaveOccurred())
+			count++
+		}
+		Expect(count).To(Equal(1))
+
+		Expect(other.Reset(ctx)).To(Succeed())
+		Expect(client.Items("cache")).To(HaveLen(1))
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+
+		// Recreating the table drops every namespace.
+		other.ResetOptions = &ResetOptions{Recreate: true}
+		Expect(other.Reset(ctx)).To(Succeed())
+		Expect(client.Items("cache")).To(BeEmpty())
+	})
+
+	It("hands out leases", func() {
+		token, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).NotTo(BeEmpty())
+
+		other, err := cacher.AcquireLease(ctx, key, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeEmpty())
+
+		Expect(cacher.ReleaseLease(ctx, key, token)).To(Succeed())
+		Expect(client.Items("cache")).To(BeEmpty())
+	})
+})
+
+var _ = Describe("ValidateTable", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.DynamoDB
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewDynamoDB()
+
+		_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName: aws.String("cache"),
+			AttributeDefinitions: []dynamodbtypes.AttributeDefinition{
+				{AttributeName: aws.String("id"), AttributeType: dynamodbtypes.ScalarAttributeTypeS},
+			},
+			KeySchema: []dynamodbtypes.KeySchemaElement{
+				{AttributeName: aws.String("id"), KeyType: dynamodbtypes.KeyTypeHash},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("accepts an existing table described by the schema", func() {
+		_, err := client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String("cache"),
+			TimeToLiveSpecification: &dynamodbtypes.TimeToLiveSpecification{
+				AttributeName: aws.String("expires"),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		cacher := &DynamoQueryCacher{Client: client, Table: "cache", Schema: &DynamoSchema{PartitionKey: "id", TTL: "expires"}}
+		Expect(cacher.ValidateTable(ctx)).To(Succeed())
+	})
+
+	It("reports a different key schema and disabled TTL", func() {
+		cacher := &DynamoQueryCacher{Client: client, Table: "cache", Schema: &DynamoSchema{PartitionKey: "pk", SortKey: "sk"}}
+
+		var derr *DriftError
+		Expect(errors.As(cacher.ValidateTable(ctx), &derr)).To(BeTrue())
+		Expect(derr.Issues).To(ConsistOf(
+			`hash key is "id" instead of "pk"`,
+			`missing range key "sk"`,
+			`TTL is not enabled on "query_expire_at"`,
+		))
+		Expect(client.Items("cache")).To(BeEmpty())
+	})
+})
@@ -69,6 +69,27 @@ var _ = Describe("DynamoQueryCacher", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(got).To(BeNil())
 		})
+
+		It("Reset only removes items in the cacher namespace", func() {
+			ours := &DynamoQueryCacher{Client: cacher.Client, Table: cacher.Table, Namespace: "pgxaws/test/ours"}
+			theirs := &DynamoQueryCacher{Client: cacher.Client, Table: cacher.Table, Namespace: "pgxaws/test/theirs"}
+
+			item := &pgxcache.QueryItem{CommandTag: "SELECT"}
+			Expect(ours.Set(ctx, key, item, time.Minute)).To(Succeed())
+			Expect(theirs.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+			Expect(ours.Reset(ctx)).To(Succeed())
+
+			got, err := ours.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(BeNil())
+
+			got, err = theirs.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).NotTo(BeNil())
+
+			Expect(theirs.Reset(ctx)).To(Succeed())
+		})
 	})
 })
 
@@ -142,5 +163,46 @@ var _ = Describe("S3QueryCacher", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(got).To(BeNil())
 		})
+
+		It("Reset only removes objects under the cacher namespace", func() {
+			ours := &S3QueryCacher{Client: cacher.Client, Bucket: cacher.Bucket, Namespace: "pgxaws/test/ours"}
+			theirs := &S3QueryCacher{Client: cacher.Client, Bucket: cacher.Bucket, Namespace: "pgxaws/test/theirs"}
+
+			item := &pgxcache.QueryItem{CommandTag: "SELECT"}
+			Expect(ours.Set(ctx, key, item, time.Minute)).To(Succeed())
+			Expect(theirs.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+			Expect(ours.Reset(ctx)).To(Succeed())
+
+			got, err := ours.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(BeNil())
+
+			got, err = theirs.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).NotTo(BeNil())
+
+			Expect(theirs.Reset(ctx)).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("namespaceKey", func() {
+	key := &pgxcache.QueryKey{SQL: "SELECT 1"}
+
+	It("returns the plain key when no namespace is set", func() {
+		Expect(namespaceKey("", key)).To(Equal(key.String()))
+	})
+
+	It("prefixes the key with the namespace", func() {
+		Expect(namespaceKey("billing/prod/v3", key)).To(Equal("billing%2Fprod%2Fv3/" + key.String()))
+	})
+
+	It("never nests the keys of one namespace under another", func() {
+		Expect(namespaceKey("billing/prod/v3", key)).NotTo(HavePrefix(namespacePrefix("billing/prod")))
+	})
+
+	It("ignores leading and trailing slashes in the namespace", func() {
+		Expect(namespaceKey("/billing/prod/v3/", key)).To(Equal("billing%2Fprod%2Fv3/" + key.String()))
 	})
 })
@@ -0,0 +1,441 @@
+package pgxaws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// framedMagic starts every item encoded by FramedCodec.
+const framedMagic = "\x00PGXF"
+
+// framedVersion is the version of the framed format written by FramedCodec.
+const framedVersion = 1
+
+// framedFrameSize is the default size of the row frames of FramedCodec.
+const framedFrameSize = 1 << 20
+
+// multipartPartSize is the default size of the parts uploaded by Set.
+const multipartPartSize = 8 << 20
+
+// multipartMinPartSize is the minimum size of every part of a multipart upload
+// but the last one.
+const multipartMinPartSize = 5 << 20
+
+// errFrameChecksum is returned when a frame does not match its checksum.
+var errFrameChecksum = errors.New("pgxaws: framed query item checksum mismatch")
+
+// QueryStreamCodec is a QueryCodec that also encodes items to a writer and
+// decodes them from a reader, so that the encoded item is never held in
+// memory as a whole. S3QueryCacher streams the items of such codecs to S3.
+type QueryStreamCodec interface {
+	QueryCodec
+	// Encode writes the encoded item to w.
+	Encode(w io.Writer, item *pgxcache.QueryItem) error
+	// Decode reads an encoded item from r into the item.
+	Decode(r io.Reader, item *pgxcache.QueryItem) error
+}
+
+var _ QueryStreamCodec = FramedCodec{}
+
+// FramedCodec encodes cache items in a chunked variant of the BinaryCodec
+// format, meant for very large results. It is a QueryStreamCodec.
+//
+// The format starts with a magic string and a version byte, followed by
+// frames: one with the command tag and the field descriptions, then frames
+// of rows of about FrameSize bytes each, then an empty frame that marks the
+// end of the item. Every frame is prefixed by its length and followed by its
+// CRC32C checksum, so that a corrupted or truncated item is detected as soon
+// as the damaged frame is read.
+//
+// Unmarshal and Decode also decode items encoded by the other built-in
+// codecs, and the other built-in codecs decode items encoded by FramedCodec.
+type FramedCodec struct {
+	// FrameSize is the approximate size of the row frames. A frame holds at
+	// least one row. Defaults to 1 MiB.
+	FrameSize int
+}
+
+// Marshal encodes the item in the framed format.
+func (x FramedCodec) Marshal(item *pgxcache.QueryItem) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := x.Encode(buf, item); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes data encoded by any built-in codec into the item.
+func (FramedCodec) Unmarshal(data []byte, item *pgxcache.QueryItem) error {
+	return unmarshalItem(data, item)
+}
+
+// Encode writes the item to w in the framed format, one frame at a time.
+func (x FramedCodec) Encode(w io.Writer, item *pgxcache.QueryItem) error {
+	size := x.FrameSize
+	if size <= 0 {
+		size = framedFrameSize
+	}
+
+	if _, err := w.Write(append([]byte(framedMagic), framedVersion)); err != nil {
+		return err
+	}
+
+	frame := appendString(nil, item.CommandTag)
+	frame = appendFields(frame, item.Fields)
+	if err := writeFrame(w, frame); err != nil {
+		return err
+	}
+
+	// Row frames start with their number of rows, which is only known once
+	// the frame is full.
+	var (
+		rows  []byte
+		count int
+	)
+	for _, row := range item.Rows {
+		rows = appendRow(rows, row)
+		count++
+		if len(rows) < size {
+			continue
+		}
+		if err := writeFrame(w, append(binary.AppendUvarint(frame[:0], uint64(count)), rows...)); err != nil {
+			return err
+		}
+		rows, count = rows[:0], 0
+	}
+	if count > 0 {
+		if err := writeFrame(w, append(binary.AppendUvarint(frame[:0], uint64(count)), rows...)); err != nil {
+			return err
+		}
+	}
+
+	return writeFrame(w, nil)
+}
+
+// Decode reads an item encoded by any built-in codec from r. Framed items
+// are decoded one frame at a time; other items are read as a whole.
+func (FramedCodec) Decode(r io.Reader, item *pgxcache.QueryItem) error {
+	body := bufio.NewReader(r)
+	if magic, _ := body.Peek(len(framedMagic)); string(magic) == framedMagic {
+		return decodeFramed(body, item)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return unmarshalItem(data, item)
+}
+
+// writeFrame writes a frame: the length of the payload, the payload and its
+// checksum.
+func writeFrame(w io.Writer, payload []byte) error {
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(payload)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(payload, crc32cTable)))
+	return err
+}
+
+// decodeFramed decodes a framed item from r. The values of the item share
+// memory with the frames, which are allocated as they are read.
+func decodeFramed(r io.Reader, item *pgxcache.QueryItem) error {
+	body := bufio.NewReader(r)
+
+	header := make([]byte, len(framedMagic)+1)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return truncated(err)
+	}
+	if string(header[:len(framedMagic)]) != framedMagic {
+		return errors.New("pgxaws: not a framed query item")
+	}
+	if version := header[len(framedMagic)]; version != framedVersion {
+		return fmt.Errorf("pgxaws: unsupported framed query item version %d", version)
+	}
+
+	frame, err := readFrame(body)
+	if err != nil {
+		return err
+	}
+	first := &binaryReader{data: frame}
+	item.CommandTag = first.string()
+	item.Fields = first.fields()
+	if err := first.end(); err != nil {
+		return err
+	}
+
+	item.Rows = nil
+	for {
+		frame, err := readFrame(body)
+		if err != nil {
+			return err
+		}
+		if len(frame) == 0 {
+			break
+		}
+
+		rows := &binaryReader{data: frame}
+		for range rows.count(1) {
+			item.Rows = append(item.Rows, rows.row())
+		}
+		if err := rows.end(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := body.ReadByte(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return errors.New("pgxaws: trailing bytes after framed query item")
+	}
+	return nil
+}
+
+// readFrame reads a frame and verifies its checksum. The payload is read as
+// it arrives, so that a corrupted length cannot allocate more memory than the
+// data that follows.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+
+	payload := &bytes.Buffer{}
+	if _, err := io.CopyN(payload, r, int64(n)); err != nil {
+		return nil, truncated(err)
+	}
+
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return nil, truncated(err)
+	}
+	if binary.BigEndian.Uint32(sum) != crc32.Checksum(payload.Bytes(), crc32cTable) {
+		return nil, errFrameChecksum
+	}
+	return payload.Bytes(), nil
+}
+
+// truncated maps the end of a stream in the middle of an item to
+// errBinaryTruncated. Other errors are returned unchanged.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errBinaryTruncated
+	}
+	return err
+}
+
+// end returns the error of the reader, or an error when data is left.
+func (x *binaryReader) end() error {
+	if x.err == nil && len(x.data) > 0 {
+		return fmt.Errorf("pgxaws: %d trailing bytes in query item frame", len(x.data))
+	}
+	return x.err
+}
+
+// readStream decodes the framed item that body starts with into the entry,
+// verifying the stored checksum as the body is read. Corrupted entries are
+// deleted and reported as missing.
+func (r *S3QueryCacher) readStream(ctx context.Context, id string, etag *string, checksum string, body io.Reader, entry *QueryEntry) (*QueryEntry, error) {
+	counter := &countingReader{reader: body}
+	verify := &checksumReader{reader: counter, checksum: checksum}
+
+	entry.Item = &pgxcache.QueryItem{}
+	err := decodeFramed(verify, entry.Item)
+	recordStats(ctx, func(stats *cacheStats) { stats.bytesRead += counter.count })
+
+	switch {
+	case errors.Is(err, errFrameChecksum), errors.Is(err, errBinaryTruncated), err == nil && !verify.verify():
+		r.deleteCorrupt(ctx, id, etag)
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	entry.Size = counter.count
+	return entry, nil
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+// Read reads from the underlying reader.
+func (x *countingReader) Read(p []byte) (int, error) {
+	n, err := x.reader.Read(p)
+	x.count += int64(n)
+	return n, err
+}
+
+// streamEntry encodes the item straight into the parts of an upload, so that
+// at most one part is held in memory. Items that fit in a single part are
+// stored with PutObject and get a checksum in their metadata; larger items
+// rely on the checksums of their frames.
+func (r *S3QueryCacher) streamEntry(ctx context.Context, id string, metadata map[string]string, codec QueryStreamCodec, item *pgxcache.QueryItem) error {
+	upload := &multipartUpload{
+		ctx:      ctx,
+		cacher:   r,
+		id:       id,
+		metadata: metadata,
+		part:     make([]byte, 0, r.partSize()),
+	}
+	if err := codec.Encode(upload, item); err != nil {
+		upload.abort()
+		return err
+	}
+	if err := upload.complete(); err != nil {
+		upload.abort()
+		return err
+	}
+	return nil
+}
+
+// partSize returns the size of the parts uploaded by Set.
+func (r *S3QueryCacher) partSize() int {
+	if r.PartSize <= 0 {
+		return multipartPartSize
+	}
+	return max(r.PartSize, multipartMinPartSize)
+}
+
+// multipartUpload is an io.Writer that uploads what is written to it in
+// parts. The multipart upload is only created once the first part is full.
+type multipartUpload struct {
+	ctx      context.Context
+	cacher   *S3QueryCacher
+	id       string
+	metadata map[string]string
+	// part is the part being written, whose capacity is the part size.
+	part     []byte
+	uploadID *string
+	parts    []s3types.CompletedPart
+	size     int64
+}
+
+// Write appends p to the current part, uploading the part whenever it is
+// full.
+func (x *multipartUpload) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := copy(x.part[len(x.part):cap(x.part)], p)
+		x.part = x.part[:len(x.part)+n]
+		p = p[n:]
+
+		if len(x.part) == cap(x.part) {
+			if err := x.upload(); err != nil {
+				return written - len(p), err
+			}
+		}
+	}
+	return written, nil
+}
+
+// upload uploads the current part, creating the multipart upload first if
+// needed.
+func (x *multipartUpload) upload() error {
+	r := x.cacher
+
+	body := x.part
+	if x.uploadID == nil {
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:              aws.String(r.Bucket),
+			Key:                 aws.String(x.id),
+			ExpectedBucketOwner: r.bucketOwner(),
+			StorageClass:        r.StorageClass,
+			Tagging:             r.tagging(),
+		}
+		r.Encryption.applyCreate(input)
+		if r.directory() {
+			body = append(appendObjectHeader(nil, x.metadata), body...)
+		} else {
+			input.Metadata = x.metadata
+		}
+
+		out, err := r.Client.CreateMultipartUpload(x.ctx, input)
+		if err != nil {
+			return err
+		}
+		x.uploadID = out.UploadId
+	}
+
+	number := aws.Int32(int32(len(x.parts) + 1))
+	input := &s3.UploadPartInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(x.id),
+		UploadId:            x.uploadID,
+		PartNumber:          number,
+		Body:                bytes.NewReader(body),
+		ContentLength:       aws.Int64(int64(len(body))),
+		ExpectedBucketOwner: r.bucketOwner(),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = r.Encryption.customerKey()
+
+	out, err := r.Client.UploadPart(x.ctx, input)
+	if err != nil {
+		return err
+	}
+	x.parts = append(x.parts, s3types.CompletedPart{ETag: out.ETag, PartNumber: number})
+	x.size += int64(len(body))
+	x.part = x.part[:0]
+	return nil
+}
+
+// complete uploads the last part and completes the multipart upload, or
+// stores the item with PutObject when it fits in a single part.
+func (x *multipartUpload) complete() error {
+	if x.uploadID == nil {
+		return x.cacher.putEntry(x.ctx, x.id, x.metadata, x.part)
+	}
+
+	if len(x.part) > 0 {
+		if err := x.upload(); err != nil {
+			return err
+		}
+	}
+
+	r := x.cacher
+	_, err := r.Client.CompleteMultipartUpload(x.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(x.id),
+		UploadId:            x.uploadID,
+		MultipartUpload:     &s3types.CompletedMultipartUpload{Parts: x.parts},
+		ExpectedBucketOwner: r.bucketOwner(),
+	})
+	if err == nil {
+		recordStats(x.ctx, func(stats *cacheStats) { stats.bytesWritten += x.size })
+	}
+	return err
+}
+
+// abort aborts the multipart upload, if any, even when the context of the
+// upload is done. Errors are ignored: the parts of uploads that could not be
+// aborted are removed by the lifecycle rule of EnsureBucket.
+func (x *multipartUpload) abort() {
+	if x.uploadID == nil {
+		return
+	}
+
+	r := x.cacher
+	_, _ = r.Client.AbortMultipartUpload(context.WithoutCancel(x.ctx), &s3.AbortMultipartUploadInput{
+		Bucket:              aws.String(r.Bucket),
+		Key:                 aws.String(x.id),
+		UploadId:            x.uploadID,
+		ExpectedBucketOwner: r.bucketOwner(),
+	})
+}
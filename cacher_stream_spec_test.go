@@ -0,0 +1,227 @@
+package pgxaws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jackc/pgx/v5/pgconn"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxaws/pgxawstest"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// largeItem returns an item of about size bytes, in rows of 1 KiB.
+func largeItem(size int) *pgxcache.QueryItem {
+	item := &pgxcache.QueryItem{
+		CommandTag: fmt.Sprintf("SELECT %d", size>>10),
+		Fields:     []pgconn.FieldDescription{{Name: "data", DataTypeOID: 17, DataTypeSize: -1, TypeModifier: -1, Format: 1}},
+	}
+	for i := range size >> 10 {
+		item.Rows = append(item.Rows, [][]byte{bytes.Repeat([]byte{byte(i)}, 1<<10)})
+	}
+	return item
+}
+
+var _ = Describe("FramedCodec", func() {
+	var (
+		codec FramedCodec
+		item  *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		codec = FramedCodec{FrameSize: 64}
+		item = &pgxcache.QueryItem{
+			CommandTag: "SELECT 3",
+			Fields: []pgconn.FieldDescription{
+				{Name: "id", TableOID: 16384, TableAttributeNumber: 1, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1, Format: 1},
+				{Name: "name", TableOID: 16384, TableAttributeNumber: 2, DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1},
+			},
+		}
+		for i := range 20 {
+			item.Rows = append(item.Rows, [][]byte{{0, 0, 0, byte(i)}, fmt.Appendf(nil, "user %d", i)})
+		}
+		item.Rows = append(item.Rows, [][]byte{{0, 0, 0, 20}, nil}, [][]byte{{0, 0, 0, 21}, {}})
+	})
+
+	It("round-trips items over several frames", func() {
+		buf := &bytes.Buffer{}
+		Expect(codec.Encode(buf, item)).To(Succeed())
+
+		got := &pgxcache.QueryItem{}
+		Expect(codec.Decode(bytes.NewReader(buf.Bytes()), got)).To(Succeed())
+		Expect(got).To(Equal(item))
+		Expect(got.Rows[20][1]).To(BeNil())
+		Expect(got.Rows[21][1]).NotTo(BeNil())
+
+		data, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(buf.Bytes()))
+	})
+
+	It("decodes items of the other built-in codecs, and the other way round", func() {
+		for _, other := range []QueryCodec{TextCodec{}, BinaryCodec{}} {
+			data, err := other.Marshal(item)
+			Expect(err).NotTo(HaveOccurred())
+
+			got := &pgxcache.QueryItem{}
+			Expect(codec.Decode(bytes.NewReader(data), got)).To(Succeed())
+			Expect(got.CommandTag).To(Equal(item.CommandTag))
+			Expect(got.Rows).To(HaveLen(len(item.Rows)))
+
+			data, err = codec.Marshal(item)
+			Expect(err).NotTo(HaveOccurred())
+
+			got = &pgxcache.QueryItem{}
+			Expect(other.Unmarshal(data, got)).To(Succeed())
+			Expect(got).To(Equal(item))
+		}
+	})
+
+	It("detects corrupted and truncated frames", func() {
+		data, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+
+		corrupted := bytes.Clone(data)
+		corrupted[len(corrupted)/2] ^= 0xff
+		err = codec.Unmarshal(corrupted, &pgxcache.QueryItem{})
+		Expect(err).To(HaveOccurred())
+
+		for n := len(framedMagic); n < len(data); n++ {
+			err := codec.Unmarshal(data[:n], &pgxcache.QueryItem{})
+			Expect(errors.Is(err, errBinaryTruncated) || errors.Is(err, errFrameChecksum)).To(BeTrue(), "truncated at %d: %v", n, err)
+		}
+		Expect(codec.Unmarshal(append(data, 0), &pgxcache.QueryItem{})).To(HaveOccurred())
+	})
+
+	It("rejects unknown versions", func() {
+		data, err := codec.Marshal(item)
+		Expect(err).NotTo(HaveOccurred())
+		data[len(framedMagic)] = framedVersion + 1
+
+		err = codec.Unmarshal(data, &pgxcache.QueryItem{})
+		Expect(err).To(MatchError(ContainSubstring("unsupported framed query item version")))
+	})
+})
+
+// failingS3 fails the uploads of parts after the first one.
+type failingS3 struct {
+	*pgxawstest.S3
+}
+
+// UploadPart fails for every part but the first.
+func (x *failingS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if aws.ToInt32(params.PartNumber) > 1 {
+		return nil, errors.New("connection reset")
+	}
+	return x.S3.UploadPart(ctx, params, optFns...)
+}
+
+var _ = Describe("S3QueryCacher streaming", func() {
+	var (
+		ctx    context.Context
+		client *pgxawstest.S3
+		cacher *S3QueryCacher
+		key    *pgxcache.QueryKey
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = pgxawstest.NewS3()
+		cacher = &S3QueryCacher{Client: client, Bucket: "queries", Codec: FramedCodec{}, Checksum: ChecksumCRC32C}
+		key = &pgxcache.QueryKey{SQL: "SELECT * FROM exports"}
+
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+	})
+
+	It("stores items that fit in a part with a single upload", func() {
+		item := largeItem(64 << 10)
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		head, err := cacher.headObject(ctx, client.Keys("queries")[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(aws.ToString(head.ETag)).NotTo(ContainSubstring("-"))
+		Expect(head.Metadata).To(HaveKey(metaKeyChecksum))
+
+		Expect(cacher.Get(ctx, key)).To(Equal(item))
+	})
+
+	It("uploads and reads large items in parts", func() {
+		var events []*CacheEvent
+		instrumented := &InstrumentedQueryCacher{
+			Cacher: cacher,
+			Observer: CacheObserverFunc(func(_ context.Context, event *CacheEvent) {
+				events = append(events, event)
+			}),
+		}
+
+		item := largeItem(12 << 20)
+		Expect(instrumented.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		head, err := cacher.headObject(ctx, client.Keys("queries")[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(aws.ToString(head.ETag)).To(HaveSuffix(`-2"`))
+		Expect(head.Metadata).NotTo(HaveKey(metaKeyChecksum))
+		Expect(client.Uploads("queries")).To(BeEmpty())
+
+		// a cacher with another codec reads the entry too
+		reader := &S3QueryCacher{Client: client, Bucket: "queries"}
+		Expect(reader.Get(ctx, key)).To(Equal(item))
+
+		Expect(instrumented.Get(ctx, key)).To(Equal(item))
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].BytesWritten).To(Equal(head.Size))
+		Expect(events[1].BytesRead).To(Equal(head.Size))
+	})
+
+	It("stores large items in directory buckets with their header", func() {
+		cacher.Bucket = "cache--use1-az4--x-s3"
+		Expect(cacher.EnsureBucket(ctx, time.Hour)).To(Succeed())
+
+		item := largeItem(6 << 20)
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		entry, err := cacher.GetEntry(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Item).To(Equal(item))
+		Expect(entry.ExpireAt).NotTo(BeZero())
+	})
+
+	It("aborts the upload when a part fails", func() {
+		cacher.Client = &failingS3{S3: client}
+
+		err := cacher.Set(ctx, key, largeItem(12<<20), time.Minute)
+		Expect(err).To(MatchError("connection reset"))
+		Expect(client.Uploads("queries")).To(BeEmpty())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+
+	It("deletes corrupted items and reports them as missing", func() {
+		Expect(cacher.Set(ctx, key, largeItem(12<<20), time.Minute)).To(Succeed())
+		id := client.Keys("queries")[0]
+
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("queries"), Key: aws.String(id)})
+		Expect(err).NotTo(HaveOccurred())
+		data := &bytes.Buffer{}
+		_, err = data.ReadFrom(out.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		corrupted := data.Bytes()
+		corrupted[len(corrupted)/2] ^= 0xff
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String("queries"),
+			Key:      aws.String(id),
+			Body:     bytes.NewReader(corrupted),
+			Metadata: out.Metadata,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cacher.Get(ctx, key)).To(BeNil())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,169 @@
+package pgxaws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+const (
+	// tieredMaxCost is the default size of the in-process cache in bytes.
+	tieredMaxCost = 64 << 20
+	// tieredMaxLifetime is the default maximum in-process lifetime of an item.
+	tieredMaxLifetime = time.Minute
+)
+
+var _ pgxcache.QueryCacher = &TieredQueryCacher{}
+
+// TieredQueryCacher implements pgxcache.QueryCacher interface with a bounded
+// in-process cache (L1) in front of another cacher (L2), such as
+// DynamoQueryCacher or S3QueryCacher. Hot items are served from memory without
+// a network round trip.
+//
+// Items are written through to both tiers on Set. The in-process cache of one
+// process is not invalidated by writes made by other processes, so an item
+// may be served from memory for up to MaxLifetime after it was replaced in L2.
+type TieredQueryCacher struct {
+	// Cacher is the shared cache behind the in-process cache.
+	Cacher pgxcache.QueryCacher
+	// MaxCost is the maximum total size in bytes of the items kept in
+	// process. Less recently and frequently used items are evicted first.
+	// Defaults to 64 MiB.
+	MaxCost int64
+	// MaxLifetime is the maximum time an item is kept in process. Items are
+	// never kept longer than their remaining lifetime in Cacher when it
+	// implements QueryEntryCacher. Defaults to 1 minute.
+	MaxLifetime time.Duration
+
+	once  sync.Once
+	cache *ristretto.Cache[string, *pgxcache.QueryItem]
+	err   error
+}
+
+// Get retrieves a cache item from memory, or from Cacher on a miss.
+func (r *TieredQueryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	cache, err := r.local()
+	if err != nil {
+		return nil, err
+	}
+
+	id := key.String()
+	if item, ok := cache.Get(id); ok {
+		return item, nil
+	}
+
+	var (
+		item     *pgxcache.QueryItem
+		lifetime = r.maxLifetime()
+	)
+
+	if cacher, ok := r.Cacher.(QueryEntryCacher); ok {
+		entry, err := cacher.GetEntry(ctx, key)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		// Respect the remaining lifetime of the entry in the backend.
+		if !entry.ExpireAt.IsZero() {
+			lifetime = min(lifetime, time.Until(entry.ExpireAt))
+		}
+		if lifetime <= 0 {
+			return nil, nil
+		}
+		item = entry.Item
+	} else {
+		item, err = r.Cacher.Get(ctx, key)
+		if err != nil || item == nil {
+			return nil, err
+		}
+	}
+
+	r.store(cache, id, item, lifetime)
+	return item, nil
+}
+
+// Set stores a cache item in Cacher and then in memory.
+func (r *TieredQueryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	cache, err := r.local()
+	if err != nil {
+		return err
+	}
+
+	if err := r.Cacher.Set(ctx, key, item, lifetime); err != nil {
+		return err
+	}
+
+	r.store(cache, key.String(), item, min(lifetime, r.maxLifetime()))
+	return nil
+}
+
+// Reset resets both the in-process cache and Cacher.
+func (r *TieredQueryCacher) Reset(ctx context.Context) error {
+	cache, err := r.local()
+	if err != nil {
+		return err
+	}
+
+	cache.Clear()
+	err = r.Cacher.Reset(ctx)
+	// Drop the items that concurrent calls to Get loaded from Cacher while it
+	// was being reset.
+	cache.Clear()
+	return err
+}
+
+// local returns the in-process cache, creating it on first use.
+func (r *TieredQueryCacher) local() (*ristretto.Cache[string, *pgxcache.QueryItem], error) {
+	r.once.Do(func() {
+		cost := r.MaxCost
+		if cost <= 0 {
+			cost = tieredMaxCost
+		}
+
+		r.cache, r.err = ristretto.NewCache(&ristretto.Config[string, *pgxcache.QueryItem]{
+			// Ristretto recommends 10 counters per item; assume items of at
+			// least 1 KiB on average.
+			NumCounters: max(10_000, cost/1024*10),
+			MaxCost:     cost,
+			BufferItems: 64,
+		})
+	})
+	return r.cache, r.err
+}
+
+// store keeps the item in memory for the given lifetime.
+func (r *TieredQueryCacher) store(cache *ristretto.Cache[string, *pgxcache.QueryItem], id string, item *pgxcache.QueryItem, lifetime time.Duration) {
+	if lifetime <= 0 {
+		return
+	}
+
+	cache.SetWithTTL(id, item, max(1, itemSize(item)), lifetime)
+	// Sets are buffered; wait so the item is visible to the next Get.
+	cache.Wait()
+}
+
+// maxLifetime returns the maximum in-process lifetime of an item.
+func (r *TieredQueryCacher) maxLifetime() time.Duration {
+	if r.MaxLifetime <= 0 {
+		return tieredMaxLifetime
+	}
+	return r.MaxLifetime
+}
+
+// itemSize estimates the memory used by the item in bytes.
+func itemSize(item *pgxcache.QueryItem) int64 {
+	size := int64(len(item.CommandTag))
+	for _, field := range item.Fields {
+		// Name plus the fixed-size attributes of the field description.
+		size += int64(len(field.Name)) + 20
+	}
+	for _, row := range item.Rows {
+		for _, value := range row {
+			// Value plus the slice header.
+			size += int64(len(value)) + 24
+		}
+	}
+	return size
+}
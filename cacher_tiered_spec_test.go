@@ -0,0 +1,175 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// entryCacher is an in-memory QueryEntryCacher that counts backend calls.
+type entryCacher struct {
+	mu      sync.Mutex
+	entries map[string]*QueryEntry
+	gets    int
+	resets  int
+	err     error
+}
+
+func newEntryCacher() *entryCacher {
+	return &entryCacher{entries: map[string]*QueryEntry{}}
+}
+
+func (x *entryCacher) Get(ctx context.Context, key *pgxcache.QueryKey) (*pgxcache.QueryItem, error) {
+	entry, err := x.GetEntry(ctx, key)
+	if err != nil || entry == nil || entry.Expired() {
+		return nil, err
+	}
+	return entry.Item, nil
+}
+
+func (x *entryCacher) GetEntry(_ context.Context, key *pgxcache.QueryKey) (*QueryEntry, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.gets++
+	if x.err != nil {
+		return nil, x.err
+	}
+	return x.entries[key.String()], nil
+}
+
+func (x *entryCacher) Set(ctx context.Context, key *pgxcache.QueryKey, item *pgxcache.QueryItem, lifetime time.Duration) error {
+	return x.SetEntry(ctx, key, &QueryEntry{Item: item, ExpireAt: time.Now().Add(lifetime)})
+}
+
+func (x *entryCacher) SetEntry(_ context.Context, key *pgxcache.QueryKey, entry *QueryEntry) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.err != nil {
+		return x.err
+	}
+	x.entries[key.String()] = entry
+	return nil
+}
+
+func (x *entryCacher) Reset(context.Context) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.resets++
+	clear(x.entries)
+	return x.err
+}
+
+var _ = Describe("TieredQueryCacher", func() {
+	var (
+		ctx     context.Context
+		backend *entryCacher
+		cacher  *TieredQueryCacher
+		key     *pgxcache.QueryKey
+		item    *pgxcache.QueryItem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = newEntryCacher()
+		cacher = &TieredQueryCacher{Cacher: backend}
+		key = &pgxcache.QueryKey{SQL: "SELECT 1"}
+		item = &pgxcache.QueryItem{CommandTag: "SELECT 1", Rows: [][][]byte{{[]byte("1")}}}
+	})
+
+	It("returns nil for a missing key", func() {
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("serves items written with Set from memory", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(item))
+		Expect(backend.gets).To(Equal(0))
+	})
+
+	It("writes through to the backend on Set", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(backend.entries).To(HaveKey(key.String()))
+	})
+
+	It("promotes backend hits to memory", func() {
+		Expect(backend.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		for range 3 {
+			got, err := cacher.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(item))
+		}
+		Expect(backend.gets).To(Equal(1))
+	})
+
+	It("does not keep items in memory beyond their backend lifetime", func() {
+		Expect(backend.Set(ctx, key, item, 50*time.Millisecond)).To(Succeed())
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).NotTo(BeNil())
+
+		Eventually(func() (*pgxcache.QueryItem, error) {
+			return cacher.Get(ctx, key)
+		}).Should(BeNil())
+	})
+
+	It("treats expired backend entries as missing", func() {
+		backend.entries[key.String()] = &QueryEntry{Item: item, ExpireAt: time.Now().Add(-time.Second)}
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("fronts cachers that do not expose entries", func() {
+		cacher.Cacher = pgxcache.NewMemoryQueryCacher()
+		Expect(cacher.Cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+
+		// MemoryQueryCacher applies sets asynchronously.
+		Eventually(func() (*pgxcache.QueryItem, error) {
+			return cacher.Get(ctx, key)
+		}).Should(HaveField("CommandTag", "SELECT 1"))
+	})
+
+	It("resets both tiers", func() {
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(Succeed())
+		Expect(cacher.Reset(ctx)).To(Succeed())
+		Expect(backend.resets).To(Equal(1))
+
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+
+	It("does not keep items in memory when the backend write fails", func() {
+		backend.err = errors.New("unavailable")
+		Expect(cacher.Set(ctx, key, item, time.Minute)).To(MatchError("unavailable"))
+
+		backend.err = nil
+		got, err := cacher.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(BeNil())
+	})
+})
+
+var _ = Describe("itemSize", func() {
+	It("accounts for the size of every value", func() {
+		small := &pgxcache.QueryItem{Rows: [][][]byte{{[]byte("a")}}}
+		large := &pgxcache.QueryItem{Rows: [][][]byte{{make([]byte, 1024)}}}
+		Expect(itemSize(large) - itemSize(small)).To(Equal(int64(1023)))
+	})
+})
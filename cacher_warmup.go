@@ -0,0 +1,190 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pgx-contrib/pgxcache"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/sync/errgroup"
+)
+
+// warmupWorkers is the default number of queries run concurrently by Warm.
+const warmupWorkers = 4
+
+// WarmupQuery is a query whose result is stored by QueryWarmer.
+type WarmupQuery struct {
+	// SQL is the text of the query, exactly as the application runs it, as
+	// it is part of the cache key.
+	SQL string `yaml:"sql"`
+	// Args are the arguments of the query. They are part of the cache key
+	// too, so they must have the types the application passes: ints and
+	// int64s are interchangeable, but other integer types are not.
+	Args []any `yaml:"args,omitempty"`
+	// TTL is the lifetime of the result. It defaults to the
+	// @cache-max-lifetime option of the query, and then to the MaxLifetime of
+	// the warmer.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+// WarmupManifest is a list of queries to warm up, as read by
+// LoadWarmupManifest.
+type WarmupManifest struct {
+	// TTL is the lifetime of the results of the queries that have none.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// Queries are the queries to warm up.
+	Queries []*WarmupQuery `yaml:"queries"`
+}
+
+// ParseWarmupManifest parses a manifest in YAML or JSON:
+//
+//	ttl: 10m
+//	queries:
+//	  - sql: SELECT * FROM customer WHERE region = $1
+//	    args: [eu]
+//	  - sql: SELECT count(*) FROM orders
+//	    ttl: 1m
+//
+// Lifetimes are durations such as "90s" or "1h". Integer arguments are
+// decoded as ints, and other numbers as float64s. The TTL of the manifest is
+// copied to the queries that have none.
+func ParseWarmupManifest(data []byte) (*WarmupManifest, error) {
+	manifest := &WarmupManifest{}
+	if err := yaml.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("pgxaws: invalid warm-up manifest: %w", err)
+	}
+
+	for i, query := range manifest.Queries {
+		if query == nil || query.SQL == "" {
+			return nil, fmt.Errorf("pgxaws: invalid warm-up manifest: query %d has no sql", i)
+		}
+		if query.TTL == 0 {
+			query.TTL = manifest.TTL
+		}
+	}
+	return manifest, nil
+}
+
+// LoadWarmupManifest reads and parses the manifest file at path (see
+// ParseWarmupManifest).
+func LoadWarmupManifest(path string) (*WarmupManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWarmupManifest(data)
+}
+
+// WarmupResult reports the outcome of a warm-up.
+type WarmupResult struct {
+	// Stored is the number of results stored in the cacher.
+	Stored int64
+	// Skipped is the number of results that were not stored, because their
+	// lifetime is zero or their row count is out of the bounds set by the
+	// @cache-min-rows and @cache-max-rows options of the query, as pgxcache
+	// would do.
+	Skipped int64
+	// Failed is the number of queries that failed or whose result could not
+	// be stored.
+	Failed int64
+}
+
+// QueryWarmer populates a cacher with the results of a list of queries, e.g.
+// after a deploy or a Reset, so that the first users do not pay the cost of
+// every expensive query. The results are stored under the keys pgxcache
+// looks them up with.
+type QueryWarmer struct {
+	// Querier runs the queries.
+	Querier Querier
+	// Cacher stores the results. It can be any pgxcache.QueryCacher.
+	Cacher pgxcache.QueryCacher
+	// Concurrency is the maximum number of queries run at a time. Defaults
+	// to 4.
+	Concurrency int
+	// MaxLifetime is the lifetime of the results of the queries that have no
+	// TTL and no @cache-max-lifetime option. As with pgxcache, a zero
+	// lifetime means the result is not stored.
+	MaxLifetime time.Duration
+	// Report, if set, is called after each query with its outcome. Calls are
+	// serialized.
+	Report func(query *WarmupQuery, err error)
+}
+
+// Warm runs the queries and stores their results. A failing query does not
+// stop the others: Warm returns the result of every query along with the
+// errors of the failed ones, joined.
+func (x *QueryWarmer) Warm(ctx context.Context, queries []*WarmupQuery) (*WarmupResult, error) {
+	var (
+		mu     sync.Mutex
+		result = &WarmupResult{}
+		errs   []error
+	)
+
+	// Failed queries are collected instead of canceling the others.
+	var group errgroup.Group
+	group.SetLimit(warmupWorkers)
+	if x.Concurrency > 0 {
+		group.SetLimit(x.Concurrency)
+	}
+
+	for _, query := range queries {
+		group.Go(func() error {
+			stored, err := x.warm(ctx, query)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err != nil:
+				result.Failed++
+				errs = append(errs, fmt.Errorf("pgxaws: warm up %q: %w", query.SQL, err))
+			case stored:
+				result.Stored++
+			default:
+				result.Skipped++
+			}
+			if x.Report != nil {
+				x.Report(query, err)
+			}
+			return nil
+		})
+	}
+
+	_ = group.Wait()
+	return result, errors.Join(errs...)
+}
+
+// warm runs the query and stores its result, and reports whether it was
+// stored.
+func (x *QueryWarmer) warm(ctx context.Context, warmup *WarmupQuery) (bool, error) {
+	key := &pgxcache.QueryKey{SQL: warmup.SQL, Args: warmup.Args}
+
+	ttl := warmup.TTL
+	if ttl == 0 {
+		ttl = lifetime(key, x.MaxLifetime)
+	}
+	if ttl <= 0 {
+		return false, nil
+	}
+
+	item, err := query(ctx, x.Querier, key)
+	if err != nil {
+		return false, err
+	}
+
+	if options, err := pgxcache.ParseQueryOptions(key.SQL); err == nil {
+		rows := len(item.Rows)
+		if (options.MinRows > 0 && rows < options.MinRows) || (options.MaxRows > 0 && rows > options.MaxRows) {
+			return false, nil
+		}
+	}
+
+	if err := x.Cacher.Set(ctx, key, item, ttl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,184 @@
+package pgxaws
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pgx-contrib/pgxcache"
+)
+
+// warmupQuerier returns a row per query argument, fails the queries that
+// contain "fail", and records the highest number of concurrent queries.
+type warmupQuerier struct {
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func (x *warmupQuerier) Query(_ context.Context, sql string, args ...any) (pgx.Rows, error) {
+	running := x.running.Add(1)
+	defer x.running.Add(-1)
+	for {
+		peak := x.peak.Load()
+		if running <= peak || x.peak.CompareAndSwap(peak, running) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if strings.Contains(sql, "fail") {
+		return nil, errors.New("relation does not exist")
+	}
+
+	rows := make([][][]byte, len(args))
+	for i := range rows {
+		rows[i] = [][]byte{[]byte("row")}
+	}
+	return &queryRows{rows: rows}, nil
+}
+
+var _ = Describe("ParseWarmupManifest", func() {
+	It("parses YAML manifests", func() {
+		manifest, err := ParseWarmupManifest([]byte(`
+ttl: 10m
+queries:
+  - sql: SELECT * FROM customer WHERE id = $1 AND region = $2
+    args: [42, eu]
+  - sql: SELECT count(*) FROM orders
+    ttl: 90s
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Queries).To(Equal([]*WarmupQuery{
+			{SQL: "SELECT * FROM customer WHERE id = $1 AND region = $2", Args: []any{42, "eu"}, TTL: 10 * time.Minute},
+			{SQL: "SELECT count(*) FROM orders", TTL: 90 * time.Second},
+		}))
+	})
+
+	It("parses JSON manifests", func() {
+		manifest, err := ParseWarmupManifest([]byte(`{
+			"queries": [{"sql": "SELECT $1::float8, $2::bool", "args": [1.5, true], "ttl": "1h"}]
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Queries).To(Equal([]*WarmupQuery{
+			{SQL: "SELECT $1::float8, $2::bool", Args: []any{1.5, true}, TTL: time.Hour},
+		}))
+	})
+
+	It("rejects queries without SQL and invalid durations", func() {
+		_, err := ParseWarmupManifest([]byte("queries:\n  - args: [1]\n"))
+		Expect(err).To(MatchError("pgxaws: invalid warm-up manifest: query 0 has no sql"))
+
+		_, err = ParseWarmupManifest([]byte("queries:\n  - sql: SELECT 1\n    ttl: soon\n"))
+		Expect(err).To(MatchError(ContainSubstring("invalid warm-up manifest")))
+	})
+
+	It("loads manifest files", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "warmup.yaml")
+		Expect(os.WriteFile(path, []byte("queries:\n  - sql: SELECT 1\n"), 0o600)).To(Succeed())
+
+		manifest, err := LoadWarmupManifest(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Queries).To(HaveLen(1))
+
+		_, err = LoadWarmupManifest(filepath.Join(GinkgoT().TempDir(), "missing.yaml"))
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+})
+
+var _ = Describe("QueryWarmer", func() {
+	var (
+		ctx     context.Context
+		backend *entryCacher
+		querier *warmupQuerier
+		warmer  *QueryWarmer
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = newEntryCacher()
+		querier = &warmupQuerier{}
+		warmer = &QueryWarmer{Querier: querier, Cacher: backend, MaxLifetime: time.Minute}
+	})
+
+	It("stores the results under the keys pgxcache looks up", func() {
+		manifest, err := ParseWarmupManifest([]byte("queries:\n  - sql: SELECT * FROM customer WHERE id = $1\n    args: [42]\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := warmer.Warm(ctx, manifest.Queries)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&WarmupResult{Stored: 1}))
+
+		// the application passes an int64
+		key := &pgxcache.QueryKey{SQL: "SELECT * FROM customer WHERE id = $1", Args: []any{int64(42)}}
+		item, err := backend.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(item.Rows).To(HaveLen(1))
+		Expect(time.Until(backend.entries[key.String()].ExpireAt)).To(BeNumerically("~", time.Minute, time.Second))
+	})
+
+	It("takes the lifetime from the query, its options, then MaxLifetime", func() {
+		queries := []*WarmupQuery{
+			{SQL: "SELECT 1", TTL: time.Hour},
+			{SQL: "-- @cache-max-lifetime 10s\nSELECT 2"},
+			{SQL: "SELECT 3"},
+		}
+		_, err := warmer.Warm(ctx, queries)
+		Expect(err).NotTo(HaveOccurred())
+
+		for i, expected := range []time.Duration{time.Hour, 10 * time.Second, time.Minute} {
+			entry := backend.entries[(&pgxcache.QueryKey{SQL: queries[i].SQL}).String()]
+			Expect(time.Until(entry.ExpireAt)).To(BeNumerically("~", expected, time.Second))
+		}
+	})
+
+	It("skips the results pgxcache would not store", func() {
+		warmer.MaxLifetime = 0
+		queries := []*WarmupQuery{
+			{SQL: "SELECT 1"},
+			{SQL: "-- @cache-max-lifetime 10s\n-- @cache-min-rows 2\nSELECT $1", Args: []any{1}},
+		}
+
+		result, err := warmer.Warm(ctx, queries)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&WarmupResult{Skipped: 2}))
+		Expect(backend.entries).To(BeEmpty())
+	})
+
+	It("runs the other queries when one fails", func() {
+		var (
+			mu      sync.Mutex
+			reports []error
+		)
+		warmer.Report = func(_ *WarmupQuery, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports = append(reports, err)
+		}
+
+		result, err := warmer.Warm(ctx, []*WarmupQuery{{SQL: "SELECT 1"}, {SQL: "SELECT * FROM fail"}})
+		Expect(err).To(MatchError(`pgxaws: warm up "SELECT * FROM fail": relation does not exist`))
+		Expect(result).To(Equal(&WarmupResult{Stored: 1, Failed: 1}))
+		Expect(reports).To(HaveLen(2))
+	})
+
+	It("bounds the number of concurrent queries", func() {
+		queries := make([]*WarmupQuery, 20)
+		for i := range queries {
+			queries[i] = &WarmupQuery{SQL: "SELECT $1", Args: []any{i}}
+		}
+
+		warmer.Concurrency = 3
+		result, err := warmer.Warm(ctx, queries)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Stored).To(Equal(int64(20)))
+		Expect(querier.peak.Load()).To(BeNumerically("<=", 3))
+	})
+})
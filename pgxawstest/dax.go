@@ -0,0 +1,219 @@
+package pgxawstest
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DAX is an in-memory fake of a DynamoDB Accelerator (DAX) cluster in front
+// of a fake DynamoDB. It implements pgxaws.DAXClient.
+//
+// Like the DAX item cache, eventually consistent reads are answered from a
+// cache of items, including the items found missing, which is updated by the
+// writes made through DAX only. Writes made to the table directly are not
+// seen until the cached items expire. Strongly consistent reads are passed
+// through to the table.
+type DAX struct {
+	// Table is the fake DynamoDB the cluster is in front of.
+	Table *DynamoDB
+	// TTL is the time an item stays in the item cache. Zero keeps the items
+	// until they are written through DAX.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	items map[string]daxItem
+	hits  int
+}
+
+// daxItem is an item of the item cache, which is nil for a missing item.
+type daxItem struct {
+	item     map[string]dynamodbtypes.AttributeValue
+	cachedAt time.Time
+}
+
+// NewDAX creates a fake DAX cluster in front of the fake DynamoDB.
+func NewDAX(table *DynamoDB) *DAX {
+	return &DAX{Table: table, items: map[string]daxItem{}}
+}
+
+// Hits returns the number of reads answered from the item cache.
+func (x *DAX) Hits() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.hits
+}
+
+// GetItem returns the attributes of the item with the given key, from the
+// item cache unless the read is strongly consistent.
+func (x *DAX) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if aws.ToBool(params.ConsistentRead) {
+		return x.Table.GetItem(ctx, params, optFns...)
+	}
+
+	item, err := x.get(ctx, params.TableName, params.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.GetItemOutput{}
+	if item != nil {
+		if out.Item, err = project(aws.ToString(params.ProjectionExpression), params.ExpressionAttributeNames, item); err != nil {
+			return nil, err
+		}
+		out.Item = maps.Clone(out.Item)
+	}
+	return out, nil
+}
+
+// BatchGetItem reads up to 100 items by their keys, from the item cache unless
+// the reads are strongly consistent.
+func (x *DAX) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	for _, request := range params.RequestItems {
+		if aws.ToBool(request.ConsistentRead) {
+			return x.Table.BatchGetItem(ctx, params, optFns...)
+		}
+	}
+
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]dynamodbtypes.AttributeValue{},
+		UnprocessedKeys: map[string]dynamodbtypes.KeysAndAttributes{},
+	}
+	for name, request := range params.RequestItems {
+		for _, key := range request.Keys {
+			item, err := x.get(ctx, aws.String(name), key)
+			if err != nil {
+				return nil, err
+			}
+			if item == nil {
+				continue
+			}
+
+			projected, err := project(aws.ToString(request.ProjectionExpression), request.ExpressionAttributeNames, item)
+			if err != nil {
+				return nil, err
+			}
+			out.Responses[name] = append(out.Responses[name], maps.Clone(projected))
+		}
+	}
+	return out, nil
+}
+
+// PutItem writes the item to the table and to the item cache.
+func (x *DAX) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	out, err := x.Table.PutItem(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, x.put(params.TableName, params.Item, params.Item)
+}
+
+// DeleteItem deletes the item from the table and from the item cache.
+func (x *DAX) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	out, err := x.Table.DeleteItem(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, x.put(params.TableName, params.Key, nil)
+}
+
+// BatchWriteItem puts or deletes up to 25 items in the table and in the item
+// cache.
+func (x *DAX) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	out, err := x.Table.BatchWriteItem(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, requests := range params.RequestItems {
+		unprocessed := out.UnprocessedItems[name]
+		for i, request := range requests {
+			// The unprocessed requests are the last ones of the table.
+			if i >= len(requests)-len(unprocessed) {
+				break
+			}
+
+			if request.PutRequest != nil {
+				err = x.put(aws.String(name), request.PutRequest.Item, request.PutRequest.Item)
+			} else {
+				err = x.put(aws.String(name), request.DeleteRequest.Key, nil)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// get returns the item with the given key from the item cache, reading it
+// from the table on a miss. It returns nil when the item does not exist.
+func (x *DAX) get(ctx context.Context, table *string, key map[string]dynamodbtypes.AttributeValue) (map[string]dynamodbtypes.AttributeValue, error) {
+	id, err := x.cacheKey(table, key)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	cached, ok := x.items[id]
+	if ok && (x.TTL == 0 || time.Since(cached.cachedAt) < x.TTL) {
+		x.hits++
+		x.mu.Unlock()
+		return cached.item, nil
+	}
+	x.mu.Unlock()
+
+	out, err := x.Table.GetItem(ctx, &dynamodb.GetItemInput{TableName: table, Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.items[id] = daxItem{item: out.Item, cachedAt: time.Now()}
+	return out.Item, nil
+}
+
+// put replaces the item with the given key in the item cache, or removes it
+// when item is nil.
+func (x *DAX) put(table *string, key, item map[string]dynamodbtypes.AttributeValue) error {
+	id, err := x.cacheKey(table, key)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if item == nil {
+		delete(x.items, id)
+		return nil
+	}
+	x.items[id] = daxItem{item: maps.Clone(item), cachedAt: time.Now()}
+	return nil
+}
+
+// cacheKey returns the key of the item cache for the item with the given
+// primary key.
+func (x *DAX) cacheKey(table *string, key map[string]dynamodbtypes.AttributeValue) (string, error) {
+	x.Table.mu.Lock()
+	defer x.Table.mu.Unlock()
+
+	t, err := x.Table.table(table)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := t.key(key)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(table) + "\x00" + id, nil
+}
@@ -0,0 +1,66 @@
+package pgxawstest
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DAX", func() {
+	var (
+		ctx    context.Context
+		client *DynamoDB
+		dax    *DAX
+		table  *string
+		key    map[string]dynamodbtypes.AttributeValue
+	)
+
+	get := func(consistent bool) map[string]dynamodbtypes.AttributeValue {
+		out, err := dax.GetItem(ctx, &dynamodb.GetItemInput{TableName: table, Key: key, ConsistentRead: aws.Bool(consistent)})
+		Expect(err).NotTo(HaveOccurred())
+		return out.Item
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = NewDynamoDB()
+		dax = NewDAX(client)
+		table = aws.String("queries")
+		key = map[string]dynamodbtypes.AttributeValue{"id": str("a")}
+
+		_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName: table,
+			KeySchema: []dynamodbtypes.KeySchemaElement{
+				{AttributeName: aws.String("id"), KeyType: dynamodbtypes.KeyTypeHash},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("caches missing items until they are written through DAX", func() {
+		Expect(get(false)).To(BeNil())
+
+		item := map[string]dynamodbtypes.AttributeValue{"id": str("a"), "data": str("1")}
+		_, err := client.PutItem(ctx, &dynamodb.PutItemInput{TableName: table, Item: item})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get(false)).To(BeNil())
+		Expect(get(true)).To(Equal(item))
+
+		item["data"] = str("2")
+		_, err = dax.PutItem(ctx, &dynamodb.PutItemInput{TableName: table, Item: item})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get(false)).To(Equal(item))
+		Expect(dax.Hits()).To(Equal(2))
+
+		_, err = dax.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]dynamodbtypes.WriteRequest{"queries": {{DeleteRequest: &dynamodbtypes.DeleteRequest{Key: key}}}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get(false)).To(BeNil())
+		Expect(client.Items("queries")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,750 @@
+// Package pgxawstest provides in-memory fakes of the DynamoDB and S3 APIs used
+// by the pgxaws cachers, so that code built on them can be tested without
+// AWS.
+package pgxawstest
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// dynamoPageSize is the default number of items evaluated by a Query or Scan
+// page.
+const dynamoPageSize = 100
+
+// dynamoBatchWriteLimit is the maximum number of requests in a BatchWriteItem
+// call.
+const dynamoBatchWriteLimit = 25
+
+// dynamoBatchGetLimit is the maximum number of keys in a BatchGetItem call.
+const dynamoBatchGetLimit = 100
+
+// DynamoDB is an in-memory fake of the DynamoDB API. It implements
+// pgxaws.DynamoClient.
+//
+// Tables are active as soon as they are created. Condition, filter and
+// projection expressions are evaluated, queries and scans are paginated,
+// scans can be split into segments, and batch reads and writes enforce the 100
+// key and 25 request limits. TTL settings are recorded but expired items are
+// never removed.
+type DynamoDB struct {
+	// PageSize is the maximum number of items evaluated by a Query or Scan
+	// page when the request has no smaller Limit. Defaults to 100.
+	PageSize int
+	// BatchWriteLimit, when positive, is the maximum number of requests a
+	// BatchWriteItem call processes. The other requests are returned as
+	// unprocessed items, as DynamoDB does when it throttles.
+	BatchWriteLimit int
+	// BatchGetLimit, when positive, is the maximum number of keys a
+	// BatchGetItem call reads. The other keys are returned as unprocessed
+	// keys, as DynamoDB does when it throttles or the response is too large.
+	BatchGetLimit int
+	// StaleReads makes eventually consistent GetItem calls return each item
+	// as it was before its last write, as DynamoDB may do right after a
+	// write. Strongly consistent reads always return the latest version.
+	StaleReads bool
+
+	mu     sync.Mutex
+	tables map[string]*dynamoTable
+}
+
+// dynamoTable is a table of the fake.
+type dynamoTable struct {
+	description *dynamodbtypes.TableDescription
+	ttl         *dynamodbtypes.TimeToLiveDescription
+	items       map[string]map[string]dynamodbtypes.AttributeValue
+	// previous holds the version of each written item before its last
+	// write, which is nil when the item did not exist.
+	previous map[string]map[string]dynamodbtypes.AttributeValue
+}
+
+// NewDynamoDB creates an empty fake DynamoDB.
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{tables: map[string]*dynamoTable{}}
+}
+
+// Items returns a copy of every item in the table, in key order.
+func (x *DynamoDB) Items(table string) []map[string]dynamodbtypes.AttributeValue {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, ok := x.tables[table]
+	if !ok {
+		return nil
+	}
+
+	var items []map[string]dynamodbtypes.AttributeValue
+	for _, id := range slices.Sorted(maps.Keys(t.items)) {
+		items = append(items, maps.Clone(t.items[id]))
+	}
+	return items
+}
+
+// CreateTable creates a table.
+func (x *DynamoDB) CreateTable(_ context.Context, params *dynamodb.CreateTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	name := aws.ToString(params.TableName)
+	if _, ok := x.tables[name]; ok {
+		return nil, &dynamodbtypes.ResourceInUseException{Message: aws.String("Table already exists: " + name)}
+	}
+
+	description := &dynamodbtypes.TableDescription{
+		TableName:            params.TableName,
+		TableStatus:          dynamodbtypes.TableStatusActive,
+		KeySchema:            params.KeySchema,
+		AttributeDefinitions: params.AttributeDefinitions,
+		CreationDateTime:     aws.Time(time.Now()),
+	}
+	if params.BillingMode != "" {
+		description.BillingModeSummary = &dynamodbtypes.BillingModeSummary{BillingMode: params.BillingMode}
+	}
+
+	x.tables[name] = &dynamoTable{
+		description: description,
+		items:       map[string]map[string]dynamodbtypes.AttributeValue{},
+	}
+	return &dynamodb.CreateTableOutput{TableDescription: description}, nil
+}
+
+// DescribeTable returns the description of a table.
+func (x *DynamoDB) DescribeTable(_ context.Context, params *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	description := *t.description
+	description.ItemCount = aws.Int64(int64(len(t.items)))
+	return &dynamodb.DescribeTableOutput{Table: &description}, nil
+}
+
+// DeleteTable deletes a table and all of its items.
+func (x *DynamoDB) DeleteTable(_ context.Context, params *dynamodb.DeleteTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteTableOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(x.tables, aws.ToString(params.TableName))
+	return &dynamodb.DeleteTableOutput{TableDescription: t.description}, nil
+}
+
+// DescribeTimeToLive returns the TTL settings of a table.
+func (x *DynamoDB) DescribeTimeToLive(_ context.Context, params *dynamodb.DescribeTimeToLiveInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := t.ttl
+	if ttl == nil {
+		ttl = &dynamodbtypes.TimeToLiveDescription{TimeToLiveStatus: dynamodbtypes.TimeToLiveStatusDisabled}
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: ttl}, nil
+}
+
+// UpdateTimeToLive enables or disables TTL on a table. The change takes
+// effect immediately.
+func (x *DynamoDB) UpdateTimeToLive(_ context.Context, params *dynamodb.UpdateTimeToLiveInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := params.TimeToLiveSpecification
+	t.ttl = &dynamodbtypes.TimeToLiveDescription{
+		AttributeName:    spec.AttributeName,
+		TimeToLiveStatus: dynamodbtypes.TimeToLiveStatusDisabled,
+	}
+	if aws.ToBool(spec.Enabled) {
+		t.ttl.TimeToLiveStatus = dynamodbtypes.TimeToLiveStatusEnabled
+	}
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: spec}, nil
+}
+
+// GetItem returns the attributes of the item with the given key.
+func (x *DynamoDB) GetItem(_ context.Context, params *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := t.key(params.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	item, ok := t.items[id]
+	if x.StaleReads && !aws.ToBool(params.ConsistentRead) {
+		if previous, written := t.previous[id]; written {
+			item, ok = previous, previous != nil
+		}
+	}
+
+	out := &dynamodb.GetItemOutput{}
+	if ok {
+		if out.Item, err = project(aws.ToString(params.ProjectionExpression), params.ExpressionAttributeNames, item); err != nil {
+			return nil, err
+		}
+		out.Item = maps.Clone(out.Item)
+	}
+	out.ConsumedCapacity = consumedCapacity(params.TableName, params.ReturnConsumedCapacity, readUnits(out.Item, aws.ToBool(params.ConsistentRead)))
+	return out, nil
+}
+
+// PutItem creates or replaces an item when its condition expression, if any,
+// holds.
+func (x *DynamoDB) PutItem(_ context.Context, params *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := t.key(params.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	old := t.items[id]
+	if err := check(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, old); err != nil {
+		return nil, err
+	}
+
+	t.write(id, maps.Clone(params.Item))
+
+	out := &dynamodb.PutItemOutput{
+		ConsumedCapacity: consumedCapacity(params.TableName, params.ReturnConsumedCapacity, writeUnits(params.Item)),
+	}
+	if params.ReturnValues == dynamodbtypes.ReturnValueAllOld {
+		out.Attributes = old
+	}
+	return out, nil
+}
+
+// DeleteItem deletes an item by its key when its condition expression, if
+// any, holds.
+func (x *DynamoDB) DeleteItem(_ context.Context, params *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := t.key(params.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	old := t.items[id]
+	if err := check(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, old); err != nil {
+		return nil, err
+	}
+
+	t.write(id, nil)
+
+	out := &dynamodb.DeleteItemOutput{
+		ConsumedCapacity: consumedCapacity(params.TableName, params.ReturnConsumedCapacity, writeUnits(old)),
+	}
+	if params.ReturnValues == dynamodbtypes.ReturnValueAllOld {
+		out.Attributes = old
+	}
+	return out, nil
+}
+
+// Scan reads a page of items in key order, starting after
+// ExclusiveStartKey. Limit and PageSize bound the number of items evaluated
+// before the filter expression is applied, as in DynamoDB.
+func (x *DynamoDB) Scan(_ context.Context, params *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	segment, segments := aws.ToInt32(params.Segment), aws.ToInt32(params.TotalSegments)
+	if segments < 0 || (segments > 0 && (segment < 0 || segment >= segments)) {
+		return nil, validationError("invalid segment %d of %d", segment, segments)
+	}
+
+	start := ""
+	if params.ExclusiveStartKey != nil {
+		if start, err = t.key(params.ExclusiveStartKey); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := x.PageSize
+	if limit <= 0 {
+		limit = dynamoPageSize
+	}
+	if n := int(aws.ToInt32(params.Limit)); n > 0 {
+		limit = min(limit, n)
+	}
+
+	var ids []string
+	for _, id := range slices.Sorted(maps.Keys(t.items)) {
+		if params.ExclusiveStartKey != nil && id <= start {
+			continue
+		}
+		if segments > 1 && segmentOf(id, segments) != segment {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	out := &dynamodb.ScanOutput{}
+	if len(ids) > limit {
+		// More items follow; the next page starts after the last one read.
+		ids = ids[:limit]
+		out.LastEvaluatedKey = t.keyOf(t.items[ids[limit-1]])
+	}
+
+	for _, id := range ids {
+		out.ScannedCount++
+
+		item := t.items[id]
+		ok, err := evaluate(aws.ToString(params.FilterExpression), params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		projected, err := project(aws.ToString(params.ProjectionExpression), params.ExpressionAttributeNames, item)
+		if err != nil {
+			return nil, err
+		}
+		out.Items = append(out.Items, maps.Clone(projected))
+		out.Count++
+	}
+
+	return out, nil
+}
+
+// Query reads a page of the items that match the key condition expression,
+// in key order or in reverse key order, starting after ExclusiveStartKey.
+// The key condition is evaluated like a filter on every item of the table.
+// Limit and PageSize bound the number of matching items evaluated before the
+// filter expression is applied, as in DynamoDB.
+func (x *DynamoDB) Query(_ context.Context, params *dynamodb.QueryInput, _ ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	t, err := x.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if aws.ToString(params.KeyConditionExpression) == "" {
+		return nil, validationError("KeyConditionExpression is required")
+	}
+
+	start := ""
+	if params.ExclusiveStartKey != nil {
+		if start, err = t.key(params.ExclusiveStartKey); err != nil {
+			return nil, err
+		}
+	}
+
+	forward := params.ScanIndexForward == nil || aws.ToBool(params.ScanIndexForward)
+	keys := slices.Sorted(maps.Keys(t.items))
+	if !forward {
+		slices.Reverse(keys)
+	}
+
+	var ids []string
+	for _, id := range keys {
+		if params.ExclusiveStartKey != nil && ((forward && id <= start) || (!forward && id >= start)) {
+			continue
+		}
+		ok, err := evaluate(aws.ToString(params.KeyConditionExpression), params.ExpressionAttributeNames, params.ExpressionAttributeValues, t.keyOf(t.items[id]))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+
+	limit := x.PageSize
+	if limit <= 0 {
+		limit = dynamoPageSize
+	}
+	if n := int(aws.ToInt32(params.Limit)); n > 0 {
+		limit = min(limit, n)
+	}
+
+	out := &dynamodb.QueryOutput{}
+	if len(ids) > limit {
+		// More items follow; the next page starts after the last one read.
+		ids = ids[:limit]
+		out.LastEvaluatedKey = t.keyOf(t.items[ids[limit-1]])
+	}
+
+	for _, id := range ids {
+		out.ScannedCount++
+
+		item := t.items[id]
+		ok, err := evaluate(aws.ToString(params.FilterExpression), params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		projected, err := project(aws.ToString(params.ProjectionExpression), params.ExpressionAttributeNames, item)
+		if err != nil {
+			return nil, err
+		}
+		out.Items = append(out.Items, maps.Clone(projected))
+		out.Count++
+	}
+
+	return out, nil
+}
+
+// BatchWriteItem puts or deletes up to 25 items. When BatchWriteLimit is set,
+// the requests beyond it are returned as unprocessed items.
+func (x *DynamoDB) BatchWriteItem(_ context.Context, params *dynamodb.BatchWriteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	total := 0
+	for _, requests := range params.RequestItems {
+		total += len(requests)
+	}
+	switch {
+	case total == 0:
+		return nil, validationError("BatchWriteItem requires at least one request")
+	case total > dynamoBatchWriteLimit:
+		return nil, validationError("too many items requested for the BatchWriteItem call: %d", total)
+	}
+
+	// Validate every request before applying any of them.
+	for name, requests := range params.RequestItems {
+		t, err := x.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, request := range requests {
+			var id string
+			switch {
+			case request.PutRequest != nil:
+				id, err = t.key(request.PutRequest.Item)
+			case request.DeleteRequest != nil:
+				id, err = t.key(request.DeleteRequest.Key)
+			default:
+				err = validationError("write request has neither a put nor a delete request")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if seen[id] {
+				return nil, validationError("provided list of item keys contains duplicates")
+			}
+			seen[id] = true
+		}
+	}
+
+	out := &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]dynamodbtypes.WriteRequest{},
+	}
+
+	processed := 0
+	for _, name := range slices.Sorted(maps.Keys(params.RequestItems)) {
+		t := x.tables[name]
+		units := 0.0
+		for _, request := range params.RequestItems[name] {
+			if x.BatchWriteLimit > 0 && processed >= x.BatchWriteLimit {
+				out.UnprocessedItems[name] = append(out.UnprocessedItems[name], request)
+				continue
+			}
+			processed++
+
+			if request.PutRequest != nil {
+				id, _ := t.key(request.PutRequest.Item)
+				t.write(id, maps.Clone(request.PutRequest.Item))
+				units += writeUnits(request.PutRequest.Item)
+			} else {
+				id, _ := t.key(request.DeleteRequest.Key)
+				t.write(id, nil)
+				units++
+			}
+		}
+		if capacity := consumedCapacity(aws.String(name), params.ReturnConsumedCapacity, units); capacity != nil {
+			out.ConsumedCapacity = append(out.ConsumedCapacity, *capacity)
+		}
+	}
+
+	return out, nil
+}
+
+// BatchGetItem reads up to 100 items by their keys. When BatchGetLimit is
+// set, the keys beyond it are returned as unprocessed keys.
+func (x *DynamoDB) BatchGetItem(_ context.Context, params *dynamodb.BatchGetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	total := 0
+	for _, request := range params.RequestItems {
+		total += len(request.Keys)
+	}
+	switch {
+	case total == 0:
+		return nil, validationError("BatchGetItem requires at least one key")
+	case total > dynamoBatchGetLimit:
+		return nil, validationError("too many items requested for the BatchGetItem call: %d", total)
+	}
+
+	// Validate every key before reading any item.
+	for name, request := range params.RequestItems {
+		t, err := x.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, key := range request.Keys {
+			id, err := t.key(key)
+			if err != nil {
+				return nil, err
+			}
+			if seen[id] {
+				return nil, validationError("provided list of item keys contains duplicates")
+			}
+			seen[id] = true
+		}
+	}
+
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]dynamodbtypes.AttributeValue{},
+		UnprocessedKeys: map[string]dynamodbtypes.KeysAndAttributes{},
+	}
+
+	processed := 0
+	for _, name := range slices.Sorted(maps.Keys(params.RequestItems)) {
+		t := x.tables[name]
+		request := params.RequestItems[name]
+		consistent := aws.ToBool(request.ConsistentRead)
+
+		units := 0.0
+		for _, key := range request.Keys {
+			if x.BatchGetLimit > 0 && processed >= x.BatchGetLimit {
+				unprocessed := out.UnprocessedKeys[name]
+				unprocessed.Keys = append(unprocessed.Keys, key)
+				unprocessed.ConsistentRead = request.ConsistentRead
+				unprocessed.ProjectionExpression = request.ProjectionExpression
+				unprocessed.ExpressionAttributeNames = request.ExpressionAttributeNames
+				out.UnprocessedKeys[name] = unprocessed
+				continue
+			}
+			processed++
+
+			id, _ := t.key(key)
+			item, ok := t.items[id]
+			if x.StaleReads && !consistent {
+				if previous, written := t.previous[id]; written {
+					item, ok = previous, previous != nil
+				}
+			}
+			if !ok {
+				units += readUnits(nil, consistent)
+				continue
+			}
+
+			projected, err := project(aws.ToString(request.ProjectionExpression), request.ExpressionAttributeNames, item)
+			if err != nil {
+				return nil, err
+			}
+			out.Responses[name] = append(out.Responses[name], maps.Clone(projected))
+			units += readUnits(projected, consistent)
+		}
+		if capacity := consumedCapacity(aws.String(name), params.ReturnConsumedCapacity, units); capacity != nil {
+			out.ConsumedCapacity = append(out.ConsumedCapacity, *capacity)
+		}
+	}
+
+	return out, nil
+}
+
+// table returns the table with the given name.
+func (x *DynamoDB) table(name *string) (*dynamoTable, error) {
+	t, ok := x.tables[aws.ToString(name)]
+	if !ok {
+		return nil, &dynamodbtypes.ResourceNotFoundException{
+			Message: aws.String("Requested resource not found: Table: " + aws.ToString(name) + " not found"),
+		}
+	}
+	return t, nil
+}
+
+// key returns the identifier of the item with the primary key found in the
+// attributes.
+func (t *dynamoTable) key(attributes map[string]dynamodbtypes.AttributeValue) (string, error) {
+	id := ""
+	for i, elem := range t.description.KeySchema {
+		name := aws.ToString(elem.AttributeName)
+		value, ok := attributes[name]
+		if !ok {
+			return "", validationError("the provided key element %s is missing", name)
+		}
+
+		s, err := keyString(name, value)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			id += "\x00"
+		}
+		id += s
+	}
+	return id, nil
+}
+
+// write replaces the item with the given identifier, or deletes it when item
+// is nil, and keeps the previous version for stale reads.
+func (t *dynamoTable) write(id string, item map[string]dynamodbtypes.AttributeValue) {
+	if t.previous == nil {
+		t.previous = map[string]map[string]dynamodbtypes.AttributeValue{}
+	}
+	t.previous[id] = t.items[id]
+
+	if item == nil {
+		delete(t.items, id)
+		return
+	}
+	t.items[id] = item
+}
+
+// keyOf returns the primary key attributes of the item.
+func (t *dynamoTable) keyOf(item map[string]dynamodbtypes.AttributeValue) map[string]dynamodbtypes.AttributeValue {
+	key := map[string]dynamodbtypes.AttributeValue{}
+	for _, elem := range t.description.KeySchema {
+		name := aws.ToString(elem.AttributeName)
+		key[name] = item[name]
+	}
+	return key
+}
+
+// keyString returns the string form of a key attribute, which sorts like the
+// attribute for string and binary keys.
+func keyString(name string, value dynamodbtypes.AttributeValue) (string, error) {
+	switch v := value.(type) {
+	case *dynamodbtypes.AttributeValueMemberS:
+		return v.Value, nil
+	case *dynamodbtypes.AttributeValueMemberN:
+		return v.Value, nil
+	case *dynamodbtypes.AttributeValueMemberB:
+		return string(v.Value), nil
+	default:
+		return "", validationError("key element %s has unsupported type %T", name, value)
+	}
+}
+
+// segmentOf returns the scan segment of the item.
+func segmentOf(id string, segments int32) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int32(h.Sum32() % uint32(segments))
+}
+
+// check evaluates a condition expression against the current item, which is
+// nil when there is none.
+func check(expr *string, names map[string]string, values map[string]dynamodbtypes.AttributeValue, item map[string]dynamodbtypes.AttributeValue) error {
+	ok, err := evaluate(aws.ToString(expr), names, values, item)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &dynamodbtypes.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	return nil
+}
+
+// consumedCapacity returns the consumed capacity to report, if requested.
+func consumedCapacity(table *string, mode dynamodbtypes.ReturnConsumedCapacity, units float64) *dynamodbtypes.ConsumedCapacity {
+	if mode == "" || mode == dynamodbtypes.ReturnConsumedCapacityNone {
+		return nil
+	}
+	return &dynamodbtypes.ConsumedCapacity{TableName: table, CapacityUnits: aws.Float64(units)}
+}
+
+// readUnits returns the read capacity units consumed by reading the item: one
+// unit per 4 KB for a strongly consistent read, half of it otherwise.
+func readUnits(item map[string]dynamodbtypes.AttributeValue, consistent bool) float64 {
+	units := math.Max(1, math.Ceil(float64(itemSize(item))/4096))
+	if !consistent {
+		units /= 2
+	}
+	return units
+}
+
+// writeUnits returns the write capacity units consumed by writing the item:
+// one unit per 1 KB.
+func writeUnits(item map[string]dynamodbtypes.AttributeValue) float64 {
+	return math.Max(1, math.Ceil(float64(itemSize(item))/1024))
+}
+
+// itemSize approximates the size of an item as counted by DynamoDB.
+func itemSize(item map[string]dynamodbtypes.AttributeValue) int {
+	n := 0
+	for name, value := range item {
+		n += len(name)
+		switch v := value.(type) {
+		case *dynamodbtypes.AttributeValueMemberS:
+			n += len(v.Value)
+		case *dynamodbtypes.AttributeValueMemberN:
+			n += len(v.Value)
+		case *dynamodbtypes.AttributeValueMemberB:
+			n += len(v.Value)
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// validationError returns the error DynamoDB reports for invalid requests.
+func validationError(format string, args ...any) error {
+	return &smithy.GenericAPIError{
+		Code:    "ValidationException",
+		Message: fmt.Sprintf(format, args...),
+		Fault:   smithy.FaultClient,
+	}
+}
@@ -0,0 +1,390 @@
+package pgxawstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func str(value string) dynamodbtypes.AttributeValue {
+	return &dynamodbtypes.AttributeValueMemberS{Value: value}
+}
+
+func num(value int) dynamodbtypes.AttributeValue {
+	return &dynamodbtypes.AttributeValueMemberN{Value: fmt.Sprint(value)}
+}
+
+var _ = Describe("evaluate", func() {
+	item := map[string]dynamodbtypes.AttributeValue{
+		"id":    str("ns/key"),
+		"count": num(10),
+	}
+
+	DescribeTable("conditions",
+		func(expr string, expected bool) {
+			names := map[string]string{"#id": "id", "#count": "count"}
+			values := map[string]dynamodbtypes.AttributeValue{
+				":prefix": str("ns/"),
+				":five":   num(5),
+				":ten":    num(10),
+				":other":  str("other"),
+			}
+			ok, err := evaluate(expr, names, values, item)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(Equal(expected))
+		},
+		Entry("empty", "", true),
+		Entry("attribute_exists", "attribute_exists(#id)", true),
+		Entry("attribute_not_exists", "attribute_not_exists(missing)", true),
+		Entry("begins_with", "begins_with(#id, :prefix)", true),
+		Entry("number comparison", "#count > :five", true),
+		Entry("numbers compare numerically", ":ten > :five", true),
+		Entry("missing attributes compare false", "missing < :five", false),
+		Entry("values of different types are not equal", "#id = :ten", false),
+		Entry("AND binds tighter than OR", "#count = :five AND #id = :other OR #count = :ten", true),
+		Entry("parentheses", "#count = :five AND (#id = :other OR #count = :ten)", false),
+		Entry("NOT", "NOT attribute_exists(#id)", false),
+		Entry("BETWEEN", "#count BETWEEN :five AND :ten", true),
+		Entry("IN", "#count IN (:five, :ten)", true),
+		Entry("size", "size(#id) = :ten", false),
+	)
+
+	It("rejects undefined placeholders", func() {
+		_, err := evaluate("#id = :missing", map[string]string{"#id": "id"}, nil, item)
+		var aerr smithy.APIError
+		Expect(errors.As(err, &aerr)).To(BeTrue())
+		Expect(aerr.ErrorCode()).To(Equal("ValidationException"))
+	})
+
+	It("rejects trailing tokens", func() {
+		_, err := evaluate("attribute_exists(id) id", nil, nil, item)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("DynamoDB", func() {
+	var (
+		ctx    context.Context
+		client *DynamoDB
+		table  *string
+	)
+
+	put := func(id string) {
+		_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: table,
+			Item:      map[string]dynamodbtypes.AttributeValue{"id": str(id), "data": str("value")},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = NewDynamoDB()
+		table = aws.String("queries")
+
+		_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName: table,
+			KeySchema: []dynamodbtypes.KeySchemaElement{
+				{AttributeName: aws.String("id"), KeyType: dynamodbtypes.KeyTypeHash},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports missing tables", func() {
+		_, err := client.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String("missing")})
+		var nerr *dynamodbtypes.ResourceNotFoundException
+		Expect(errors.As(err, &nerr)).To(BeTrue())
+	})
+
+	It("rejects tables that already exist", func() {
+		_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{TableName: table})
+		var ierr *dynamodbtypes.ResourceInUseException
+		Expect(errors.As(err, &ierr)).To(BeTrue())
+	})
+
+	It("gets, puts and deletes items", func() {
+		put("a")
+
+		out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:              table,
+			Key:                    map[string]dynamodbtypes.AttributeValue{"id": str("a")},
+			ReturnConsumedCapacity: dynamodbtypes.ReturnConsumedCapacityTotal,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.Item).To(HaveKeyWithValue("data", str("value")))
+		Expect(aws.ToFloat64(out.ConsumedCapacity.CapacityUnits)).To(Equal(0.5))
+
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: table,
+			Key:       map[string]dynamodbtypes.AttributeValue{"id": str("a")},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Items("queries")).To(BeEmpty())
+	})
+
+	It("serves stale eventually consistent reads", func() {
+		client.StaleReads = true
+		put("a")
+
+		get := func(consistent bool) map[string]dynamodbtypes.AttributeValue {
+			out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+				TableName:      table,
+				Key:            map[string]dynamodbtypes.AttributeValue{"id": str("a")},
+				ConsistentRead: aws.Bool(consistent),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return out.Item
+		}
+		Expect(get(false)).To(BeNil())
+		Expect(get(true)).To(HaveKeyWithValue("data", str("value")))
+	})
+
+	It("rejects items without their key", func() {
+		_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: table,
+			Item:      map[string]dynamodbtypes.AttributeValue{"data": str("value")},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("enforces condition expressions", func() {
+		input := &dynamodb.PutItemInput{
+			TableName:           table,
+			Item:                map[string]dynamodbtypes.AttributeValue{"id": str("a")},
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		}
+
+		_, err := client.PutItem(ctx, input)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.PutItem(ctx, input)
+		var cerr *dynamodbtypes.ConditionalCheckFailedException
+		Expect(errors.As(err, &cerr)).To(BeTrue())
+	})
+
+	It("paginates scans", func() {
+		client.PageSize = 2
+		for i := range 5 {
+			put(fmt.Sprintf("item-%d", i))
+		}
+
+		var ids []string
+		paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{TableName: table})
+		pages := 0
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(page.Items)).To(BeNumerically("<=", 2))
+			for _, item := range page.Items {
+				ids = append(ids, item["id"].(*dynamodbtypes.AttributeValueMemberS).Value)
+			}
+			pages++
+		}
+		Expect(ids).To(Equal([]string{"item-0", "item-1", "item-2", "item-3", "item-4"}))
+		Expect(pages).To(Equal(3))
+	})
+
+	It("queries one item collection in both directions", func() {
+		_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName: aws.String("composite"),
+			KeySchema: []dynamodbtypes.KeySchemaElement{
+				{AttributeName: aws.String("pk"), KeyType: dynamodbtypes.KeyTypeHash},
+				{AttributeName: aws.String("sk"), KeyType: dynamodbtypes.KeyTypeRange},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		client.PageSize = 2
+		for _, pk := range []string{"a", "b"} {
+			for i := range 3 {
+				_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+					TableName: aws.String("composite"),
+					Item:      map[string]dynamodbtypes.AttributeValue{"pk": str(pk), "sk": str(fmt.Sprint(i))},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+
+		query := func(forward bool) []string {
+			var keys []string
+			paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+				TableName:                 aws.String("composite"),
+				KeyConditionExpression:    aws.String("pk = :pk"),
+				ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{":pk": str("b")},
+				ScanIndexForward:          aws.Bool(forward),
+			})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				for _, item := range page.Items {
+					keys = append(keys, item["sk"].(*dynamodbtypes.AttributeValueMemberS).Value)
+				}
+			}
+			return keys
+		}
+		Expect(query(true)).To(Equal([]string{"0", "1", "2"}))
+		Expect(query(false)).To(Equal([]string{"2", "1", "0"}))
+	})
+
+	It("splits scans into disjoint segments", func() {
+		for i := range 20 {
+			put(fmt.Sprintf("item-%d", i))
+		}
+
+		seen := map[string]int{}
+		for segment := range int32(3) {
+			out, err := client.Scan(ctx, &dynamodb.ScanInput{
+				TableName:     table,
+				Segment:       aws.Int32(segment),
+				TotalSegments: aws.Int32(3),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			for _, item := range out.Items {
+				seen[item["id"].(*dynamodbtypes.AttributeValueMemberS).Value]++
+			}
+		}
+		Expect(seen).To(HaveLen(20))
+		for _, n := range seen {
+			Expect(n).To(Equal(1))
+		}
+	})
+
+	It("filters and projects scanned items", func() {
+		put("a/1")
+		put("b/1")
+
+		out, err := client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:                 table,
+			FilterExpression:          aws.String("begins_with(#id, :prefix)"),
+			ProjectionExpression:      aws.String("#id"),
+			ExpressionAttributeNames:  map[string]string{"#id": "id"},
+			ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{":prefix": str("a/")},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.Items).To(Equal([]map[string]dynamodbtypes.AttributeValue{{"id": str("a/1")}}))
+		Expect(out.ScannedCount).To(Equal(int32(2)))
+	})
+
+	It("limits batch writes to 25 requests", func() {
+		requests := make([]dynamodbtypes.WriteRequest, 26)
+		for i := range requests {
+			requests[i] = dynamodbtypes.WriteRequest{PutRequest: &dynamodbtypes.PutRequest{
+				Item: map[string]dynamodbtypes.AttributeValue{"id": str(fmt.Sprint(i))},
+			}}
+		}
+
+		_, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]dynamodbtypes.WriteRequest{"queries": requests},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(client.Items("queries")).To(BeEmpty())
+	})
+
+	It("returns unprocessed items beyond BatchWriteLimit", func() {
+		client.BatchWriteLimit = 2
+		requests := make([]dynamodbtypes.WriteRequest, 5)
+		for i := range requests {
+			requests[i] = dynamodbtypes.WriteRequest{PutRequest: &dynamodbtypes.PutRequest{
+				Item: map[string]dynamodbtypes.AttributeValue{"id": str(fmt.Sprint(i))},
+			}}
+		}
+
+		out, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]dynamodbtypes.WriteRequest{"queries": requests},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Items("queries")).To(HaveLen(2))
+		Expect(out.UnprocessedItems["queries"]).To(HaveLen(3))
+	})
+
+	It("rejects batch writes with duplicate keys", func() {
+		request := dynamodbtypes.WriteRequest{PutRequest: &dynamodbtypes.PutRequest{
+			Item: map[string]dynamodbtypes.AttributeValue{"id": str("a")},
+		}}
+
+		_, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]dynamodbtypes.WriteRequest{"queries": {request, request}},
+		})
+		Expect(err).To(MatchError(ContainSubstring("duplicates")))
+	})
+
+	It("reads items in batches of up to 100 keys", func() {
+		put("a")
+		put("b")
+
+		keys := make([]map[string]dynamodbtypes.AttributeValue, 101)
+		for i := range keys {
+			keys[i] = map[string]dynamodbtypes.AttributeValue{"id": str(fmt.Sprint(i))}
+		}
+		_, err := client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]dynamodbtypes.KeysAndAttributes{"queries": {Keys: keys}},
+		})
+		Expect(err).To(HaveOccurred())
+
+		keys = []map[string]dynamodbtypes.AttributeValue{{"id": str("a")}, {"id": str("a")}}
+		_, err = client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]dynamodbtypes.KeysAndAttributes{"queries": {Keys: keys}},
+		})
+		Expect(err).To(MatchError(ContainSubstring("duplicates")))
+
+		keys = []map[string]dynamodbtypes.AttributeValue{{"id": str("a")}, {"id": str("b")}, {"id": str("c")}}
+		out, err := client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]dynamodbtypes.KeysAndAttributes{"queries": {
+				Keys:                     keys,
+				ProjectionExpression:     aws.String("#id"),
+				ExpressionAttributeNames: map[string]string{"#id": "id"},
+				ConsistentRead:           aws.Bool(true),
+			}},
+			ReturnConsumedCapacity: dynamodbtypes.ReturnConsumedCapacityTotal,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.Responses["queries"]).To(ConsistOf(
+			map[string]dynamodbtypes.AttributeValue{"id": str("a")},
+			map[string]dynamodbtypes.AttributeValue{"id": str("b")},
+		))
+		Expect(out.UnprocessedKeys).To(BeEmpty())
+		Expect(out.ConsumedCapacity).To(HaveLen(1))
+		Expect(aws.ToFloat64(out.ConsumedCapacity[0].CapacityUnits)).To(Equal(3.0))
+	})
+
+	It("returns unprocessed keys beyond BatchGetLimit", func() {
+		client.BatchGetLimit = 2
+		keys := make([]map[string]dynamodbtypes.AttributeValue, 5)
+		for i := range keys {
+			put(fmt.Sprint(i))
+			keys[i] = map[string]dynamodbtypes.AttributeValue{"id": str(fmt.Sprint(i))}
+		}
+
+		out, err := client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]dynamodbtypes.KeysAndAttributes{"queries": {Keys: keys, ConsistentRead: aws.Bool(true)}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.Responses["queries"]).To(HaveLen(2))
+		Expect(out.UnprocessedKeys["queries"].Keys).To(Equal(keys[2:]))
+		Expect(aws.ToBool(out.UnprocessedKeys["queries"].ConsistentRead)).To(BeTrue())
+	})
+
+	It("records TTL settings", func() {
+		_, err := client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName: table,
+			TimeToLiveSpecification: &dynamodbtypes.TimeToLiveSpecification{
+				AttributeName: aws.String("expire_at"),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		out, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: table})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.TimeToLiveDescription.TimeToLiveStatus).To(Equal(dynamodbtypes.TimeToLiveStatusEnabled))
+		Expect(aws.ToString(out.TimeToLiveDescription.AttributeName)).To(Equal("expire_at"))
+	})
+})
@@ -0,0 +1,436 @@
+package pgxawstest
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// expression is a parsed DynamoDB condition or filter expression. It supports
+// the comparison operators, BETWEEN, IN, AND, OR, NOT, parentheses and the
+// attribute_exists, attribute_not_exists, begins_with, contains and size
+// functions on top-level attributes.
+type expression struct {
+	tokens []string
+	pos    int
+	names  map[string]string
+	values map[string]dynamodbtypes.AttributeValue
+}
+
+// evaluate reports whether the item satisfies the expression. An empty
+// expression is satisfied by every item.
+func evaluate(expr string, names map[string]string, values map[string]dynamodbtypes.AttributeValue, item map[string]dynamodbtypes.AttributeValue) (bool, error) {
+	if strings.TrimSpace(expr) == "" {
+		return true, nil
+	}
+
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return false, err
+	}
+
+	x := &expression{tokens: tokens, names: names, values: values}
+	ok, err := x.or(item)
+	if err != nil {
+		return false, err
+	}
+	if x.pos < len(x.tokens) {
+		return false, validationError("unexpected token %q in expression %q", x.tokens[x.pos], expr)
+	}
+	return ok, nil
+}
+
+// project returns the attributes of the item named by the projection
+// expression. An empty projection returns the whole item.
+func project(expr string, names map[string]string, item map[string]dynamodbtypes.AttributeValue) (map[string]dynamodbtypes.AttributeValue, error) {
+	if strings.TrimSpace(expr) == "" {
+		return item, nil
+	}
+
+	out := map[string]dynamodbtypes.AttributeValue{}
+	for _, path := range strings.Split(expr, ",") {
+		name, err := attributeName(strings.TrimSpace(path), names)
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := item[name]; ok {
+			out[name] = value
+		}
+	}
+	return out, nil
+}
+
+// tokenize splits an expression into names, placeholders, keywords,
+// operators and punctuation.
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '=':
+			tokens = append(tokens, "=")
+			i++
+		case c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(expr) && (expr[i+1] == '=' || (c == '<' && expr[i+1] == '>')) {
+				op += string(expr[i+1])
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		case c == '#' || c == ':' || c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(expr) {
+				d := rune(expr[j])
+				if d != '_' && d != '.' && !unicode.IsLetter(d) && !unicode.IsDigit(d) {
+					break
+				}
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			return nil, validationError("invalid character %q in expression %q", c, expr)
+		}
+	}
+
+	return tokens, nil
+}
+
+// peek returns the next token, or an empty string at the end.
+func (x *expression) peek() string {
+	if x.pos < len(x.tokens) {
+		return x.tokens[x.pos]
+	}
+	return ""
+}
+
+// keyword reports whether the next token is the keyword and consumes it.
+func (x *expression) keyword(word string) bool {
+	if strings.EqualFold(x.peek(), word) {
+		x.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes the next token, which must be the given one.
+func (x *expression) expect(token string) error {
+	if x.peek() != token {
+		return validationError("expected %q but got %q", token, x.peek())
+	}
+	x.pos++
+	return nil
+}
+
+// or evaluates a disjunction.
+func (x *expression) or(item map[string]dynamodbtypes.AttributeValue) (bool, error) {
+	ok, err := x.and(item)
+	for err == nil && x.keyword("OR") {
+		var right bool
+		right, err = x.and(item)
+		ok = ok || right
+	}
+	return ok, err
+}
+
+// and evaluates a conjunction.
+func (x *expression) and(item map[string]dynamodbtypes.AttributeValue) (bool, error) {
+	ok, err := x.not(item)
+	for err == nil && x.keyword("AND") {
+		var right bool
+		right, err = x.not(item)
+		ok = ok && right
+	}
+	return ok, err
+}
+
+// not evaluates a negation.
+func (x *expression) not(item map[string]dynamodbtypes.AttributeValue) (bool, error) {
+	if x.keyword("NOT") {
+		ok, err := x.not(item)
+		return !ok, err
+	}
+	return x.condition(item)
+}
+
+// condition evaluates a parenthesized expression, a function or a
+// comparison.
+func (x *expression) condition(item map[string]dynamodbtypes.AttributeValue) (bool, error) {
+	if x.peek() == "(" {
+		x.pos++
+		ok, err := x.or(item)
+		if err != nil {
+			return false, err
+		}
+		return ok, x.expect(")")
+	}
+
+	switch fn := strings.ToLower(x.peek()); fn {
+	case "attribute_exists", "attribute_not_exists", "begins_with", "contains":
+		x.pos++
+		args, err := x.arguments(item)
+		if err != nil {
+			return false, err
+		}
+		return call(fn, args)
+	}
+
+	left, err := x.operand(item)
+	if err != nil {
+		return false, err
+	}
+
+	switch op := x.peek(); {
+	case op == "=" || op == "<>" || op == "<" || op == "<=" || op == ">" || op == ">=":
+		x.pos++
+		right, err := x.operand(item)
+		if err != nil {
+			return false, err
+		}
+		return compare(op, left.value, right.value), nil
+	case strings.EqualFold(op, "BETWEEN"):
+		x.pos++
+		low, err := x.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if !x.keyword("AND") {
+			return false, validationError("expected AND in BETWEEN")
+		}
+		high, err := x.operand(item)
+		if err != nil {
+			return false, err
+		}
+		return compare(">=", left.value, low.value) && compare("<=", left.value, high.value), nil
+	case strings.EqualFold(op, "IN"):
+		x.pos++
+		args, err := x.arguments(item)
+		if err != nil {
+			return false, err
+		}
+		for _, arg := range args {
+			if compare("=", left.value, arg.value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, validationError("expected a comparison but got %q", op)
+	}
+}
+
+// arguments evaluates a parenthesized, comma-separated list of operands.
+func (x *expression) arguments(item map[string]dynamodbtypes.AttributeValue) ([]operand, error) {
+	if err := x.expect("("); err != nil {
+		return nil, err
+	}
+
+	var args []operand
+	for {
+		arg, err := x.operand(item)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if x.peek() == "," {
+			x.pos++
+			continue
+		}
+		return args, x.expect(")")
+	}
+}
+
+// operand is an evaluated path or placeholder. The value of a path is nil
+// when the item has no such attribute.
+type operand struct {
+	path  bool
+	value dynamodbtypes.AttributeValue
+}
+
+// operand evaluates a path, a placeholder or the size function.
+func (x *expression) operand(item map[string]dynamodbtypes.AttributeValue) (operand, error) {
+	token := x.peek()
+	if token == "" {
+		return operand{}, validationError("unexpected end of expression")
+	}
+	x.pos++
+
+	switch {
+	case strings.EqualFold(token, "size"):
+		args, err := x.arguments(item)
+		if err != nil {
+			return operand{}, err
+		}
+		if len(args) != 1 {
+			return operand{}, validationError("size takes one argument")
+		}
+		n, ok := size(args[0].value)
+		if !ok {
+			return operand{}, nil
+		}
+		return operand{value: &dynamodbtypes.AttributeValueMemberN{Value: fmt.Sprint(n)}}, nil
+	case strings.HasPrefix(token, ":"):
+		value, ok := x.values[token]
+		if !ok {
+			return operand{}, validationError("undefined expression attribute value %s", token)
+		}
+		return operand{value: value}, nil
+	default:
+		name, err := attributeName(token, x.names)
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{path: true, value: item[name]}, nil
+	}
+}
+
+// attributeName resolves a path, which may be an expression attribute name.
+func attributeName(path string, names map[string]string) (string, error) {
+	if !strings.HasPrefix(path, "#") {
+		return path, nil
+	}
+	name, ok := names[path]
+	if !ok {
+		return "", validationError("undefined expression attribute name %s", path)
+	}
+	return name, nil
+}
+
+// call evaluates a function.
+func call(fn string, args []operand) (bool, error) {
+	switch fn {
+	case "attribute_exists", "attribute_not_exists":
+		if len(args) != 1 || !args[0].path {
+			return false, validationError("%s takes one path", fn)
+		}
+		return (args[0].value != nil) == (fn == "attribute_exists"), nil
+	case "begins_with":
+		if len(args) != 2 {
+			return false, validationError("begins_with takes two arguments")
+		}
+		switch v := args[0].value.(type) {
+		case *dynamodbtypes.AttributeValueMemberS:
+			prefix, ok := args[1].value.(*dynamodbtypes.AttributeValueMemberS)
+			return ok && strings.HasPrefix(v.Value, prefix.Value), nil
+		case *dynamodbtypes.AttributeValueMemberB:
+			prefix, ok := args[1].value.(*dynamodbtypes.AttributeValueMemberB)
+			return ok && bytes.HasPrefix(v.Value, prefix.Value), nil
+		}
+		return false, nil
+	case "contains":
+		if len(args) != 2 {
+			return false, validationError("contains takes two arguments")
+		}
+		switch v := args[0].value.(type) {
+		case *dynamodbtypes.AttributeValueMemberS:
+			sub, ok := args[1].value.(*dynamodbtypes.AttributeValueMemberS)
+			return ok && strings.Contains(v.Value, sub.Value), nil
+		case *dynamodbtypes.AttributeValueMemberSS:
+			sub, ok := args[1].value.(*dynamodbtypes.AttributeValueMemberS)
+			for _, s := range v.Value {
+				if ok && s == sub.Value {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, validationError("unsupported function %s", fn)
+}
+
+// size returns the size of an attribute value as defined by the size
+// function.
+func size(value dynamodbtypes.AttributeValue) (int, bool) {
+	switch v := value.(type) {
+	case *dynamodbtypes.AttributeValueMemberS:
+		return len(v.Value), true
+	case *dynamodbtypes.AttributeValueMemberB:
+		return len(v.Value), true
+	case *dynamodbtypes.AttributeValueMemberSS:
+		return len(v.Value), true
+	case *dynamodbtypes.AttributeValueMemberNS:
+		return len(v.Value), true
+	case *dynamodbtypes.AttributeValueMemberL:
+		return len(v.Value), true
+	case *dynamodbtypes.AttributeValueMemberM:
+		return len(v.Value), true
+	}
+	return 0, false
+}
+
+// compare applies a comparison operator to two scalar values. Comparisons
+// involving missing attributes or values of different types are false.
+func compare(op string, left, right dynamodbtypes.AttributeValue) bool {
+	if left == nil || right == nil {
+		return false
+	}
+
+	var c int
+	switch l := left.(type) {
+	case *dynamodbtypes.AttributeValueMemberS:
+		r, ok := right.(*dynamodbtypes.AttributeValueMemberS)
+		if !ok {
+			return op == "<>"
+		}
+		c = strings.Compare(l.Value, r.Value)
+	case *dynamodbtypes.AttributeValueMemberN:
+		r, ok := right.(*dynamodbtypes.AttributeValueMemberN)
+		if !ok {
+			return op == "<>"
+		}
+		c = compareNumbers(l.Value, r.Value)
+	case *dynamodbtypes.AttributeValueMemberB:
+		r, ok := right.(*dynamodbtypes.AttributeValueMemberB)
+		if !ok {
+			return op == "<>"
+		}
+		c = bytes.Compare(l.Value, r.Value)
+	case *dynamodbtypes.AttributeValueMemberBOOL:
+		r, ok := right.(*dynamodbtypes.AttributeValueMemberBOOL)
+		if !ok || (op != "=" && op != "<>") {
+			return op == "<>"
+		}
+		if l.Value != r.Value {
+			c = 1
+		}
+	default:
+		return false
+	}
+
+	switch op {
+	case "=":
+		return c == 0
+	case "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// compareNumbers compares two DynamoDB numbers.
+func compareNumbers(x, y string) int {
+	a, _, errA := big.ParseFloat(x, 10, 128, big.ToNearestEven)
+	b, _, errB := big.ParseFloat(y, 10, 128, big.ToNearestEven)
+	if errA != nil || errB != nil {
+		return strings.Compare(x, y)
+	}
+	return a.Cmp(b)
+}
@@ -0,0 +1,947 @@
+package pgxawstest
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// s3PageSize is the default number of keys returned by a list page.
+const s3PageSize = 1000
+
+// s3DeleteLimit is the maximum number of objects in a DeleteObjects call.
+const s3DeleteLimit = 1000
+
+// s3MinPartSize is the minimum size of every part of a multipart upload but
+// the last one.
+const s3MinPartSize = 5 << 20
+
+// s3MaxParts is the maximum number of parts of a multipart upload.
+const s3MaxParts = 10000
+
+// S3 is an in-memory fake of the S3 API. It implements pgxaws.S3Client.
+//
+// Objects keep their body, user-defined metadata, ETag, encryption settings,
+// storage class and tags, and objects written with an SSE-C key can only be
+// read with the same key. Conditional writes with If-None-Match and If-Match,
+// upload checksums and expected bucket owners are honoured, listings are
+// paginated and batch deletes enforce the 1000 object limit. Multipart uploads
+// enforce the 5 MiB minimum part size. Only the current
+// version of each object is kept, even when versioning is enabled, and
+// lifecycle rules are recorded but never applied.
+//
+// Buckets created with a directory bucket configuration behave like S3
+// Express One Zone directory buckets: they list objects in no particular
+// order, only accept list prefixes that end with a slash and have neither
+// versioning nor object versions. GetObject honours byte ranges.
+type S3 struct {
+	// Region is the region reported by Options, in which buckets are
+	// created.
+	Region string
+	// PageSize is the maximum number of keys returned by a list page when
+	// the request has no smaller MaxKeys. Defaults to 1000.
+	PageSize int
+	// AccountID is the account that owns every bucket. Requests that expect
+	// another bucket owner are denied.
+	AccountID string
+	// GetLatency, if set, returns how long each GetObject call waits before
+	// it is served, e.g. to simulate slow responses. A call whose context is
+	// done meanwhile fails with the context error.
+	GetLatency func() time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*s3Bucket
+	// uploads is the number of multipart uploads created so far, from which
+	// upload IDs are derived.
+	uploads int
+}
+
+// s3Bucket is a bucket of the fake.
+type s3Bucket struct {
+	region     string
+	directory  bool
+	versioning s3types.BucketVersioningStatus
+	lifecycle  []s3types.LifecycleRule
+	objects    map[string]*s3Object
+	uploads    map[string]*s3Upload
+}
+
+// s3Upload is a multipart upload in progress.
+type s3Upload struct {
+	key string
+	// object holds the settings of the object being uploaded.
+	object *s3Object
+	parts  map[int32][]byte
+}
+
+// s3Object is an object of the fake.
+type s3Object struct {
+	body     []byte
+	metadata map[string]string
+	etag     string
+	modified time.Time
+	// encryption, kmsKeyID and bucketKey describe the server-side
+	// encryption of the object.
+	encryption s3types.ServerSideEncryption
+	kmsKeyID   string
+	bucketKey  bool
+	// customerKeyMD5 is the digest of the SSE-C key, which reads must send.
+	customerKeyMD5 string
+	storageClass   s3types.StorageClass
+	tags           map[string]string
+}
+
+// NewS3 creates an empty fake S3.
+func NewS3() *S3 {
+	return &S3{buckets: map[string]*s3Bucket{}}
+}
+
+// Options returns the options of the client, which only carry the region.
+func (x *S3) Options() s3.Options {
+	return s3.Options{Region: x.Region}
+}
+
+// Keys returns the keys of every object in the bucket, in order.
+func (x *S3) Keys(bucket string) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, ok := x.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(b.objects))
+}
+
+// Uploads returns the keys of the multipart uploads in progress in the bucket,
+// in order.
+func (x *S3) Uploads(bucket string) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, ok := x.buckets[bucket]
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	for _, upload := range b.uploads {
+		keys = append(keys, upload.key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Tags returns the tags of an object, or nil when it does not exist.
+func (x *S3) Tags(bucket, key string) map[string]string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	obj, err := x.object(aws.String(bucket), nil, aws.String(key))
+	if err != nil {
+		return nil
+	}
+	return maps.Clone(obj.tags)
+}
+
+// SetVersioning sets the versioning state of a bucket.
+func (x *S3) SetVersioning(bucket string, status s3types.BucketVersioningStatus) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(aws.String(bucket), nil)
+	if err != nil {
+		return err
+	}
+	b.versioning = status
+	return nil
+}
+
+// HeadBucket reports whether a bucket exists.
+func (x *S3) HeadBucket(_ context.Context, params *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, ok := x.buckets[aws.ToString(params.Bucket)]
+	if !ok {
+		return nil, &s3types.NotFound{Message: aws.String("Not Found")}
+	}
+	if err := x.checkOwner(params.ExpectedBucketOwner); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{BucketRegion: aws.String(b.region)}, nil
+}
+
+// CreateBucket creates a bucket.
+func (x *S3) CreateBucket(_ context.Context, params *s3.CreateBucketInput, _ ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	name := aws.ToString(params.Bucket)
+	if _, ok := x.buckets[name]; ok {
+		return nil, &s3types.BucketAlreadyOwnedByYou{Message: aws.String("Your previous request to create the named bucket succeeded and you already own it.")}
+	}
+
+	b := &s3Bucket{region: "us-east-1", objects: map[string]*s3Object{}, uploads: map[string]*s3Upload{}}
+	if config := params.CreateBucketConfiguration; config != nil {
+		if config.LocationConstraint != "" {
+			b.region = string(config.LocationConstraint)
+		}
+		if config.Bucket != nil && config.Bucket.Type == s3types.BucketTypeDirectory {
+			if config.Location == nil || !strings.HasSuffix(name, "--"+aws.ToString(config.Location.Name)+"--x-s3") {
+				return nil, apiError("InvalidBucketName", "The specified bucket is not valid.")
+			}
+			b.directory = true
+			if x.Region != "" {
+				b.region = x.Region
+			}
+		}
+	}
+
+	x.buckets[name] = b
+	return &s3.CreateBucketOutput{Location: aws.String("/" + name)}, nil
+}
+
+// GetBucketVersioning returns the versioning state of a bucket.
+func (x *S3) GetBucketVersioning(_ context.Context, params *s3.GetBucketVersioningInput, _ ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+	if b.directory {
+		return nil, notImplemented()
+	}
+	return &s3.GetBucketVersioningOutput{Status: b.versioning}, nil
+}
+
+// GetBucketLifecycleConfiguration returns the lifecycle rules of a bucket.
+func (x *S3) GetBucketLifecycleConfiguration(_ context.Context, params *s3.GetBucketLifecycleConfigurationInput, _ ...func(*s3.Options)) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.lifecycle) == 0 {
+		return nil, apiError("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist")
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: slices.Clone(b.lifecycle)}, nil
+}
+
+// PutBucketLifecycleConfiguration replaces the lifecycle rules of a bucket.
+func (x *S3) PutBucketLifecycleConfiguration(_ context.Context, params *s3.PutBucketLifecycleConfigurationInput, _ ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+	if params.LifecycleConfiguration == nil {
+		return nil, apiError("MalformedXML", "The XML you provided was not well-formed")
+	}
+	b.lifecycle = slices.Clone(params.LifecycleConfiguration.Rules)
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+// GetObject returns an object and its metadata, or the byte range of the
+// object given by the Range header.
+func (x *S3) GetObject(ctx context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if x.GetLatency != nil {
+		timer := time.NewTimer(x.GetLatency())
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	obj, err := x.object(params.Bucket, params.ExpectedBucketOwner, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := obj.checkCustomerKey(params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+
+	out := &s3.GetObjectOutput{
+		ETag:         aws.String(obj.etag),
+		LastModified: aws.Time(obj.modified),
+		Metadata:     maps.Clone(obj.metadata),
+		StorageClass: obj.storageClass,
+		TagCount:     aws.Int32(int32(len(obj.tags))),
+	}
+	out.ServerSideEncryption, out.SSEKMSKeyId, out.BucketKeyEnabled, out.SSECustomerAlgorithm, out.SSECustomerKeyMD5 = obj.encryptionHeaders()
+
+	body := obj.body
+	if params.Range != nil {
+		first, last, ok := byteRange(aws.ToString(params.Range), len(body))
+		if !ok {
+			return nil, apiError("InvalidRange", "The requested range is not satisfiable")
+		}
+		body = body[first : last+1]
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", first, last, len(obj.body)))
+	}
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = aws.Int64(int64(len(body)))
+	return out, nil
+}
+
+// HeadObject returns the metadata of an object.
+func (x *S3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	obj, err := x.object(params.Bucket, params.ExpectedBucketOwner, params.Key)
+	if _, ok := err.(*s3types.NoSuchKey); ok {
+		// HEAD responses have no body, so the error has no specific code.
+		return nil, &s3types.NotFound{Message: aws.String("Not Found")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := obj.checkCustomerKey(params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.body))),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.modified),
+		Metadata:      maps.Clone(obj.metadata),
+		StorageClass:  obj.storageClass,
+	}
+	out.ServerSideEncryption, out.SSEKMSKeyId, out.BucketKeyEnabled, out.SSECustomerAlgorithm, out.SSECustomerKeyMD5 = obj.encryptionHeaders()
+	return out, nil
+}
+
+// PutObject creates or replaces an object. The write is rejected when the
+// If-None-Match or If-Match condition does not hold, or when the body does
+// not match its CRC32C or SHA-256 checksum.
+func (x *S3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	// Read the body before taking the lock, as it may be a slow stream.
+	var body []byte
+	if params.Body != nil {
+		var err error
+		if body, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkChecksums(params, body); err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	key := aws.ToString(params.Key)
+	if err := b.checkCondition(key, params.IfMatch, params.IfNoneMatch); err != nil {
+		return nil, err
+	}
+
+	obj, err := newObject(params, body)
+	if err != nil {
+		return nil, err
+	}
+	b.objects[key] = obj
+
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag), Size: aws.Int64(int64(len(body)))}, nil
+}
+
+// CreateMultipartUpload starts a multipart upload. The settings of the object
+// are those of the upload.
+func (x *S3) CreateMultipartUpload(_ context.Context, params *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := newObject(&s3.PutObjectInput{
+		Metadata:             params.Metadata,
+		ServerSideEncryption: params.ServerSideEncryption,
+		SSEKMSKeyId:          params.SSEKMSKeyId,
+		BucketKeyEnabled:     params.BucketKeyEnabled,
+		SSECustomerAlgorithm: params.SSECustomerAlgorithm,
+		SSECustomerKey:       params.SSECustomerKey,
+		SSECustomerKeyMD5:    params.SSECustomerKeyMD5,
+		StorageClass:         params.StorageClass,
+		Tagging:              params.Tagging,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	x.uploads++
+	id := strconv.Itoa(x.uploads)
+	b.uploads[id] = &s3Upload{key: aws.ToString(params.Key), object: obj, parts: map[int32][]byte{}}
+
+	return &s3.CreateMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, UploadId: aws.String(id)}, nil
+}
+
+// UploadPart uploads a part of a multipart upload. Parts of uploads encrypted
+// with SSE-C must be sent with the same key.
+func (x *S3) UploadPart(_ context.Context, params *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	// Read the body before taking the lock, as it may be a slow stream.
+	var body []byte
+	if params.Body != nil {
+		var err error
+		if body, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	upload, err := x.upload(params.Bucket, params.ExpectedBucketOwner, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if number := aws.ToInt32(params.PartNumber); number < 1 || number > s3MaxParts {
+		return nil, apiError("InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+	}
+	if err := upload.object.checkCustomerKey(params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+
+	upload.parts[aws.ToInt32(params.PartNumber)] = body
+	return &s3.UploadPartOutput{ETag: aws.String(etag(body))}, nil
+}
+
+// CompleteMultipartUpload assembles the parts of a multipart upload into an
+// object. Every part but the last must be at least 5 MiB.
+func (x *S3) CompleteMultipartUpload(_ context.Context, params *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	upload, err := x.upload(params.Bucket, params.ExpectedBucketOwner, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if params.MultipartUpload == nil || len(params.MultipartUpload.Parts) == 0 {
+		return nil, apiError("MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+	}
+
+	var (
+		body    []byte
+		digests []byte
+	)
+	parts := params.MultipartUpload.Parts
+	for i := 1; i < len(parts); i++ {
+		if aws.ToInt32(parts[i].PartNumber) <= aws.ToInt32(parts[i-1].PartNumber) {
+			return nil, apiError("InvalidPartOrder", "The list of parts was not in ascending order. The parts list must be specified in order by part number.")
+		}
+	}
+	for i, part := range parts {
+		data, ok := upload.parts[aws.ToInt32(part.PartNumber)]
+		if !ok || aws.ToString(part.ETag) != etag(data) {
+			return nil, apiError("InvalidPart", "One or more of the specified parts could not be found. The part might not have been uploaded, or the specified entity tag might not have matched the part's entity tag.")
+		}
+		if i < len(parts)-1 && len(data) < s3MinPartSize {
+			return nil, apiError("EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.")
+		}
+
+		sum := md5.Sum(data)
+		digests = append(digests, sum[:]...)
+		body = append(body, data...)
+	}
+
+	b, _ := x.bucket(params.Bucket, nil)
+	if err := b.checkCondition(upload.key, params.IfMatch, params.IfNoneMatch); err != nil {
+		return nil, err
+	}
+
+	// The ETag of a multipart object is the digest of the digests of its
+	// parts, followed by the number of parts.
+	sum := md5.Sum(digests)
+	obj := *upload.object
+	obj.body = body
+	obj.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(parts))
+	obj.modified = time.Now().UTC()
+	b.objects[upload.key] = &obj
+	delete(b.uploads, aws.ToString(params.UploadId))
+
+	return &s3.CompleteMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, ETag: aws.String(obj.etag)}, nil
+}
+
+// AbortMultipartUpload aborts a multipart upload and deletes its parts.
+func (x *S3) AbortMultipartUpload(_ context.Context, params *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, err := x.upload(params.Bucket, params.ExpectedBucketOwner, params.Key, params.UploadId); err != nil {
+		return nil, err
+	}
+
+	b, _ := x.bucket(params.Bucket, nil)
+	delete(b.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// DeleteObject deletes an object. Deleting a missing object succeeds, unless
+// the request has an If-Match condition.
+func (x *S3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	key := aws.ToString(params.Key)
+	existing, ok := b.objects[key]
+	switch {
+	case params.IfMatch != nil && !ok:
+		return nil, noSuchKey()
+	case params.IfMatch != nil && aws.ToString(params.IfMatch) != existing.etag:
+		return nil, preconditionFailed()
+	}
+
+	delete(b.objects, key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// DeleteObjects deletes up to 1000 objects. Object versions are ignored.
+func (x *S3) DeleteObjects(_ context.Context, params *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+	if params.Delete == nil || len(params.Delete.Objects) == 0 || len(params.Delete.Objects) > s3DeleteLimit {
+		return nil, apiError("MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+	}
+
+	out := &s3.DeleteObjectsOutput{}
+	for _, obj := range params.Delete.Objects {
+		delete(b.objects, aws.ToString(obj.Key))
+		if !aws.ToBool(params.Delete.Quiet) {
+			out.Deleted = append(out.Deleted, s3types.DeletedObject{Key: obj.Key, VersionId: obj.VersionId})
+		}
+	}
+	return out, nil
+}
+
+// ListObjectsV2 lists the objects in a bucket in key order, or in no
+// particular order in directory buckets. Keys that contain the delimiter after
+// the prefix are rolled up into common prefixes.
+func (x *S3) ListObjectsV2(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+	if prefix := aws.ToString(params.Prefix); b.directory && prefix != "" && !strings.HasSuffix(prefix, "/") {
+		return nil, apiError("InvalidArgument", "Prefixes must end in a delimiter for directory buckets")
+	}
+
+	after := aws.ToString(params.StartAfter)
+	if token := aws.ToString(params.ContinuationToken); token != "" {
+		after = token
+	}
+
+	keys, truncated := x.page(b, aws.ToString(params.Prefix), aws.ToString(params.Delimiter), after, aws.ToInt32(params.MaxKeys))
+
+	out := &s3.ListObjectsV2Output{
+		Name:              params.Bucket,
+		Prefix:            params.Prefix,
+		Delimiter:         params.Delimiter,
+		ContinuationToken: params.ContinuationToken,
+		KeyCount:          aws.Int32(int32(len(keys))),
+		IsTruncated:       aws.Bool(truncated),
+	}
+	for _, key := range keys {
+		obj, ok := b.objects[key]
+		if !ok {
+			out.CommonPrefixes = append(out.CommonPrefixes, s3types.CommonPrefix{Prefix: aws.String(key)})
+			continue
+		}
+		out.Contents = append(out.Contents, s3types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.body))),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	if truncated {
+		// The continuation token is opaque to callers.
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	return out, nil
+}
+
+// ListObjectVersions lists the objects in a bucket in key order. Each object
+// has a single, current version whose ID is "null".
+func (x *S3) ListObjectVersions(_ context.Context, params *s3.ListObjectVersionsInput, _ ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, err := x.bucket(params.Bucket, params.ExpectedBucketOwner)
+	if err != nil {
+		return nil, err
+	}
+	if b.directory {
+		return nil, notImplemented()
+	}
+
+	keys, truncated := x.page(b, aws.ToString(params.Prefix), "", aws.ToString(params.KeyMarker), aws.ToInt32(params.MaxKeys))
+
+	out := &s3.ListObjectVersionsOutput{
+		Name:        params.Bucket,
+		Prefix:      params.Prefix,
+		KeyMarker:   params.KeyMarker,
+		IsTruncated: aws.Bool(truncated),
+	}
+	for _, key := range keys {
+		obj := b.objects[key]
+		out.Versions = append(out.Versions, s3types.ObjectVersion{
+			Key:          aws.String(key),
+			VersionId:    aws.String("null"),
+			IsLatest:     aws.Bool(true),
+			Size:         aws.Int64(int64(len(obj.body))),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	if truncated {
+		out.NextKeyMarker = aws.String(keys[len(keys)-1])
+		out.NextVersionIdMarker = aws.String("null")
+	}
+	return out, nil
+}
+
+// page returns the keys and common prefixes of a list page, in list order,
+// and whether more follow.
+func (x *S3) page(b *s3Bucket, prefix, delimiter, after string, maxKeys int32) ([]string, bool) {
+	limit := x.PageSize
+	if limit <= 0 {
+		limit = s3PageSize
+	}
+	if maxKeys > 0 {
+		limit = min(limit, int(maxKeys))
+	}
+
+	elements := map[string]bool{}
+	for key := range b.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			key = prefix + rest[:i+len(delimiter)]
+		}
+		elements[key] = true
+	}
+
+	var keys []string
+	for _, key := range slices.SortedFunc(maps.Keys(elements), b.compare) {
+		if b.compare(key, after) <= 0 {
+			continue
+		}
+		if len(keys) == limit {
+			return keys, true
+		}
+		keys = append(keys, key)
+	}
+	return keys, false
+}
+
+// compare orders keys as listings do. Directory buckets order keys by hash, so
+// that listings are not sorted but continuation tokens remain stable.
+func (b *s3Bucket) compare(x, y string) int {
+	if b.directory && y != "" {
+		if c := cmp.Compare(keyHash(x), keyHash(y)); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(x, y)
+}
+
+// keyHash returns the FNV-1a hash of the key.
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// byteRange parses a "bytes=first-last" range of a body of the given size.
+// The last position is clamped to the end of the body.
+func byteRange(value string, size int) (int, int, bool) {
+	spec, ok := strings.CutPrefix(value, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	first, err := strconv.Atoi(from)
+	if err != nil || first >= size {
+		return 0, 0, false
+	}
+	last := size - 1
+	if to != "" {
+		if last, err = strconv.Atoi(to); err != nil || last < first {
+			return 0, 0, false
+		}
+		last = min(last, size-1)
+	}
+	return first, last, true
+}
+
+// bucket returns the bucket with the given name, provided that it belongs to
+// the expected owner.
+func (x *S3) bucket(name, owner *string) (*s3Bucket, error) {
+	b, ok := x.buckets[aws.ToString(name)]
+	if !ok {
+		return nil, &s3types.NoSuchBucket{Message: aws.String("The specified bucket does not exist")}
+	}
+	if err := x.checkOwner(owner); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkOwner denies requests that expect buckets to belong to another
+// account.
+func (x *S3) checkOwner(owner *string) error {
+	if owner != nil && aws.ToString(owner) != x.AccountID {
+		return apiError("AccessDenied", "Access Denied")
+	}
+	return nil
+}
+
+// object returns the object with the given key.
+func (x *S3) object(bucket, owner, key *string) (*s3Object, error) {
+	b, err := x.bucket(bucket, owner)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := b.objects[aws.ToString(key)]
+	if !ok {
+		return nil, noSuchKey()
+	}
+	return obj, nil
+}
+
+// upload returns the multipart upload with the given ID.
+func (x *S3) upload(bucket, owner, key, id *string) (*s3Upload, error) {
+	b, err := x.bucket(bucket, owner)
+	if err != nil {
+		return nil, err
+	}
+	upload, ok := b.uploads[aws.ToString(id)]
+	if !ok || upload.key != aws.ToString(key) {
+		return nil, &s3types.NoSuchUpload{Message: aws.String("The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed.")}
+	}
+	return upload, nil
+}
+
+// checkCondition verifies the If-Match and If-None-Match conditions of a
+// write of the object with the given key.
+func (b *s3Bucket) checkCondition(key string, ifMatch, ifNoneMatch *string) error {
+	existing, ok := b.objects[key]
+	switch {
+	case aws.ToString(ifNoneMatch) == "*" && ok:
+		return preconditionFailed()
+	case ifMatch != nil && !ok:
+		return noSuchKey()
+	case ifMatch != nil && aws.ToString(ifMatch) != existing.etag:
+		return preconditionFailed()
+	}
+	return nil
+}
+
+// newObject returns an object with the body and the settings of the upload.
+func newObject(params *s3.PutObjectInput, body []byte) (*s3Object, error) {
+	obj := &s3Object{
+		body:         body,
+		metadata:     lowerKeys(params.Metadata),
+		etag:         etag(body),
+		modified:     time.Now().UTC(),
+		encryption:   params.ServerSideEncryption,
+		kmsKeyID:     aws.ToString(params.SSEKMSKeyId),
+		bucketKey:    aws.ToBool(params.BucketKeyEnabled),
+		storageClass: params.StorageClass,
+	}
+	if obj.encryption == "" {
+		// Objects are encrypted with SSE-S3 by default.
+		obj.encryption = s3types.ServerSideEncryptionAes256
+	}
+	if obj.storageClass == "" {
+		obj.storageClass = s3types.StorageClassStandard
+	}
+	if params.SSECustomerKey != nil {
+		var err error
+		if obj.customerKeyMD5, err = customerKeyMD5(params.SSECustomerAlgorithm, params.SSECustomerKey, params.SSECustomerKeyMD5); err != nil {
+			return nil, err
+		}
+		obj.encryption = ""
+	}
+	if params.Tagging != nil {
+		tags, err := url.ParseQuery(aws.ToString(params.Tagging))
+		if err != nil {
+			return nil, apiError("InvalidArgument", "The header 'x-amz-tagging' shall be encoded as UTF-8 then URLEncoded URL query parameters without tag name duplicates.")
+		}
+		obj.tags = map[string]string{}
+		for k := range tags {
+			obj.tags[k] = tags.Get(k)
+		}
+	}
+	return obj, nil
+}
+
+// etag returns the ETag of an object uploaded in one piece, which is the MD5
+// digest of its body.
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// checkCustomerKey verifies the SSE-C key sent to read an object. Objects
+// written without customer key can be read without one.
+func (x *s3Object) checkCustomerKey(algorithm, key, keyMD5 *string) error {
+	if x.customerKeyMD5 == "" {
+		return nil
+	}
+	if key == nil {
+		return apiError("InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+	}
+
+	digest, err := customerKeyMD5(algorithm, key, keyMD5)
+	if err != nil {
+		return err
+	}
+	if digest != x.customerKeyMD5 {
+		return apiError("AccessDenied", "Access Denied")
+	}
+	return nil
+}
+
+// encryptionHeaders returns the encryption headers of the responses that
+// return the object.
+func (x *s3Object) encryptionHeaders() (s3types.ServerSideEncryption, *string, *bool, *string, *string) {
+	if x.customerKeyMD5 != "" {
+		return "", nil, nil, aws.String(string(s3types.ServerSideEncryptionAes256)), aws.String(x.customerKeyMD5)
+	}
+
+	var kmsKeyID *string
+	if x.kmsKeyID != "" {
+		kmsKeyID = aws.String(x.kmsKeyID)
+	}
+	return x.encryption, kmsKeyID, aws.Bool(x.bucketKey), nil, nil
+}
+
+// customerKeyMD5 validates the headers of an SSE-C key and returns the
+// digest of the key.
+func customerKeyMD5(algorithm, key, keyMD5 *string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(aws.ToString(key))
+	if err != nil || aws.ToString(algorithm) != string(s3types.ServerSideEncryptionAes256) || len(decoded) != 32 {
+		return "", apiError("InvalidArgument", "The secret key was invalid for the specified algorithm.")
+	}
+
+	sum := md5.Sum(decoded)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+	if keyMD5 != nil && aws.ToString(keyMD5) != digest {
+		return "", apiError("InvalidArgument", "The calculated MD5 hash of the key did not match the hash that was provided.")
+	}
+	return digest, nil
+}
+
+// lowerKeys returns a copy of the metadata with lowercase keys, as S3
+// normalises user-defined metadata keys.
+func lowerKeys(metadata map[string]string) map[string]string {
+	out := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// checkChecksums verifies the CRC32C and SHA-256 checksums of an upload.
+func checkChecksums(params *s3.PutObjectInput, body []byte) error {
+	if params.ChecksumCRC32C != nil {
+		sum := binary.BigEndian.AppendUint32(nil, crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)))
+		if aws.ToString(params.ChecksumCRC32C) != base64.StdEncoding.EncodeToString(sum) {
+			return badDigest("CRC32C")
+		}
+	}
+	if params.ChecksumSHA256 != nil {
+		sum := sha256.Sum256(body)
+		if aws.ToString(params.ChecksumSHA256) != base64.StdEncoding.EncodeToString(sum[:]) {
+			return badDigest("SHA256")
+		}
+	}
+	return nil
+}
+
+// badDigest returns the error S3 reports when an upload does not match its
+// checksum.
+func badDigest(algorithm string) error {
+	return apiError("BadDigest", "The "+algorithm+" you specified did not match the calculated checksum.")
+}
+
+// noSuchKey returns the error S3 reports for missing objects.
+func noSuchKey() error {
+	return &s3types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+}
+
+// preconditionFailed returns the error S3 reports when the condition of a
+// conditional request does not hold.
+func preconditionFailed() error {
+	return apiError("PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+}
+
+// notImplemented returns the error S3 reports for requests that directory
+// buckets do not support.
+func notImplemented() error {
+	return apiError("NotImplemented", "A header you provided implies functionality that is not implemented")
+}
+
+// apiError returns an S3 error that has no dedicated type.
+func apiError(code, message string) error {
+	return &smithy.GenericAPIError{Code: code, Message: message, Fault: smithy.FaultClient}
+}
@@ -0,0 +1,400 @@
+package pgxawstest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("S3", func() {
+	var (
+		ctx    context.Context
+		client *S3
+		bucket *string
+	)
+
+	put := func(key string) *s3.PutObjectOutput {
+		out, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: bucket,
+			Key:    aws.String(key),
+			Body:   strings.NewReader("value"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return out
+	}
+
+	errorCode := func(err error) string {
+		var aerr smithy.APIError
+		Expect(errors.As(err, &aerr)).To(BeTrue())
+		return aerr.ErrorCode()
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = NewS3()
+		bucket = aws.String("queries")
+
+		_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: bucket})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports missing buckets", func() {
+		_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String("missing")})
+		var nerr *s3types.NotFound
+		Expect(errors.As(err, &nerr)).To(BeTrue())
+	})
+
+	It("stores objects with lowercase metadata keys", func() {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   bucket,
+			Key:      aws.String("a"),
+			Body:     strings.NewReader("value"),
+			Metadata: map[string]string{"Expires-At": "soon"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("a")})
+		Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(out.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("value"))
+		Expect(out.Metadata).To(HaveKeyWithValue("expires-at", "soon"))
+	})
+
+	It("reports missing objects", func() {
+		_, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("missing")})
+		var kerr *s3types.NoSuchKey
+		Expect(errors.As(err, &kerr)).To(BeTrue())
+
+		_, err = client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: bucket, Key: aws.String("missing")})
+		var nerr *s3types.NotFound
+		Expect(errors.As(err, &nerr)).To(BeTrue())
+	})
+
+	It("honours conditional writes", func() {
+		input := &s3.PutObjectInput{Bucket: bucket, Key: aws.String("a"), IfNoneMatch: aws.String("*")}
+		_, err := client.PutObject(ctx, input)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.PutObject(ctx, input)
+		Expect(errorCode(err)).To(Equal("PreconditionFailed"))
+
+		current := put("a")
+		_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String("a"), IfMatch: aws.String(`"stale"`)})
+		Expect(errorCode(err)).To(Equal("PreconditionFailed"))
+
+		_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String("a"), IfMatch: current.ETag})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+
+	It("requires the customer key to read objects encrypted with it", func() {
+		key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               bucket,
+			Key:                  aws.String("a"),
+			Body:                 strings.NewReader("value"),
+			SSECustomerAlgorithm: aws.String("AES256"),
+			SSECustomerKey:       aws.String(key),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("a")})
+		Expect(errorCode(err)).To(Equal("InvalidRequest"))
+
+		out, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               bucket,
+			Key:                  aws.String("a"),
+			SSECustomerAlgorithm: aws.String("AES256"),
+			SSECustomerKey:       aws.String(key),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(aws.ToString(out.SSECustomerAlgorithm)).To(Equal("AES256"))
+
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               bucket,
+			Key:                  aws.String("b"),
+			SSECustomerAlgorithm: aws.String("AES256"),
+			SSECustomerKey:       aws.String("short"),
+		})
+		Expect(errorCode(err)).To(Equal("InvalidArgument"))
+	})
+
+	It("denies requests that expect another bucket owner", func() {
+		client.AccountID = "111122223333"
+		_, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, ExpectedBucketOwner: aws.String("111122223333")})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, ExpectedBucketOwner: aws.String("444455556666")})
+		Expect(errorCode(err)).To(Equal("AccessDenied"))
+	})
+
+	It("verifies upload checksums", func() {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:         bucket,
+			Key:            aws.String("a"),
+			Body:           strings.NewReader("value"),
+			ChecksumCRC32C: aws.String("AAAAAA=="),
+		})
+		Expect(errorCode(err)).To(Equal("BadDigest"))
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+
+	It("paginates listings under a prefix", func() {
+		client.PageSize = 2
+		for i := range 5 {
+			put(fmt.Sprintf("ns/%d", i))
+		}
+		put("other/0")
+
+		var keys []string
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("ns/")})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.ToString(obj.Key))
+			}
+		}
+		Expect(keys).To(Equal([]string{"ns/0", "ns/1", "ns/2", "ns/3", "ns/4"}))
+	})
+
+	It("rolls keys up into common prefixes", func() {
+		client.PageSize = 2
+		for _, key := range []string{"ns/a/0", "ns/a/1", "ns/b/0", "ns/c", "ns/d/0", "other/0"} {
+			put(key)
+		}
+
+		var keys, prefixes []string
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("ns/"), Delimiter: aws.String("/")})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.ToString(obj.Key))
+			}
+			for _, prefix := range page.CommonPrefixes {
+				prefixes = append(prefixes, aws.ToString(prefix.Prefix))
+			}
+		}
+		Expect(keys).To(Equal([]string{"ns/c"}))
+		Expect(prefixes).To(Equal([]string{"ns/a/", "ns/b/", "ns/d/"}))
+	})
+
+	It("limits batch deletes to 1000 objects", func() {
+		objects := make([]s3types.ObjectIdentifier, 1001)
+		for i := range objects {
+			objects[i] = s3types.ObjectIdentifier{Key: aws.String(fmt.Sprint(i))}
+		}
+
+		_, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: bucket, Delete: &s3types.Delete{Objects: objects}})
+		Expect(errorCode(err)).To(Equal("MalformedXML"))
+
+		put("0")
+		_, err = client.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: bucket, Delete: &s3types.Delete{Objects: objects[:1000]}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Keys("queries")).To(BeEmpty())
+	})
+
+	It("stores lifecycle rules", func() {
+		_, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: bucket})
+		Expect(errorCode(err)).To(Equal("NoSuchLifecycleConfiguration"))
+
+		rules := []s3types.LifecycleRule{{ID: aws.String("rule"), Status: s3types.ExpirationStatusEnabled}}
+		_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 bucket,
+			LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{Rules: rules},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		out, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: bucket})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.Rules).To(Equal(rules))
+	})
+
+	It("reads byte ranges", func() {
+		put("a")
+
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("a"), Range: aws.String("bytes=1-100")})
+		Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(out.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("alue"))
+		Expect(aws.ToString(out.ContentRange)).To(Equal("bytes 1-4/5"))
+
+		_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("a"), Range: aws.String("bytes=5-")})
+		Expect(errorCode(err)).To(Equal("InvalidRange"))
+	})
+
+	It("delays reads until the context is done", func() {
+		put("a")
+		client.GetLatency = func() time.Duration { return time.Hour }
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		_, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("a")})
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("assembles multipart uploads", func() {
+		key := aws.String("large")
+		create, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:   bucket,
+			Key:      key,
+			Metadata: map[string]string{"Expires-At": "soon"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Uploads("queries")).To(Equal([]string{"large"}))
+
+		var parts []s3types.CompletedPart
+		for i, body := range [][]byte{bytes.Repeat([]byte("a"), 5<<20), []byte("b")} {
+			out, err := client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     bucket,
+				Key:        key,
+				UploadId:   create.UploadId,
+				PartNumber: aws.Int32(int32(i + 1)),
+				Body:       bytes.NewReader(body),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			parts = append(parts, s3types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(int32(i + 1))})
+		}
+
+		// parts must be listed in order
+		_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          bucket,
+			Key:             key,
+			UploadId:        create.UploadId,
+			MultipartUpload: &s3types.CompletedMultipartUpload{Parts: []s3types.CompletedPart{parts[1], parts[0]}},
+		})
+		Expect(errorCode(err)).To(Equal("InvalidPartOrder"))
+
+		complete, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          bucket,
+			Key:             key,
+			UploadId:        create.UploadId,
+			MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(aws.ToString(complete.ETag)).To(HaveSuffix(`-2"`))
+		Expect(client.Uploads("queries")).To(BeEmpty())
+
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: key})
+		Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(out.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(HaveLen(5<<20 + 1))
+		Expect(out.Metadata).To(HaveKeyWithValue("expires-at", "soon"))
+	})
+
+	It("rejects small parts and aborted uploads", func() {
+		key := aws.String("large")
+		create, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: bucket, Key: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		var parts []s3types.CompletedPart
+		for i := range 2 {
+			out, err := client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     bucket,
+				Key:        key,
+				UploadId:   create.UploadId,
+				PartNumber: aws.Int32(int32(i + 1)),
+				Body:       strings.NewReader("small"),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			parts = append(parts, s3types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(int32(i + 1))})
+		}
+
+		_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          bucket,
+			Key:             key,
+			UploadId:        create.UploadId,
+			MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+		})
+		Expect(errorCode(err)).To(Equal("EntityTooSmall"))
+
+		_, err = client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: bucket, Key: key, UploadId: create.UploadId})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Uploads("queries")).To(BeEmpty())
+
+		_, err = client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     bucket,
+			Key:        key,
+			UploadId:   create.UploadId,
+			PartNumber: aws.Int32(3),
+			Body:       strings.NewReader("late"),
+		})
+		var uerr *s3types.NoSuchUpload
+		Expect(errors.As(err, &uerr)).To(BeTrue())
+	})
+
+	Context("with a directory bucket", func() {
+		BeforeEach(func() {
+			bucket = aws.String("queries--use1-az4--x-s3")
+
+			_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{
+				Bucket: bucket,
+				CreateBucketConfiguration: &s3types.CreateBucketConfiguration{
+					Location: &s3types.LocationInfo{Type: s3types.LocationTypeAvailabilityZone, Name: aws.String("use1-az4")},
+					Bucket:   &s3types.BucketInfo{Type: s3types.BucketTypeDirectory},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects names outside of the zone", func() {
+			_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{
+				Bucket: aws.String("other--use1-az5--x-s3"),
+				CreateBucketConfiguration: &s3types.CreateBucketConfiguration{
+					Location: &s3types.LocationInfo{Type: s3types.LocationTypeAvailabilityZone, Name: aws.String("use1-az4")},
+					Bucket:   &s3types.BucketInfo{Type: s3types.BucketTypeDirectory},
+				},
+			})
+			Expect(errorCode(err)).To(Equal("InvalidBucketName"))
+		})
+
+		It("paginates listings in no particular order", func() {
+			client.PageSize = 2
+			for i := range 10 {
+				put(fmt.Sprintf("ns/%d", i))
+			}
+
+			var keys []string
+			paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("ns/")})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				for _, obj := range page.Contents {
+					keys = append(keys, aws.ToString(obj.Key))
+				}
+			}
+			Expect(keys).To(ConsistOf(client.Keys(aws.ToString(bucket))))
+			Expect(keys).NotTo(Equal(client.Keys(aws.ToString(bucket))))
+		})
+
+		It("rejects prefixes without delimiter", func() {
+			_, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("ns")})
+			Expect(errorCode(err)).To(Equal("InvalidArgument"))
+		})
+
+		It("has no versions", func() {
+			_, err := client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: bucket})
+			Expect(errorCode(err)).To(Equal("NotImplemented"))
+
+			_, err = client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{Bucket: bucket})
+			Expect(errorCode(err)).To(Equal("NotImplemented"))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package pgxawstest_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPgxawstest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "pgxawstest Suite")
+}